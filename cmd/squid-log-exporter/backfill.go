@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"google.golang.org/protobuf/proto"
+
+	"squid-log-exporter/internal/metrics"
+	"squid-log-exporter/internal/parser"
+	"squid-log-exporter/internal/relabel"
+)
+
+// selfMetricsPrefix marks metrics about the exporter process, which are left
+// out of backfills
+const selfMetricsPrefix = "squid_exporter_"
+
+// labelFlags collects repeated --label name=value flags
+type labelFlags map[string]string
+
+func (l labelFlags) String() string {
+	pairs := make([]string, 0, len(l))
+	for name, value := range l {
+		pairs = append(pairs, name+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (l labelFlags) Set(value string) error {
+	name, labelValue, ok := strings.Cut(value, "=")
+	if !ok || !relabel.IsValidLabelName(name) || strings.HasPrefix(name, "__") {
+		return fmt.Errorf("expected name=value with a valid label name, got %q", value)
+	}
+	l[name] = labelValue
+	return nil
+}
+
+// runBackfill implements the backfill subcommand. It replays historical log
+// files by their line timestamps and writes OpenMetrics with a sample of
+// every series at the end of each step, for
+// promtool tsdb create-blocks-from openmetrics.
+func runBackfill(args []string) int {
+	fs := flag.NewFlagSet("backfill", flag.ExitOnError)
+	configFile := fs.String("config", defaultConfigFile, "Path to configuration file")
+	step := fs.Duration("step", time.Minute, "Interval between samples, like the Prometheus scrape interval")
+	startFlag := fs.String("start", "", "Skip lines before this time (RFC 3339 or YYYY-MM-DD)")
+	endFlag := fs.String("end", "", "Skip lines from this time on, e.g. when the exporter was deployed (RFC 3339 or YYYY-MM-DD)")
+	output := fs.String("output", "-", "File to write the OpenMetrics to, - for stdout")
+	labels := labelFlags{}
+	fs.Var(labels, "label", "Label added to every series as name=value, e.g. job=squid (repeatable)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s backfill [--config=FILE] [--step=1m] [--start=TIME] [--end=TIME] [--label=NAME=VALUE]... [--output=FILE] LOGFILE...\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "Log files must be given oldest first and may be gzip or bzip2 compressed; - reads stdin.\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	if *step < time.Second {
+		fmt.Fprintf(os.Stderr, "--step must be at least 1s\n")
+		return 2
+	}
+	start, err := parseTimeFlag(*startFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid --start: %v\n", err)
+		return 2
+	}
+	end, err := parseTimeFlag(*endFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid --end: %v\n", err)
+		return 2
+	}
+
+	cfg, err := loadConfig(*configFile, true)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", *configFile, err)
+		return 1
+	}
+
+	var inputs []parser.ReplayInput
+	for _, name := range fs.Args() {
+		reader, closer, err := openLog(name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		defer closer.Close()
+		inputs = append(inputs, parser.ReplayInput{Name: name, Reader: reader})
+	}
+
+	out := os.Stdout
+	if *output != "-" {
+		if out, err = os.Create(*output); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		defer out.Close()
+	}
+	spool, err := newFamilySpool()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	defer spool.Close()
+
+	m := metrics.NewIsolatedMetrics(cfg.GetCustomLabelKeys())
+	m.SetRelabelConfigs(cfg.RelabelConfigs)
+	p := parser.NewReplayParser(m, cfg)
+
+	emit := func(t time.Time) error {
+		return spoolStep(spool, m, t, labels)
+	}
+	summary, err := p.Backfill(*step, start, end, emit, inputs...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "backfill failed: %v\n", err)
+		return 1
+	}
+
+	writer := bufio.NewWriter(out)
+	if err := spool.writeOpenMetrics(writer); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to write metrics: %v\n", err)
+		return 1
+	}
+	if err := writer.Flush(); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to write metrics: %v\n", err)
+		return 1
+	}
+
+	if summary.Steps == 0 {
+		fmt.Fprintf(os.Stderr, "Read %d lines, no lines in the requested time range\n", summary.LinesRead+summary.LinesSkipped)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "Backfilled %d steps of %s from %s to %s: %d lines read, %d parsed, %d outside the time range\n",
+		summary.Steps, *step, summary.From.Format(time.RFC3339), summary.To.Format(time.RFC3339),
+		summary.LinesRead, summary.LinesParsed, summary.LinesSkipped)
+	return 0
+}
+
+// spoolStep adds every series except the exporter's own metrics to the
+// spool with timestamp t and the extra labels
+func spoolStep(spool *familySpool, m *metrics.Metrics, t time.Time, labels labelFlags) error {
+	families, err := m.Gatherer().Gather()
+	if err != nil {
+		return err
+	}
+
+	for _, family := range families {
+		if strings.HasPrefix(family.GetName(), selfMetricsPrefix) {
+			continue
+		}
+		for _, metric := range family.Metric {
+			metric.TimestampMs = proto.Int64(t.UnixMilli())
+			metric.Label = withLabels(metric.Label, labels)
+		}
+		if err := spool.add(family); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// familySpool keeps the samples of each family across all steps in a
+// temporary file per family. OpenMetrics requires each family, and each
+// series in it, to be written in one piece, while steps produce a sample of
+// every series at a time.
+type familySpool struct {
+	dir   string
+	files map[string]*spoolFile
+}
+
+// spoolFile holds the samples of one family, as length-delimited protobuf
+type spoolFile struct {
+	file    *os.File
+	writer  *bufio.Writer
+	encoder expfmt.Encoder
+}
+
+func newFamilySpool() (*familySpool, error) {
+	dir, err := os.MkdirTemp("", "squid-log-exporter-backfill-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create spool directory: %w", err)
+	}
+	return &familySpool{dir: dir, files: make(map[string]*spoolFile)}, nil
+}
+
+// add appends the samples of one step of a family
+func (s *familySpool) add(family *dto.MetricFamily) error {
+	spool := s.files[family.GetName()]
+	if spool == nil {
+		file, err := os.Create(filepath.Join(s.dir, fmt.Sprintf("%d.pb", len(s.files))))
+		if err != nil {
+			return fmt.Errorf("failed to create spool file: %w", err)
+		}
+		writer := bufio.NewWriter(file)
+		spool = &spoolFile{file: file, writer: writer, encoder: expfmt.NewEncoder(writer, expfmt.NewFormat(expfmt.TypeProtoDelim))}
+		s.files[family.GetName()] = spool
+	}
+	return spool.encoder.Encode(family)
+}
+
+// writeOpenMetrics writes the families in name order as OpenMetrics, each series with
+// its samples in time order, followed by # EOF. One family is read back
+// into memory at a time.
+func (s *familySpool) writeOpenMetrics(w io.Writer) error {
+	names := make([]string, 0, len(s.files))
+	for name := range s.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		family, err := s.files[name].read()
+		if err != nil {
+			return err
+		}
+		if _, err := expfmt.MetricFamilyToOpenMetrics(w, family); err != nil {
+			return err
+		}
+	}
+	_, err := expfmt.FinalizeOpenMetrics(w)
+	return err
+}
+
+// read returns all samples of the family, grouped by series. Steps were
+// spooled in time order, so a stable sort keeps each series in time order.
+func (f *spoolFile) read() (*dto.MetricFamily, error) {
+	if err := f.writer.Flush(); err != nil {
+		return nil, err
+	}
+	if _, err := f.file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	var family *dto.MetricFamily
+	decoder := expfmt.NewDecoder(bufio.NewReader(f.file), expfmt.NewFormat(expfmt.TypeProtoDelim))
+	for {
+		var step dto.MetricFamily
+		err := decoder.Decode(&step)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read spool file: %w", err)
+		}
+		if family == nil {
+			family = &step
+			continue
+		}
+		family.Metric = append(family.Metric, step.Metric...)
+	}
+
+	sort.SliceStable(family.Metric, func(i, j int) bool {
+		return seriesLess(family.Metric[i].Label, family.Metric[j].Label)
+	})
+	return family, nil
+}
+
+// seriesLess orders label sets, which are sorted by name
+func seriesLess(a, b []*dto.LabelPair) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i].GetName() != b[i].GetName() {
+			return a[i].GetName() < b[i].GetName()
+		}
+		if a[i].GetValue() != b[i].GetValue() {
+			return a[i].GetValue() < b[i].GetValue()
+		}
+	}
+	return len(a) < len(b)
+}
+
+// Close removes the spool files
+func (s *familySpool) Close() error {
+	for _, spool := range s.files {
+		spool.file.Close()
+	}
+	return os.RemoveAll(s.dir)
+}
+
+// withLabels sets the extra labels on a label set, replacing existing values
+func withLabels(pairs []*dto.LabelPair, labels labelFlags) []*dto.LabelPair {
+	if len(labels) == 0 {
+		return pairs
+	}
+
+	result := make([]*dto.LabelPair, 0, len(pairs)+len(labels))
+	for _, pair := range pairs {
+		if _, ok := labels[pair.GetName()]; !ok {
+			result = append(result, pair)
+		}
+	}
+	for name, value := range labels {
+		result = append(result, &dto.LabelPair{Name: proto.String(name), Value: proto.String(value)})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].GetName() < result[j].GetName()
+	})
+	return result
+}
+
+// parseTimeFlag parses an RFC 3339 time or a local date; empty is zero
+func parseTimeFlag(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02", value, time.Local)
+}
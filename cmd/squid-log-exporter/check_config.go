@@ -0,0 +1,66 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"squid-log-exporter/internal/config"
+	"squid-log-exporter/internal/web"
+)
+
+// runCheckConfig implements the check-config subcommand. It prints every
+// problem as file:line: severity: message and returns a non-zero exit code
+// if any error was found, so it can gate deployments.
+func runCheckConfig(args []string) int {
+	fs := flag.NewFlagSet("check-config", flag.ExitOnError)
+	configFile := fs.String("config", defaultConfigFile, "Path to configuration file")
+	webConfigFile := fs.String("web-config-file", "", "Path to a web configuration file to check as well")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s check-config [--config=FILE | FILE]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() > 0 {
+		*configFile = fs.Arg(0)
+	}
+
+	if *webConfigFile != "" {
+		if _, err := web.LoadConfig(*webConfigFile); err != nil {
+			fmt.Printf("%s: error: %v\n", *webConfigFile, err)
+			fmt.Printf("%s: FAILED\n", *webConfigFile)
+			return 1
+		}
+		fmt.Printf("%s: OK\n", *webConfigFile)
+	}
+
+	problems, err := config.Validate(*configFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", *configFile, err)
+		return 1
+	}
+
+	errorCount, warningCount := 0, 0
+	for _, p := range problems {
+		if p.Line > 0 {
+			fmt.Printf("%s:%d: %s: %s\n", *configFile, p.Line, p.Severity, p.Message)
+		} else {
+			fmt.Printf("%s: %s: %s\n", *configFile, p.Severity, p.Message)
+		}
+
+		if p.Severity == config.SeverityError {
+			errorCount++
+		} else {
+			warningCount++
+		}
+	}
+
+	if errorCount > 0 {
+		fmt.Printf("%s: FAILED (%d errors, %d warnings)\n", *configFile, errorCount, warningCount)
+		return 1
+	}
+
+	fmt.Printf("%s: OK (%d warnings)\n", *configFile, warningCount)
+	return 0
+}
@@ -19,19 +19,25 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
+	"fmt"
+	"io/fs"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	"squid-log-exporter/internal/config"
 	"squid-log-exporter/internal/metrics"
 	"squid-log-exporter/internal/parser"
+	"squid-log-exporter/internal/web"
 )
 
 var (
@@ -40,42 +46,86 @@ var (
 	date    = "unknown"
 )
 
+const defaultConfigFile = "/etc/squid-log-exporter/config.yaml"
+
 func main() {
+	// Subcommands
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "check-config":
+			os.Exit(runCheckConfig(os.Args[2:]))
+		case "test-line":
+			os.Exit(runTestLine(os.Args[2:]))
+		case "replay":
+			os.Exit(runReplay(os.Args[2:]))
+		case "backfill":
+			os.Exit(runBackfill(os.Args[2:]))
+		}
+	}
+
 	var (
 		listenAddr   = flag.String("listen-address", ":9448", "The address to listen on for HTTP requests")
 		metricsPath  = flag.String("metrics-path", "/metrics", "Path under which to expose metrics")
+		webConfig    = flag.String("web-config-file", "", "Path to a web configuration file enabling TLS and basic authentication")
 		logFile      = flag.String("log-file", "/var/log/squid/access.log", "Path to Squid access log")
-		configFile   = flag.String("config", "/etc/squid-log-exporter/config.yaml", "Path to configuration file")
+		configFile   = flag.String("config", defaultConfigFile, "Path to configuration file")
 		positionFile = flag.String("position-file", "/var/lib/squid-log-exporter/position.json", "Path to position tracking file")
 		interval     = flag.Duration("interval", 60*time.Second, "Interval for parsing logs")
+		strictConfig = flag.Bool("strict-config", true, "Exit on configuration errors instead of falling back to defaults")
 		showVersion  = flag.Bool("version", false, "Show version information")
 	)
 	flag.Parse()
 
+	opts, err := newSettings(flag.CommandLine)
+	if err != nil {
+		log.Fatalf("Invalid environment variable: %v", err)
+	}
+
 	if *showVersion {
 		log.Printf("squid-log-exporter version %s (commit: %s, built: %s)", version, commit, date)
 		os.Exit(0)
 	}
 
+	started := time.Now()
 	log.Printf("Starting squid-log-exporter version %s", version)
-	log.Printf("Listen address: %s", *listenAddr)
-	log.Printf("Metrics path: %s", *metricsPath)
-	log.Printf("Log file: %s", *logFile)
-	log.Printf("Config file: %s", *configFile)
-	log.Printf("Position file: %s", *positionFile)
-	log.Printf("Parse interval: %s", *interval)
+	log.Printf("Config file: %s (%s)", *configFile, opts.source("config"))
 
 	// Load configuration
-	cfg, err := config.LoadConfig(*configFile)
+	cfg, err := loadConfig(*configFile, *strictConfig)
+	configLoaded := err == nil
 	if err != nil {
+		// Like before strict mode, a missing file at the default path means
+		// running with the defaults; an explicitly given file must exist
+		missingDefault := errors.Is(err, fs.ErrNotExist) && opts.source("config") == sourceDefault
+		if *strictConfig && !missingDefault {
+			log.Fatalf("Invalid configuration: %v (run '%s check-config --config=%s' for details, or use --strict-config=false to fall back to defaults)",
+				err, os.Args[0], *configFile)
+		}
 		log.Printf("Warning: failed to load config: %v, using defaults", err)
 		cfg = getDefaultConfig()
-	} else {
+	}
+
+	// Options not given as flags or environment variables come from the file
+	if err := opts.applyFile(cfg); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	opts.effective(cfg)
+
+	log.Printf("Listen address: %s (%s)", *listenAddr, opts.source("listen-address"))
+	log.Printf("Metrics path: %s (%s)", *metricsPath, opts.source("metrics-path"))
+	log.Printf("Web config file: %s (%s)", *webConfig, opts.source("web-config-file"))
+	log.Printf("Log file: %s (%s)", *logFile, opts.source("log-file"))
+	log.Printf("Position file: %s (%s)", *positionFile, opts.source("position-file"))
+	log.Printf("Parse interval: %s (%s)", *interval, opts.source("interval"))
+
+	if configLoaded {
 		log.Printf("Configuration loaded:")
 		log.Printf("  Log format: %s", cfg.LogFormat.Type)
 		log.Printf("  Duration unit: %s", cfg.LogFormat.DurationUnit)
 		log.Printf("  Track all domains: %v", cfg.Global.TrackAllDomains)
 		log.Printf("  Max domains: %d", cfg.Global.MaxDomains)
+		log.Printf("  Domain TTL: %s (LRU eviction: %v)", cfg.Global.DomainTTL, cfg.Global.EvictLRU)
+		log.Printf("  Site aggregation: %v", cfg.Global.SiteAggregation)
 		log.Printf("  Monitored domains: %d", len(cfg.MonitoredDomains))
 		log.Printf("  Domain patterns: %d", len(cfg.DomainPatterns))
 
@@ -86,9 +136,19 @@ func main() {
 		}
 	}
 
+	if dump, err := cfg.Dump(); err == nil {
+		log.Printf("Effective configuration:\n%s", dump)
+	}
+
+	// Configuration served on /config, replaced on reload
+	var current atomic.Pointer[config.Config]
+	current.Store(cfg)
+
 	// Initialize metrics with custom label keys
 	customLabelKeys := cfg.GetCustomLabelKeys()
 	m := metrics.NewMetrics(customLabelKeys)
+	m.SetRelabelConfigs(cfg.RelabelConfigs)
+	m.SetConfigReload(configLoaded)
 
 	// Initialize parser
 	p := parser.NewParser(*logFile, *positionFile, m, cfg)
@@ -97,15 +157,78 @@ func main() {
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 
+	// Configuration reload via SIGHUP or POST /-/reload
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	reloadChan := make(chan chan error)
+	// Closed when the main loop stops taking reload requests
+	stopping := make(chan struct{})
+
 	// HTTP server
 	mux := http.NewServeMux()
-	mux.Handle(*metricsPath, promhttp.Handler())
+	mux.Handle(*metricsPath, promhttp.InstrumentMetricHandler(
+		prometheus.DefaultRegisterer,
+		promhttp.HandlerFor(m.Gatherer(), promhttp.HandlerOpts{}),
+	))
+	mux.HandleFunc("/-/reload", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost && r.Method != http.MethodPut {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			fmt.Fprintf(w, "This endpoint requires a POST request.\n")
+			return
+		}
+
+		// The main loop takes the request between parse cycles; a client
+		// that gives up waiting cancels it, or leaves it running if taken
+		errChan := make(chan error, 1)
+		select {
+		case reloadChan <- errChan:
+		case <-stopping:
+			http.Error(w, "shutting down, configuration not reloaded", http.StatusServiceUnavailable)
+			return
+		case <-r.Context().Done():
+			return
+		}
+
+		select {
+		case err := <-errChan:
+			if err != nil {
+				http.Error(w, fmt.Sprintf("failed to reload config: %v", err), http.StatusInternalServerError)
+			}
+		case <-r.Context().Done():
+		}
+	})
+	mux.HandleFunc("/-/healthy", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "Squid Log Exporter is Healthy.\n")
+	})
+	mux.HandleFunc("/-/ready", func(w http.ResponseWriter, r *http.Request) {
+		if err := p.Ready(); err != nil {
+			http.Error(w, fmt.Sprintf("Squid Log Exporter is not ready: %v", err), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintf(w, "Squid Log Exporter is Ready.\n")
+	})
+	mux.HandleFunc("/config", func(w http.ResponseWriter, r *http.Request) {
+		dump, err := current.Load().Dump()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to dump config: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write(dump)
+	})
+	status := statusSource{parser: p, config: &current, started: started}
+	mux.HandleFunc("/status", status.servePage)
+	mux.HandleFunc("/api/v1/status", status.serveAPI)
+	mux.HandleFunc("/api/v1/top", serveTop(p))
+	mux.HandleFunc("/api/v1/parse", serveParse(p))
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(`<html>
 <head><title>Squid Log Exporter</title></head>
 <body>
 <h1>Squid Log Exporter</h1>
 <p><a href='` + *metricsPath + `'>Metrics</a></p>
+<p><a href='/status'>Status</a></p>
+<p><a href='/config'>Configuration</a></p>
 <p>Version: ` + version + `</p>
 </body>
 </html>`))
@@ -115,11 +238,19 @@ func main() {
 		Addr:    *listenAddr,
 		Handler: mux,
 	}
+	webServer, err := web.NewServer(*webConfig)
+	if err != nil {
+		log.Fatalf("Invalid web configuration: %v", err)
+	}
 
 	// Start HTTP server in goroutine
 	go func() {
-		log.Printf("Starting HTTP server on %s", *listenAddr)
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		scheme := "HTTP"
+		if webServer.TLSEnabled() {
+			scheme = "HTTPS"
+		}
+		log.Printf("Starting %s server on %s", scheme, *listenAddr)
+		if err := webServer.ListenAndServe(server); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("HTTP server error: %v", err)
 		}
 	}()
@@ -147,8 +278,23 @@ func main() {
 				log.Printf("Error parsing log: %v", err)
 			}
 
+		case <-hupChan:
+			log.Println("Received SIGHUP, reloading configuration...")
+			if err := reloadConfig(*configFile, *strictConfig, opts, &current, p, m); err != nil {
+				log.Printf("Error reloading config: %v", err)
+			}
+
+		case errChan := <-reloadChan:
+			log.Println("Reload requested via HTTP, reloading configuration...")
+			err := reloadConfig(*configFile, *strictConfig, opts, &current, p, m)
+			if err != nil {
+				log.Printf("Error reloading config: %v", err)
+			}
+			errChan <- err
+
 		case sig := <-sigChan:
 			log.Printf("Received shutdown signal: %s", sig)
+			close(stopping)
 
 			// Stop ticker
 			ticker.Stop()
@@ -174,6 +320,55 @@ func main() {
 	}
 }
 
+// loadConfig loads the configuration file. In strict mode the file is also
+// validated and any error-level problem (unknown keys, duplicates, invalid
+// label names, ...) fails the load.
+func loadConfig(configFile string, strict bool) (*config.Config, error) {
+	cfg, err := config.LoadConfig(configFile)
+	if err != nil || !strict {
+		return cfg, err
+	}
+
+	problems, err := config.Validate(configFile)
+	if err != nil {
+		return nil, err
+	}
+	for _, problem := range problems {
+		log.Printf("Config %s: %s", configFile, problem)
+	}
+	if config.HasErrors(problems) {
+		return nil, fmt.Errorf("configuration %s has errors", configFile)
+	}
+
+	return cfg, nil
+}
+
+// reloadConfig loads and validates the configuration file and swaps it into
+// the parser. On failure the running configuration is kept.
+func reloadConfig(configFile string, strict bool, opts *settings, current *atomic.Pointer[config.Config], p *parser.Parser, m *metrics.Metrics) error {
+	cfg, err := loadConfig(configFile, strict)
+	if err != nil {
+		m.SetConfigReload(false)
+		return err
+	}
+
+	// Server and input options are only read at startup
+	if names := opts.changed(cfg); len(names) > 0 {
+		log.Printf("Warning: changes to %v take effect after a restart", names)
+	}
+	opts.effective(cfg)
+	current.Store(cfg)
+
+	p.SetConfig(cfg)
+	m.SetRelabelConfigs(cfg.RelabelConfigs)
+	m.SetConfigReload(true)
+
+	log.Printf("Configuration reloaded: %d monitored domains, %d domain patterns",
+		len(cfg.MonitoredDomains), len(cfg.DomainPatterns))
+
+	return nil
+}
+
 func getDefaultConfig() *config.Config {
 	return &config.Config{
 		Global: config.GlobalConfig{
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/prometheus/common/expfmt"
+
+	"squid-log-exporter/internal/metrics"
+	"squid-log-exporter/internal/parser"
+)
+
+// runReplay implements the replay subcommand. It runs historical log files
+// through the parser and metrics pipeline and writes the resulting metrics,
+// without touching the position file or any state file.
+func runReplay(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	configFile := fs.String("config", defaultConfigFile, "Path to configuration file")
+	format := fs.String("format", "text", "Output format: text (Prometheus text format) or openmetrics")
+	output := fs.String("output", "-", "File to write the metrics to, - for stdout")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s replay [--config=FILE] [--format=text|openmetrics] [--output=FILE] LOGFILE...\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "Log files may be gzip or bzip2 compressed; - reads stdin.\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	var encoding expfmt.Format
+	switch *format {
+	case "text":
+		encoding = expfmt.NewFormat(expfmt.TypeTextPlain)
+	case "openmetrics":
+		encoding = expfmt.NewFormat(expfmt.TypeOpenMetrics)
+	default:
+		fmt.Fprintf(os.Stderr, "invalid --format %q (valid: text, openmetrics)\n", *format)
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	cfg, err := loadConfig(*configFile, true)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", *configFile, err)
+		return 1
+	}
+
+	var inputs []parser.ReplayInput
+	for _, name := range fs.Args() {
+		reader, closer, err := openLog(name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		defer closer.Close()
+		inputs = append(inputs, parser.ReplayInput{Name: name, Reader: reader})
+	}
+
+	m := metrics.NewIsolatedMetrics(cfg.GetCustomLabelKeys())
+	m.SetRelabelConfigs(cfg.RelabelConfigs)
+	p := parser.NewReplayParser(m, cfg)
+
+	stats, err := p.Replay(inputs...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "replay failed: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "Replayed %d lines from %d files: %d parsed, %d rejected\n",
+		stats.LinesRead, len(inputs), stats.LinesParsed, stats.LinesRead-stats.LinesParsed)
+
+	if err := writeMetrics(*output, m, encoding); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to write metrics: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// openLog opens a log file for replay, decompressing gzip and bzip2 files
+// detected by their magic bytes. The name - is stdin.
+func openLog(name string) (io.Reader, io.Closer, error) {
+	file := os.Stdin
+	if name != "-" {
+		var err error
+		if file, err = os.Open(name); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	reader := bufio.NewReader(file)
+	magic, _ := reader.Peek(3)
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			file.Close()
+			return nil, nil, fmt.Errorf("%s: %w", name, err)
+		}
+		return gz, file, nil
+	case bytes.Equal(magic, []byte("BZh")):
+		return bzip2.NewReader(reader), file, nil
+	}
+
+	return reader, file, nil
+}
+
+// writeMetrics gathers all metrics, sorted by name, and writes them to file
+// or to stdout for -
+func writeMetrics(file string, m *metrics.Metrics, format expfmt.Format) error {
+	families, err := m.Gatherer().Gather()
+	if err != nil {
+		return err
+	}
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].GetName() < families[j].GetName()
+	})
+
+	out := os.Stdout
+	if file != "-" {
+		if out, err = os.Create(file); err != nil {
+			return err
+		}
+	}
+
+	writer := bufio.NewWriter(out)
+	encoder := expfmt.NewEncoder(writer, format)
+	for _, family := range families {
+		if err := encoder.Encode(family); err != nil {
+			return err
+		}
+	}
+	if closer, ok := encoder.(expfmt.Closer); ok {
+		if err := closer.Close(); err != nil {
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+
+	if out != os.Stdout {
+		return out.Close()
+	}
+	return nil
+}
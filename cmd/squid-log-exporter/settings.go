@@ -0,0 +1,138 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"squid-log-exporter/internal/config"
+)
+
+// envPrefix is prepended to a flag name to form its environment variable,
+// e.g. SQUID_LOG_EXPORTER_LISTEN_ADDRESS for --listen-address
+const envPrefix = "SQUID_LOG_EXPORTER_"
+
+// Where the value of an option came from, highest precedence first
+const (
+	sourceFlag    = "flag"
+	sourceEnv     = "environment"
+	sourceFile    = "config file"
+	sourceDefault = "default"
+)
+
+// settings resolves command-line options with the precedence
+// flag > environment variable > config file > default
+type settings struct {
+	flags   *flag.FlagSet
+	sources map[string]string
+}
+
+// newSettings records which flags were given on the command line and fills
+// the others from their environment variables
+func newSettings(flags *flag.FlagSet) (*settings, error) {
+	s := &settings{flags: flags, sources: make(map[string]string)}
+	flags.VisitAll(func(f *flag.Flag) {
+		s.sources[f.Name] = sourceDefault
+	})
+	flags.Visit(func(f *flag.Flag) {
+		s.sources[f.Name] = sourceFlag
+	})
+
+	var err error
+	flags.VisitAll(func(f *flag.Flag) {
+		if err != nil || s.sources[f.Name] != sourceDefault {
+			return
+		}
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok {
+			return
+		}
+		if setErr := flags.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("%s: %w", envName(f.Name), setErr)
+			return
+		}
+		s.sources[f.Name] = sourceEnv
+	})
+
+	return s, err
+}
+
+// envName returns the environment variable for a flag
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// fileSettings maps flag names to their value in the config file. Empty
+// values are not set in the file.
+func fileSettings(cfg *config.Config) map[string]string {
+	values := map[string]string{
+		"listen-address":  cfg.Server.ListenAddress,
+		"metrics-path":    cfg.Server.MetricsPath,
+		"web-config-file": cfg.Server.WebConfigFile,
+		"log-file":        cfg.Input.LogFile,
+		"position-file":   cfg.Input.PositionFile,
+		"interval":        "",
+	}
+	if cfg.Input.Interval > 0 {
+		values["interval"] = cfg.Input.Interval.String()
+	}
+	return values
+}
+
+// applyFile sets the options given neither as a flag nor in the environment
+// from the config file
+func (s *settings) applyFile(cfg *config.Config) error {
+	for name, value := range fileSettings(cfg) {
+		if value == "" || s.sources[name] != sourceDefault {
+			continue
+		}
+		if err := s.flags.Set(name, value); err != nil {
+			return fmt.Errorf("invalid value %q for %s: %w", value, name, err)
+		}
+		s.sources[name] = sourceFile
+	}
+	return nil
+}
+
+// changed returns the options whose config file value differs from the
+// running one although the file is what decides them
+func (s *settings) changed(cfg *config.Config) []string {
+	var names []string
+	for name, value := range fileSettings(cfg) {
+		switch s.sources[name] {
+		case sourceFile:
+			if value != s.value(name) {
+				names = append(names, name)
+			}
+		case sourceDefault:
+			if value != "" && value != s.value(name) {
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// effective stores the running option values in cfg, so that dumps show
+// the settings actually in use
+func (s *settings) effective(cfg *config.Config) {
+	cfg.Server.ListenAddress = s.value("listen-address")
+	cfg.Server.MetricsPath = s.value("metrics-path")
+	cfg.Server.WebConfigFile = s.value("web-config-file")
+	cfg.Input.LogFile = s.value("log-file")
+	cfg.Input.PositionFile = s.value("position-file")
+	cfg.Input.Interval = s.flags.Lookup("interval").Value.(flag.Getter).Get().(time.Duration)
+}
+
+func (s *settings) value(name string) string {
+	return s.flags.Lookup(name).Value.String()
+}
+
+// source returns where the value of an option came from
+func (s *settings) source(name string) string {
+	return s.sources[name]
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"squid-log-exporter/internal/config"
+	"squid-log-exporter/internal/parser"
+)
+
+// statusResponse is the body of /api/v1/status
+type statusResponse struct {
+	Version   string    `json:"version"`
+	StartTime time.Time `json:"start_time"`
+	parser.Status
+	Config any `json:"config"`
+}
+
+// statusSource gathers everything the status endpoints show
+type statusSource struct {
+	parser  *parser.Parser
+	config  *atomic.Pointer[config.Config]
+	started time.Time
+}
+
+func (s statusSource) status() (statusResponse, string, error) {
+	dump, err := s.config.Load().Dump()
+	if err != nil {
+		return statusResponse{}, "", err
+	}
+	var tree any
+	if err := yaml.Unmarshal(dump, &tree); err != nil {
+		return statusResponse{}, "", err
+	}
+
+	return statusResponse{
+		Version:   version,
+		StartTime: s.started,
+		Status:    s.parser.Status(),
+		Config:    tree,
+	}, string(dump), nil
+}
+
+// serveAPI serves /api/v1/status
+func (s statusSource) serveAPI(w http.ResponseWriter, r *http.Request) {
+	status, _, err := s.status()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to get status: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(status)
+}
+
+// servePage serves /status
+func (s statusSource) servePage(w http.ResponseWriter, r *http.Request) {
+	status, dump, err := s.status()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to get status: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := statusTemplate.Execute(w, struct {
+		statusResponse
+		ConfigYAML string
+	}{status, dump}); err != nil {
+		http.Error(w, fmt.Sprintf("failed to render status: %v", err), http.StatusInternalServerError)
+	}
+}
+
+var statusTemplate = template.Must(template.New("status").Funcs(template.FuncMap{
+	"labels": func(labels map[string]string) string {
+		pairs := make([]string, 0, len(labels))
+		for name, value := range labels {
+			pairs = append(pairs, name+"="+value)
+		}
+		sort.Strings(pairs)
+		return strings.Join(pairs, ", ")
+	},
+	"time": func(t time.Time) string {
+		return t.Format(time.RFC3339)
+	},
+}).Parse(`<html>
+<head>
+<title>Squid Log Exporter Status</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { border: 1px solid #ccc; padding: 2px 8px; text-align: left; }
+pre { background: #f4f4f4; padding: 8px; }
+</style>
+</head>
+<body>
+<h1>Squid Log Exporter Status</h1>
+<table>
+<tr><th>Version</th><td>{{.Version}}</td></tr>
+<tr><th>Started</th><td>{{time .StartTime}}</td></tr>
+<tr><th>Ready</th><td>{{if .Ready}}yes{{else}}no: {{.NotReadyReason}}{{end}}</td></tr>
+<tr><th>Last parse</th><td>{{if .LastParse}}{{time .LastParse}} ({{.LastParseLines}} lines in {{printf "%.3f" .LastParseSeconds}}s){{else}}not yet{{end}}</td></tr>
+<tr><th>Lines read since start</th><td>{{.LinesRead}}</td></tr>
+<tr><th>Tracked domains</th><td>{{if .TrackAllDomains}}{{.TrackedDomains}} hosts, {{.TrackedSites}} sites of max_domains {{.MaxDomains}}{{else}}track_all_domains is off{{end}}</td></tr>
+</table>
+
+<h2>Inputs</h2>
+<table>
+<tr><th>File</th><th>Position file</th><th>Inode</th><th>Offset</th><th>Size</th></tr>
+{{range .Inputs}}<tr><td>{{.File}}</td><td>{{.PositionFile}}</td><td>{{.Inode}}</td><td>{{.Offset}}</td><td>{{.Size}}</td></tr>
+{{end}}</table>
+
+<h2>Monitored Domains (last parse cycle)</h2>
+{{if .MonitoredDomains}}<table>
+<tr><th>Host</th><th>Port</th><th>Labels</th><th>Requests</th><th>Requests/s</th></tr>
+{{range .MonitoredDomains}}<tr><td>{{.Host}}</td><td>{{.Port}}</td><td>{{labels .Labels}}</td><td>{{.Requests}}</td><td>{{printf "%.2f" .RequestsPerSecond}}</td></tr>
+{{end}}</table>{{else}}<p>No monitored domain traffic in the last parse cycle.</p>{{end}}
+
+<h2>Recent Parse Errors</h2>
+{{if .RecentErrors}}<table>
+<tr><th>Time</th><th>Reason</th><th>Error</th><th>Line</th></tr>
+{{range .RecentErrors}}<tr><td>{{time .Time}}</td><td>{{.Reason}}</td><td>{{.Error}}</td><td><code>{{.Line}}</code></td></tr>
+{{end}}</table>{{else}}<p>None.</p>{{end}}
+
+<h2>Effective Configuration</h2>
+<pre>{{.ConfigYAML}}</pre>
+</body>
+</html>
+`))
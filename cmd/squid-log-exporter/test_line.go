@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"squid-log-exporter/internal/config"
+	"squid-log-exporter/internal/parser"
+)
+
+// Limits of POST /api/v1/parse
+const (
+	maxParseBodyBytes = 1 << 20
+	maxParseLines     = 1000
+)
+
+// runTestLine implements the test-line subcommand. It explains how the
+// configured log format and rules read each line given as an argument or on
+// stdin, and returns a non-zero exit code if any line was rejected.
+func runTestLine(args []string) int {
+	fs := flag.NewFlagSet("test-line", flag.ExitOnError)
+	configFile := fs.String("config", defaultConfigFile, "Path to configuration file")
+	output := fs.String("output", "text", "Output format: text or json")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s test-line [--config=FILE] [--output=text|json] [LINE...]\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "Reads lines from stdin if none are given.\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *output != "text" && *output != "json" {
+		fmt.Fprintf(os.Stderr, "invalid --output %q (valid: text, json)\n", *output)
+		return 2
+	}
+
+	cfg, err := config.LoadConfig(*configFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", *configFile, err)
+		return 1
+	}
+
+	lines := fs.Args()
+	if len(lines) == 0 {
+		lines, err = readLines(os.Stdin, 0)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to read stdin: %v\n", err)
+			return 1
+		}
+	}
+
+	status := 0
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	for i, line := range lines {
+		report := parser.ExplainLine(cfg, line)
+		if report.RejectReason != "" {
+			status = 1
+		}
+
+		if *output == "json" {
+			encoder.Encode(report)
+			continue
+		}
+		if i > 0 {
+			fmt.Println()
+		}
+		printLineReport(os.Stdout, report)
+	}
+
+	return status
+}
+
+// readLines returns the non-empty lines of r, at most max if max > 0
+func readLines(r io.Reader, max int) ([]string, error) {
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxParseBodyBytes)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if max > 0 && len(lines) >= max {
+			return nil, fmt.Errorf("more than %d lines", max)
+		}
+		lines = append(lines, line)
+	}
+	return lines, scanner.Err()
+}
+
+// printLineReport writes a report in the text format of test-line
+func printLineReport(w io.Writer, report parser.LineReport) {
+	fmt.Fprintf(w, "line: %s\n", report.Line)
+	fmt.Fprintf(w, "fields (%d):\n", len(report.Fields))
+	for i, field := range report.Fields {
+		fmt.Fprintf(w, "  [%d] %s\n", i, field)
+	}
+	fmt.Fprintf(w, "mapping:\n")
+	for _, mapping := range report.Mapping {
+		value := mapping.Value
+		if mapping.Index >= len(report.Fields) {
+			value = "<missing>"
+		}
+		fmt.Fprintf(w, "  %-14s [%d] %s\n", mapping.Name, mapping.Index, value)
+	}
+
+	if report.Error != "" {
+		fmt.Fprintf(w, "result: rejected (%s): %s\n", report.RejectReason, report.Error)
+		return
+	}
+
+	fmt.Fprintf(w, "cache status: %s", report.CacheStatus)
+	if report.CacheResult != "" {
+		fmt.Fprintf(w, " (%s)", report.CacheResult)
+	}
+	fmt.Fprintf(w, "\nhttp code: %s (%s)\n", report.HTTPCode, report.Category)
+	fmt.Fprintf(w, "bytes: %d\n", report.Bytes)
+	fmt.Fprintf(w, "duration: %gs\n", report.DurationSeconds)
+
+	if report.RuleGroup != "" || len(report.RuleLabels) > 0 {
+		fmt.Fprintf(w, "rules: group=%q labels={%s}\n", report.RuleGroup, formatLabels(report.RuleLabels))
+	}
+
+	if report.URLError != "" {
+		fmt.Fprintf(w, "url: rejected (%s): %s\n", report.RejectReason, report.URLError)
+	}
+	if report.Host != "" {
+		fmt.Fprintf(w, "host: %s\nport: %s\n", report.Host, report.Port)
+	}
+	if report.Path != "" {
+		fmt.Fprintf(w, "path: %s\n", report.Path)
+	}
+	if report.Site != "" {
+		fmt.Fprintf(w, "site: %s\n", report.Site)
+	}
+
+	if report.DroppedBy != "" {
+		fmt.Fprintf(w, "result: dropped by rule %s\n", report.DroppedBy)
+		return
+	}
+	if report.Host == "" {
+		fmt.Fprintf(w, "result: counted in global metrics only (no target host)\n")
+		return
+	}
+	if report.Monitored == nil {
+		fmt.Fprintf(w, "result: counted, not monitored\n")
+		return
+	}
+	fmt.Fprintf(w, "monitored: labels={%s}", formatLabels(report.Monitored.Labels))
+	if report.Monitored.Endpoint != "" {
+		fmt.Fprintf(w, " endpoint=%s", report.Monitored.Endpoint)
+	}
+	fmt.Fprintf(w, "\nresult: counted, monitored\n")
+}
+
+// formatLabels returns labels as sorted name="value" pairs
+func formatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for name, value := range labels {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", name, value))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ", ")
+}
+
+// serveParse serves POST /api/v1/parse. The body holds raw log lines, one
+// per line; the response explains each of them with the running config.
+func serveParse(p *parser.Parser) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeJSONError(w, http.StatusMethodNotAllowed, fmt.Errorf("this endpoint requires a POST request"))
+			return
+		}
+
+		lines, err := readLines(http.MaxBytesReader(w, r.Body, maxParseBodyBytes), maxParseLines)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, fmt.Errorf("invalid body: %w", err))
+			return
+		}
+
+		results := make([]parser.LineReport, 0, len(lines))
+		for _, line := range lines {
+			results = append(results, p.ExplainLine(line))
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(map[string][]parser.LineReport{"results": results})
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"squid-log-exporter/internal/parser"
+)
+
+// Defaults and limits of /api/v1/top
+const (
+	defaultTopWindow = 5 * time.Minute
+	defaultTopLimit  = 50
+	maxTopLimit      = 1000
+)
+
+// serveTop serves /api/v1/top?by=requests|bytes|errors&window=5m&limit=50&client=10.0.0.0/8
+func serveTop(p *parser.Parser) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		by := query.Get("by")
+		if by == "" {
+			by = parser.TopByRequests
+		}
+
+		window := defaultTopWindow
+		if value := query.Get("window"); value != "" {
+			parsed, err := time.ParseDuration(value)
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, fmt.Errorf("invalid window: %w", err))
+				return
+			}
+			window = parsed
+		}
+
+		limit := defaultTopLimit
+		if value := query.Get("limit"); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed < 1 || parsed > maxTopLimit {
+				writeJSONError(w, http.StatusBadRequest, fmt.Errorf("limit must be between 1 and %d", maxTopLimit))
+				return
+			}
+			limit = parsed
+		}
+
+		var client netip.Prefix
+		if value := query.Get("client"); value != "" {
+			var err error
+			client, err = parseClient(value)
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, err)
+				return
+			}
+		}
+
+		result, err := p.Top(by, window, limit, client)
+		if errors.Is(err, parser.ErrLiveTopDisabled) {
+			writeJSONError(w, http.StatusNotFound, err)
+			return
+		}
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(result)
+	}
+}
+
+// parseClient accepts a CIDR prefix or a single address
+func parseClient(value string) (netip.Prefix, error) {
+	if strings.Contains(value, "/") {
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid client: %w", err)
+		}
+		return prefix.Masked(), nil
+	}
+
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid client: %w", err)
+	}
+	return netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()), nil
+}
+
+// writeJSONError writes {"error": "..."} with the given status
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
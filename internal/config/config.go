@@ -3,24 +3,94 @@ package config
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 	"regexp"
+	"regexp/syntax"
 	"sort"
+	"strconv"
+	"strings"
+	"time"
 
-	"gopkg.in/yaml.v3"
+	"squid-log-exporter/internal/relabel"
+	"squid-log-exporter/internal/site"
 )
 
 // Config represents the exporter configuration
 type Config struct {
-	Global           GlobalConfig      `yaml:"global"`
-	LogFormat        LogFormatConfig   `yaml:"log_format"`
-	MonitoredDomains []MonitoredDomain `yaml:"monitored_domains"`
-	DomainPatterns   []DomainPattern   `yaml:"domain_patterns"`
+	Server                ServerConfig      `yaml:"server,omitempty"`
+	Input                 InputConfig       `yaml:"input,omitempty"`
+	Global                GlobalConfig      `yaml:"global"`
+	LogFormat             LogFormatConfig   `yaml:"log_format"`
+	MonitoredDomains      []MonitoredDomain `yaml:"monitored_domains"`
+	MonitoredDomainsFiles []string          `yaml:"monitored_domains_files,omitempty"` // globs of YAML/JSON/CSV files
+	DomainPatterns        []DomainPattern   `yaml:"domain_patterns"`
+	TopDomains            TopDomainsConfig  `yaml:"top_domains"`
+	LiveTop               LiveTopConfig     `yaml:"live_top,omitempty"`
+	Cardinality           CardinalityConfig `yaml:"cardinality"`
+	State                 StateConfig       `yaml:"state,omitempty"`
+	DomainMatching        DomainMatching    `yaml:"domain_matching"`
+	Rules                 []Rule            `yaml:"rules,omitempty"`
+	RelabelConfigs        []relabel.Config  `yaml:"relabel_configs,omitempty"`
+
+	suffixList *site.List
+	matcher    *domainMatcher
+	pathRules  bool
+}
+
+// ServerConfig contains the HTTP server settings. Each can also be set with a
+// command-line flag or environment variable, which take precedence.
+type ServerConfig struct {
+	ListenAddress string `yaml:"listen_address,omitempty"`  // --listen-address
+	MetricsPath   string `yaml:"metrics_path,omitempty"`    // --metrics-path
+	WebConfigFile string `yaml:"web_config_file,omitempty"` // --web-config-file
+}
+
+// InputConfig contains the log input settings, overridable like ServerConfig
+type InputConfig struct {
+	LogFile      string        `yaml:"log_file,omitempty"`      // --log-file
+	PositionFile string        `yaml:"position_file,omitempty"` // --position-file
+	Interval     time.Duration `yaml:"interval,omitempty"`      // --interval
+	StaleAfter   time.Duration `yaml:"stale_after,omitempty"`   // not ready if no lines are read for this long (0 = never)
 }
 
 // GlobalConfig contains global settings
 type GlobalConfig struct {
-	TrackAllDomains bool `yaml:"track_all_domains"`
-	MaxDomains      int  `yaml:"max_domains"`
+	TrackAllDomains  bool          `yaml:"track_all_domains"`
+	MaxDomains       int           `yaml:"max_domains"`
+	DomainTTL        time.Duration `yaml:"domain_ttl,omitempty"` // 0 = never expire
+	EvictLRU         bool          `yaml:"evict_lru"`
+	SiteAggregation  bool          `yaml:"site_aggregation"`
+	PublicSuffixFile string        `yaml:"public_suffix_file,omitempty"`
+}
+
+// TopDomainsConfig configures heavy-hitter ("top talkers") tracking
+type TopDomainsConfig struct {
+	Enabled  bool          `yaml:"enabled"`
+	N        int           `yaml:"n"`
+	Capacity int           `yaml:"capacity,omitempty"` // counters kept by the sketch
+	Window   time.Duration `yaml:"window,omitempty"`
+}
+
+// LiveTopConfig configures the in-memory per-cycle aggregates behind
+// /api/v1/top, which are kept per host and client independent of max_domains
+type LiveTopConfig struct {
+	Enabled    bool          `yaml:"enabled"`
+	Retention  time.Duration `yaml:"retention,omitempty"`   // longest queryable window
+	MaxEntries int           `yaml:"max_entries,omitempty"` // host/client pairs kept per parse cycle
+}
+
+// CardinalityConfig configures HyperLogLog estimates of distinct clients,
+// users and hosts over sliding windows
+type CardinalityConfig struct {
+	Enabled   bool            `yaml:"enabled"`
+	Windows   []time.Duration `yaml:"windows,omitempty"`
+	Precision uint8           `yaml:"precision,omitempty"`
+}
+
+// StateConfig configures the snapshot of counters, tracked domains and top
+// domain sketches that is committed with the position and restored on startup
+type StateConfig struct {
+	Enabled bool `yaml:"enabled"`
 }
 
 // LogFormatConfig defines the log format
@@ -31,20 +101,47 @@ type LogFormatConfig struct {
 	DurationUnit    string         `yaml:"duration_unit,omitempty"`
 }
 
-// MonitoredDomain represents a domain with extended monitoring
+// MonitoredDomain represents a domain with extended monitoring.
+// Either Host (exact host) or Site (registrable domain) is set.
 type MonitoredDomain struct {
 	Host   string            `yaml:"host"`
+	Site   string            `yaml:"site,omitempty"`
 	Port   string            `yaml:"port"`
 	Labels map[string]string `yaml:"labels"`
+	Paths  []PathRule        `yaml:"paths,omitempty"` // per-endpoint metrics
 }
 
-// DomainPattern represents a pattern-based domain configuration
+// DomainPattern represents a pattern-based domain configuration. Either
+// Pattern (glob, only * is special) or Regex (full regular expression) is set.
+// Label values may reference capture groups as $name, ${name} or $1.
 type DomainPattern struct {
-	Pattern string            `yaml:"pattern"`
-	Labels  map[string]string `yaml:"labels"`
+	Pattern string            `yaml:"pattern,omitempty"`
+	Regex   string            `yaml:"regex,omitempty"`
+	Match   string            `yaml:"match,omitempty"` // "host" (default) or "site"
+	Labels  map[string]string `yaml:"labels" expand:"false"`
+	Paths   []PathRule        `yaml:"paths,omitempty"`
 	regex   *regexp.Regexp
 }
 
+// String returns the pattern or regex as written in the config
+func (p DomainPattern) String() string {
+	if p.Regex != "" {
+		return p.Regex
+	}
+	return p.Pattern
+}
+
+// DomainMatching controls how monitored domains and patterns are combined
+type DomainMatching struct {
+	// Order is "config" (monitored_domains, then domain_patterns, in file
+	// order) or "specificity" (exact hosts, then sites, then patterns with
+	// the most literal characters first)
+	Order string `yaml:"order,omitempty"`
+	// Mode is "first" (first match wins) or "merge" (labels of all matches
+	// are merged, earlier matches win on conflicts)
+	Mode string `yaml:"mode,omitempty"`
+}
+
 // Predefined log format presets
 var logFormatPresets = map[string]LogFormatConfig{
 	"squid_native": {
@@ -93,36 +190,206 @@ func LoadConfig(filename string) (*Config, error) {
 	}
 
 	var config Config
-	if err := yaml.Unmarshal(data, &config); err != nil {
+	if err := decodeExpanded(data, &config, filepath.Dir(filename), false); err != nil {
 		return nil, fmt.Errorf("failed to parse config: %w", err)
 	}
 
+	if config.Server.MetricsPath != "" && !strings.HasPrefix(config.Server.MetricsPath, "/") {
+		return nil, fmt.Errorf("server.metrics_path must start with /, got %q", config.Server.MetricsPath)
+	}
+	if config.Input.Interval < 0 || config.Input.StaleAfter < 0 {
+		return nil, fmt.Errorf("input.interval and input.stale_after must not be negative")
+	}
+
 	// Set defaults
 	if config.Global.MaxDomains == 0 {
 		config.Global.MaxDomains = 10000
 	}
+	if config.Global.DomainTTL < 0 {
+		return nil, fmt.Errorf("domain_ttl must not be negative")
+	}
+	if config.TopDomains.N == 0 {
+		config.TopDomains.N = 20
+	}
+	if config.TopDomains.Capacity == 0 {
+		config.TopDomains.Capacity = 100 * config.TopDomains.N
+	}
+	if config.TopDomains.Window == 0 {
+		config.TopDomains.Window = 5 * time.Minute
+	}
+	if config.LiveTop.Retention == 0 {
+		config.LiveTop.Retention = time.Hour
+	}
+	if config.LiveTop.MaxEntries == 0 {
+		config.LiveTop.MaxEntries = 100000
+	}
+	if config.LiveTop.Retention < 0 || config.LiveTop.MaxEntries < 0 {
+		return nil, fmt.Errorf("live_top.retention and live_top.max_entries must not be negative")
+	}
+	if len(config.Cardinality.Windows) == 0 {
+		config.Cardinality.Windows = []time.Duration{5 * time.Minute, time.Hour, 24 * time.Hour}
+	}
+	if config.Cardinality.Precision == 0 {
+		config.Cardinality.Precision = 12
+	}
+	if config.Cardinality.Precision < 4 || config.Cardinality.Precision > 16 {
+		return nil, fmt.Errorf("cardinality.precision must be between 4 and 16, got %d", config.Cardinality.Precision)
+	}
+	for _, window := range config.Cardinality.Windows {
+		if window <= 0 {
+			return nil, fmt.Errorf("cardinality.windows must be positive durations")
+		}
+	}
+	if config.TopDomains.Capacity < config.TopDomains.N {
+		return nil, fmt.Errorf("top_domains.capacity (%d) must be at least top_domains.n (%d)",
+			config.TopDomains.Capacity, config.TopDomains.N)
+	}
 
 	// Apply log format preset or defaults
 	if err := config.applyLogFormatDefaults(); err != nil {
 		return nil, err
 	}
 
+	// Load Public Suffix List override
+	if config.Global.PublicSuffixFile != "" {
+		list, err := site.LoadFile(config.Global.PublicSuffixFile)
+		if err != nil {
+			return nil, err
+		}
+		config.suffixList = list
+	}
+
+	for i, domain := range config.MonitoredDomains {
+		if (domain.Host == "") == (domain.Site == "") {
+			return nil, fmt.Errorf("monitored domain #%d: exactly one of host or site must be set", i+1)
+		}
+	}
+
+	// Merge monitored domains and patterns from external files
+	if err := config.loadDomainFiles(filepath.Dir(filename)); err != nil {
+		return nil, err
+	}
+
+	for i := range config.MonitoredDomains {
+		domain := &config.MonitoredDomains[i]
+		if err := compilePathRules(domain.Paths, domain.key()); err != nil {
+			return nil, err
+		}
+		config.pathRules = config.pathRules || len(domain.Paths) > 0
+	}
+
 	// Compile regex patterns
 	for i := range config.DomainPatterns {
-		pattern := config.DomainPatterns[i].Pattern
-		regexPattern := "^" + regexp.QuoteMeta(pattern) + "$"
-		regexPattern = regexp.MustCompile(`\\\*`).ReplaceAllString(regexPattern, ".*")
+		pattern := &config.DomainPatterns[i]
+		switch pattern.Match {
+		case "", "host", "site":
+		default:
+			return nil, fmt.Errorf("invalid match %q for pattern %s (valid: host, site)", pattern.Match, pattern)
+		}
 
-		regex, err := regexp.Compile(regexPattern)
-		if err != nil {
-			return nil, fmt.Errorf("invalid pattern %s: %w", pattern, err)
+		if (pattern.Pattern == "") == (pattern.Regex == "") {
+			return nil, fmt.Errorf("domain pattern #%d: exactly one of pattern or regex must be set", i+1)
+		}
+
+		if pattern.Regex != "" {
+			regex, err := regexp.Compile(pattern.Regex)
+			if err != nil {
+				return nil, fmt.Errorf("invalid regex %s: %w", pattern.Regex, err)
+			}
+			pattern.regex = regex
+		} else {
+			pattern.regex = globToRegexp(pattern.Pattern)
+		}
+
+		if err := compilePathRules(pattern.Paths, pattern.key()); err != nil {
+			return nil, err
+		}
+		config.pathRules = config.pathRules || len(pattern.Paths) > 0
+	}
+
+	if err := config.applyDomainMatching(); err != nil {
+		return nil, err
+	}
+
+	if err := config.compileRules(); err != nil {
+		return nil, err
+	}
+
+	for i := range config.RelabelConfigs {
+		if err := config.RelabelConfigs[i].Compile(); err != nil {
+			return nil, fmt.Errorf("relabel_configs #%d: %w", i+1, err)
 		}
-		config.DomainPatterns[i].regex = regex
 	}
 
 	return &config, nil
 }
 
+// globToRegexp converts a domain pattern where only * is special into an
+// anchored regex. Each * becomes a numbered capture group ($1, $2, ...).
+func globToRegexp(pattern string) *regexp.Regexp {
+	regexPattern := "^" + regexp.QuoteMeta(pattern) + "$"
+	regexPattern = strings.ReplaceAll(regexPattern, `\*`, "(.*)")
+	return regexp.MustCompile(regexPattern)
+}
+
+// applyDomainMatching validates the matching settings and builds the index
+// used by IsMonitored
+func (c *Config) applyDomainMatching() error {
+	switch c.DomainMatching.Order {
+	case "":
+		c.DomainMatching.Order = "config"
+	case "config", "specificity":
+	default:
+		return fmt.Errorf("invalid domain_matching.order %q (valid: config, specificity)", c.DomainMatching.Order)
+	}
+
+	switch c.DomainMatching.Mode {
+	case "":
+		c.DomainMatching.Mode = "first"
+	case "first", "merge":
+	default:
+		return fmt.Errorf("invalid domain_matching.mode %q (valid: first, merge)", c.DomainMatching.Mode)
+	}
+
+	c.matcher = newDomainMatcher(c)
+
+	return nil
+}
+
+// specificity counts the literal characters a host must contain to match
+func (p DomainPattern) specificity() int {
+	if p.Regex == "" {
+		return len(strings.ReplaceAll(p.Pattern, "*", ""))
+	}
+
+	re, err := syntax.Parse(p.Regex, syntax.Perl)
+	if err != nil {
+		return 0
+	}
+	return literalLength(re)
+}
+
+// literalLength sums literal runes that are required for a match
+func literalLength(re *syntax.Regexp) int {
+	switch re.Op {
+	case syntax.OpLiteral:
+		return len(re.Rune)
+	case syntax.OpConcat, syntax.OpCapture:
+		n := 0
+		for _, sub := range re.Sub {
+			n += literalLength(sub)
+		}
+		return n
+	case syntax.OpPlus:
+		return literalLength(re.Sub[0])
+	case syntax.OpRepeat:
+		if re.Min > 0 {
+			return literalLength(re.Sub[0])
+		}
+	}
+	return 0
+}
+
 // applyLogFormatDefaults applies preset or default log format
 func (c *Config) applyLogFormatDefaults() error {
 	if c.LogFormat.Type == "" {
@@ -176,25 +443,53 @@ func (c *LogFormatConfig) GetField(fields []string, fieldName string) string {
 	return ""
 }
 
-// IsMonitored checks if a domain should have extended monitoring
-func (c *Config) IsMonitored(host, port string) (*MonitoredDomain, bool) {
-	for _, domain := range c.MonitoredDomains {
-		if domain.Host == host && (domain.Port == "" || domain.Port == port) {
-			return &domain, true
+// ParseTimestamp parses a timestamp field with TimestampFormat: "unix" for
+// seconds since the epoch, otherwise a Go time layout. Surrounding brackets
+// are ignored, and times without a zone are in the local time zone.
+func (c *LogFormatConfig) ParseTimestamp(value string) (time.Time, error) {
+	value = strings.Trim(value, "[]")
+	if c.TimestampFormat == "unix" {
+		seconds, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid unix timestamp %q", value)
 		}
+		return time.UnixMilli(int64(seconds * 1000)), nil
 	}
 
-	for _, pattern := range c.DomainPatterns {
-		if pattern.regex.MatchString(host) {
-			return &MonitoredDomain{
-				Host:   host,
-				Port:   port,
-				Labels: pattern.Labels,
-			}, true
-		}
+	t, err := time.ParseInLocation(c.TimestampFormat, value, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid timestamp %q for format %q", value, c.TimestampFormat)
+	}
+	return t, nil
+}
+
+// RegistrableDomain returns the registrable domain (eTLD+1) of host
+func (c *Config) RegistrableDomain(host string) string {
+	return c.suffixList.RegistrableDomain(host)
+}
+
+// IsMonitored checks if a domain should have extended monitoring. With
+// domain_matching.mode "merge" the labels of all matches are combined.
+// The returned domain is shared between calls and must not be modified.
+func (c *Config) IsMonitored(host, port string) (*MonitoredDomain, bool) {
+	if c.matcher == nil {
+		// Config not created by LoadConfig; build an uncached index
+		domain := newDomainMatcher(c).lookup(host, port)
+		return domain, domain != nil
 	}
+	return c.matcher.match(host, port)
+}
 
-	return nil, false
+// expandLabels substitutes capture group references in label values
+func (p DomainPattern) expandLabels(target string, match []int) map[string]string {
+	labels := make(map[string]string, len(p.Labels))
+	for key, value := range p.Labels {
+		if strings.Contains(value, "$") {
+			value = string(p.regex.ExpandString(nil, value, target, match))
+		}
+		labels[key] = value
+	}
+	return labels
 }
 
 // GetCustomLabelKeys returns all unique custom label keys from config
@@ -0,0 +1,215 @@
+package config
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// domainsFile is the layout of a YAML or JSON file listed in
+// monitored_domains_files
+type domainsFile struct {
+	MonitoredDomains []MonitoredDomain `yaml:"monitored_domains" json:"monitored_domains"`
+	DomainPatterns   []DomainPattern   `yaml:"domain_patterns" json:"domain_patterns"`
+}
+
+// csvColumns are the CSV header names that are not labels
+var csvColumns = map[string]bool{
+	"host":    true,
+	"site":    true,
+	"port":    true,
+	"pattern": true,
+	"regex":   true,
+	"match":   true,
+}
+
+// loadDomainFiles appends the monitored domains and patterns of every file
+// matched by monitored_domains_files. Relative globs are resolved against
+// baseDir. An entry defined more than once, where at least one definition
+// comes from a file, is an error.
+func (c *Config) loadDomainFiles(baseDir string) error {
+	if len(c.MonitoredDomainsFiles) == 0 {
+		return nil
+	}
+
+	domainSources := make(map[string]string)
+	patternSources := make(map[string]string)
+	for _, domain := range c.MonitoredDomains {
+		domainSources[domain.key()] = "the main config file"
+	}
+	for _, pattern := range c.DomainPatterns {
+		patternSources[pattern.key()] = "the main config file"
+	}
+
+	seen := make(map[string]bool)
+	for _, glob := range c.MonitoredDomainsFiles {
+		if !filepath.IsAbs(glob) {
+			glob = filepath.Join(baseDir, glob)
+		}
+
+		files, err := filepath.Glob(glob)
+		if err != nil {
+			return fmt.Errorf("invalid monitored_domains_files pattern %q: %w", glob, err)
+		}
+		if len(files) == 0 && !strings.ContainsAny(glob, "*?[") {
+			return fmt.Errorf("monitored domains file %s does not exist", glob)
+		}
+
+		for _, file := range files {
+			if seen[file] {
+				continue
+			}
+			seen[file] = true
+
+			entries, err := readDomainsFile(file)
+			if err != nil {
+				return err
+			}
+
+			for i, domain := range entries.MonitoredDomains {
+				if (domain.Host == "") == (domain.Site == "") {
+					return fmt.Errorf("%s: monitored domain #%d: exactly one of host or site must be set", file, i+1)
+				}
+				key := domain.key()
+				if source, ok := domainSources[key]; ok {
+					return fmt.Errorf("%s: monitored domain %s is already defined in %s", file, key, source)
+				}
+				domainSources[key] = file
+				c.MonitoredDomains = append(c.MonitoredDomains, domain)
+			}
+
+			for _, pattern := range entries.DomainPatterns {
+				key := pattern.key()
+				if source, ok := patternSources[key]; ok {
+					return fmt.Errorf("%s: domain pattern %s is already defined in %s", file, key, source)
+				}
+				patternSources[key] = file
+				c.DomainPatterns = append(c.DomainPatterns, pattern)
+			}
+		}
+	}
+
+	return nil
+}
+
+// key identifies a monitored domain for conflict detection
+func (d MonitoredDomain) key() string {
+	key := "host " + d.Host
+	if d.Host == "" {
+		key = "site " + d.Site
+	}
+	if d.Port != "" {
+		key += ":" + d.Port
+	}
+	return key
+}
+
+// key identifies a domain pattern for conflict detection
+func (p DomainPattern) key() string {
+	kind := "pattern"
+	if p.Regex != "" {
+		kind = "regex"
+	}
+	key := fmt.Sprintf("%s %q", kind, p.String())
+	if p.Match == "site" {
+		key += " (match: site)"
+	}
+	return key
+}
+
+// readDomainsFile decodes a YAML, JSON or CSV domains file by extension
+func readDomainsFile(file string) (*domainsFile, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read monitored domains file: %w", err)
+	}
+
+	var entries domainsFile
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		if err := decodeExpanded(data, &entries, filepath.Dir(file), true); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", file, err)
+		}
+
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&entries); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", file, err)
+		}
+
+	case ".csv":
+		if err := parseDomainsCSV(data, &entries); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", file, err)
+		}
+
+	default:
+		return nil, fmt.Errorf("unsupported monitored domains file %s (use .yaml, .yml, .json or .csv)", file)
+	}
+
+	return &entries, nil
+}
+
+// parseDomainsCSV reads a CSV file with a header row. The columns host, site,
+// port, pattern, regex and match have their config meaning; every other
+// column is a label. Rows with pattern or regex become domain patterns.
+// Empty label cells are omitted and lines starting with # are ignored.
+func parseDomainsCSV(data []byte, entries *domainsFile) error {
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.Comment = '#'
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for i := range header {
+		header[i] = strings.TrimSpace(header[i])
+	}
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		fields := make(map[string]string)
+		labels := make(map[string]string)
+		for i, value := range record {
+			value = strings.TrimSpace(value)
+			if csvColumns[header[i]] {
+				fields[header[i]] = value
+			} else if value != "" {
+				labels[header[i]] = value
+			}
+		}
+
+		if fields["pattern"] != "" || fields["regex"] != "" {
+			entries.DomainPatterns = append(entries.DomainPatterns, DomainPattern{
+				Pattern: fields["pattern"],
+				Regex:   fields["regex"],
+				Match:   fields["match"],
+				Labels:  labels,
+			})
+			continue
+		}
+
+		entries.MonitoredDomains = append(entries.MonitoredDomains, MonitoredDomain{
+			Host:   fields["host"],
+			Site:   fields["site"],
+			Port:   fields["port"],
+			Labels: labels,
+		})
+	}
+}
@@ -0,0 +1,23 @@
+package config
+
+import (
+	"bytes"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Dump returns the configuration as YAML, including entries merged from
+// monitored_domains_files. The configuration holds no credentials; those
+// live in the web config file, which is never dumped.
+func (c *Config) Dump() ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(c); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,219 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// envRefRegex matches $$, ${VAR} and ${VAR:-default}
+var envRefRegex = regexp.MustCompile(`\$\$|\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// fileSuffix marks a key whose value is read from a file, e.g. password_file
+const fileSuffix = "_file"
+
+// expandEnv replaces ${VAR} and ${VAR:-default} with environment variables.
+// $$ is a literal $. A variable that is unset and has no default is an error.
+func expandEnv(value string) (string, error) {
+	if !strings.Contains(value, "$") {
+		return value, nil
+	}
+
+	var missing []string
+	expanded := envRefRegex.ReplaceAllStringFunc(value, func(ref string) string {
+		if ref == "$$" {
+			return "$"
+		}
+		groups := envRefRegex.FindStringSubmatch(ref)
+		if env, ok := os.LookupEnv(groups[1]); ok && (env != "" || groups[2] == "") {
+			return env
+		}
+		if groups[2] != "" {
+			return groups[3]
+		}
+		missing = append(missing, groups[1])
+		return ""
+	})
+
+	if len(missing) > 0 {
+		return "", fmt.Errorf("environment variable %s is not set", strings.Join(missing, ", "))
+	}
+	return expanded, nil
+}
+
+// expandNode walks a YAML tree alongside the Go type it decodes into. It
+// expands environment variables in scalar values and replaces "<key>_file: path"
+// with "<key>: <file contents>" for string fields that have no _file field of
+// their own. Fields tagged expand:"false" hold capture group templates such
+// as ${name} and are left untouched. Relative file paths are resolved
+// against baseDir.
+func expandNode(node *yaml.Node, t reflect.Type, baseDir, path string) error {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if node.Kind == yaml.ScalarNode {
+		return expandScalar(node, path)
+	}
+	if t == nil || t == reflect.TypeOf(time.Duration(0)) {
+		return nil
+	}
+
+	switch {
+	case t.Kind() == reflect.Struct && node.Kind == yaml.MappingNode:
+		fields := structFields(t)
+		present := make(map[string]bool)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			present[node.Content[i].Value] = true
+		}
+
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			keyPath := joinPath(path, key.Value)
+
+			if field, ok := fields[key.Value]; ok {
+				if field.Tag.Get("expand") == "false" {
+					continue
+				}
+				if err := expandNode(value, field.Type, baseDir, keyPath); err != nil {
+					return err
+				}
+				continue
+			}
+
+			base := strings.TrimSuffix(key.Value, fileSuffix)
+			field, ok := fields[base]
+			if base == key.Value || !ok || !isStringType(field.Type) {
+				continue
+			}
+			if present[base] {
+				return fmt.Errorf("%s: only one of %s and %s may be set", describePath(path), base, key.Value)
+			}
+			if err := readSecretFile(key, value, base, baseDir, keyPath); err != nil {
+				return err
+			}
+		}
+
+	case (t.Kind() == reflect.Slice || t.Kind() == reflect.Array) && node.Kind == yaml.SequenceNode:
+		for i, item := range node.Content {
+			if err := expandNode(item, t.Elem(), baseDir, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+
+	case t.Kind() == reflect.Map && node.Kind == yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			keyPath := joinPath(path, node.Content[i].Value)
+			if err := expandNode(node.Content[i+1], t.Elem(), baseDir, keyPath); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// expandScalar expands environment variables in a scalar node. Plain scalars
+// have their tag re-resolved so ${PORT} can fill an integer field.
+func expandScalar(node *yaml.Node, path string) error {
+	expanded, err := expandEnv(node.Value)
+	if err != nil {
+		return fmt.Errorf("%s: %w", describePath(path), err)
+	}
+	if expanded == node.Value {
+		return nil
+	}
+
+	node.Value = expanded
+	if node.Style == 0 {
+		node.Tag = ""
+	}
+	return nil
+}
+
+// readSecretFile turns a "<base>_file: path" entry into "<base>: contents",
+// dropping a single trailing newline
+func readSecretFile(key, value *yaml.Node, base, baseDir, path string) error {
+	if err := expandScalar(value, path); err != nil {
+		return err
+	}
+
+	file := value.Value
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(baseDir, file)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("%s: %w", describePath(path), err)
+	}
+
+	key.Value = base
+	*value = yaml.Node{
+		Kind:  yaml.ScalarNode,
+		Tag:   "!!str",
+		Value: strings.TrimSuffix(strings.TrimSuffix(string(data), "\n"), "\r"),
+	}
+	return nil
+}
+
+// structFields maps YAML keys of a struct to its exported fields
+func structFields(t reflect.Type) map[string]reflect.StructField {
+	fields := make(map[string]reflect.StructField)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		fields[name] = field
+	}
+	return fields
+}
+
+func isStringType(t reflect.Type) bool {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Kind() == reflect.String
+}
+
+// decodeExpanded unmarshals YAML into out after expanding environment
+// variables and secret files
+func decodeExpanded(data []byte, out any, baseDir string, knownFields bool) error {
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return err
+	}
+	if len(root.Content) == 0 {
+		return nil
+	}
+
+	if err := expandNode(root.Content[0], reflect.TypeOf(out), baseDir, ""); err != nil {
+		return err
+	}
+
+	if !knownFields {
+		return root.Content[0].Decode(out)
+	}
+
+	// Node.Decode has no KnownFields option; round-trip through a decoder
+	expanded, err := yaml.Marshal(root.Content[0])
+	if err != nil {
+		return err
+	}
+	decoder := yaml.NewDecoder(strings.NewReader(string(expanded)))
+	decoder.KnownFields(true)
+	return decoder.Decode(out)
+}
@@ -0,0 +1,353 @@
+package config
+
+import (
+	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// matchCacheSize bounds the number of memoised host:port lookups. The cache
+// is cleared when full; a reload builds a new matcher with an empty cache.
+const matchCacheSize = 100000
+
+// domainMatcher indexes monitored domains and patterns so that a lookup only
+// evaluates rules that can match. Results are identical to checking every rule
+// in evaluation order:
+//   - exact hosts and sites are map lookups
+//   - "*.suffix" globs, and patterns ending in literal labels like
+//     `\.example\.net$`, live in a trie keyed on reversed host labels
+//   - all other patterns are prefiltered by one combined regex per target
+type domainMatcher struct {
+	merge       bool
+	resolveSite func(host string) string
+	needSite    bool
+
+	hosts    map[string][]*matchRule
+	sites    map[string][]*matchRule
+	suffixes [2]*suffixNode // indexed by targetHost/targetSite
+	regexes  [2]regexSet    // indexed by targetHost/targetSite
+
+	mu    sync.Mutex
+	cache map[string]*MonitoredDomain // nil value: not monitored
+}
+
+// Targets a pattern is matched against
+const (
+	targetHost = iota
+	targetSite
+)
+
+// matchRule is a monitored domain or pattern with its evaluation rank
+type matchRule struct {
+	rank    int
+	port    string
+	site    string
+	labels  map[string]string
+	paths   []PathRule
+	pattern *DomainPattern // nil for monitored domains
+	target  int
+}
+
+// suffixNode is a trie node for one host label; rules hold the "*.suffix"
+// patterns whose suffix ends at this node
+type suffixNode struct {
+	children map[string]*suffixNode
+	rules    []*matchRule
+}
+
+// regexSet prefilters rules with a single alternation of all their regexes
+type regexSet struct {
+	combined *regexp.Regexp
+	rules    []*matchRule
+}
+
+// newDomainMatcher builds the indexes for a config whose patterns are compiled
+func newDomainMatcher(c *Config) *domainMatcher {
+	m := &domainMatcher{
+		merge:       c.DomainMatching.Mode == "merge",
+		resolveSite: c.RegistrableDomain,
+		hosts:       make(map[string][]*matchRule),
+		sites:       make(map[string][]*matchRule),
+		suffixes:    [2]*suffixNode{{}, {}},
+		cache:       make(map[string]*MonitoredDomain),
+	}
+
+	domains, patterns := c.evaluationOrder()
+	rank := 0
+
+	for _, domain := range domains {
+		rule := &matchRule{rank: rank, port: domain.Port, site: domain.Site, labels: domain.Labels, paths: domain.Paths}
+		rank++
+
+		if domain.Host != "" {
+			m.hosts[domain.Host] = append(m.hosts[domain.Host], rule)
+		} else {
+			m.sites[domain.Site] = append(m.sites[domain.Site], rule)
+			m.needSite = true
+		}
+	}
+
+	var pending [2][]*matchRule
+	for i := range patterns {
+		pattern := &patterns[i]
+		rule := &matchRule{rank: rank, labels: pattern.Labels, paths: pattern.Paths, pattern: pattern}
+		rank++
+
+		if pattern.Match == "site" {
+			rule.target = targetSite
+			m.needSite = true
+		}
+
+		if suffix, ok := globSuffix(pattern.Pattern); ok {
+			m.suffixes[rule.target].insert(suffix, rule)
+			continue
+		}
+		// Candidates from the trie are checked with the full regex
+		if suffix, ok := literalSuffixLabels(pattern.regex); ok {
+			m.suffixes[rule.target].insert(suffix, rule)
+			continue
+		}
+		pending[rule.target] = append(pending[rule.target], rule)
+	}
+
+	for target, rules := range pending {
+		m.regexes[target] = newRegexSet(rules)
+	}
+
+	return m
+}
+
+// evaluationOrder returns monitored domains and patterns in the order they
+// are checked according to domain_matching.order
+func (c *Config) evaluationOrder() ([]MonitoredDomain, []DomainPattern) {
+	if c.DomainMatching.Order != "specificity" {
+		return c.MonitoredDomains, c.DomainPatterns
+	}
+
+	domains := append([]MonitoredDomain(nil), c.MonitoredDomains...)
+	sort.SliceStable(domains, func(i, j int) bool {
+		return domains[i].Host != "" && domains[j].Host == ""
+	})
+
+	patterns := append([]DomainPattern(nil), c.DomainPatterns...)
+	sort.SliceStable(patterns, func(i, j int) bool {
+		return patterns[i].specificity() > patterns[j].specificity()
+	})
+
+	return domains, patterns
+}
+
+// match returns the monitored domain for host:port, memoising the result.
+// The returned value is shared and must not be modified.
+func (m *domainMatcher) match(host, port string) (*MonitoredDomain, bool) {
+	key := host + ":" + port
+
+	m.mu.Lock()
+	result, ok := m.cache[key]
+	m.mu.Unlock()
+	if ok {
+		return result, result != nil
+	}
+
+	result = m.lookup(host, port)
+
+	m.mu.Lock()
+	if len(m.cache) >= matchCacheSize {
+		m.cache = make(map[string]*MonitoredDomain)
+	}
+	m.cache[key] = result
+	m.mu.Unlock()
+
+	return result, result != nil
+}
+
+// lookup gathers candidate rules from the indexes and applies them in rank order
+func (m *domainMatcher) lookup(host, port string) *MonitoredDomain {
+	var candidates []*matchRule
+	addDomains := func(rules []*matchRule) {
+		for _, rule := range rules {
+			if rule.port == "" || rule.port == port {
+				candidates = append(candidates, rule)
+			}
+		}
+	}
+
+	targets := [2]string{host, ""}
+	if m.needSite {
+		targets[targetSite] = m.resolveSite(host)
+		addDomains(m.sites[targets[targetSite]])
+	}
+	addDomains(m.hosts[host])
+
+	for target, value := range targets {
+		if value == "" {
+			continue
+		}
+		candidates = m.suffixes[target].collect(value, candidates)
+		candidates = m.regexes[target].collect(value, candidates)
+	}
+
+	if len(candidates) == 0 {
+		return nil
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].rank < candidates[j].rank
+	})
+
+	var result *MonitoredDomain
+	for _, rule := range candidates {
+		labels := rule.labels
+		if rule.pattern != nil {
+			target := targets[rule.target]
+			match := rule.pattern.regex.FindStringSubmatchIndex(target)
+			if match == nil {
+				continue
+			}
+			labels = rule.pattern.expandLabels(target, match)
+		}
+
+		if result == nil {
+			result = &MonitoredDomain{
+				Host:   host,
+				Site:   rule.site,
+				Port:   port,
+				Labels: make(map[string]string, len(labels)),
+			}
+		}
+		for key, value := range labels {
+			if _, exists := result.Labels[key]; !exists {
+				result.Labels[key] = value
+			}
+		}
+		if len(result.Paths) == 0 {
+			result.Paths = rule.paths
+		}
+
+		if !m.merge {
+			break
+		}
+	}
+
+	return result
+}
+
+// globSuffix reports whether a glob has the form "*.suffix" with no other
+// wildcard and returns the suffix
+func globSuffix(pattern string) (string, bool) {
+	suffix, ok := strings.CutPrefix(pattern, "*.")
+	if !ok || suffix == "" || strings.Contains(suffix, "*") {
+		return "", false
+	}
+	return suffix, true
+}
+
+// literalSuffixLabels returns the whole labels a value must end with to
+// match an anchored regex: for `^api-\d+\.example\.net$` that is
+// "example.net". The first label of the literal may be partial and is left
+// out, so every label returned is preceded by a dot in a matching value.
+func literalSuffixLabels(regex *regexp.Regexp) (string, bool) {
+	re, err := syntax.Parse(regex.String(), syntax.Perl)
+	if err != nil || re.Op != syntax.OpConcat || len(re.Sub) < 2 {
+		return "", false
+	}
+	if re.Sub[len(re.Sub)-1].Op != syntax.OpEndText {
+		return "", false
+	}
+
+	literal := re.Sub[len(re.Sub)-2]
+	if literal.Op != syntax.OpLiteral || literal.Flags&syntax.FoldCase != 0 {
+		return "", false
+	}
+
+	suffix := string(literal.Rune)
+	dot := strings.IndexByte(suffix, '.')
+	if dot < 0 || dot == len(suffix)-1 {
+		return "", false
+	}
+	return suffix[dot+1:], true
+}
+
+// insert adds rule under the reversed labels of suffix
+func (n *suffixNode) insert(suffix string, rule *matchRule) {
+	labels := strings.Split(suffix, ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		if n.children == nil {
+			n.children = make(map[string]*suffixNode)
+		}
+		child := n.children[labels[i]]
+		if child == nil {
+			child = &suffixNode{}
+			n.children[labels[i]] = child
+		}
+		n = child
+	}
+	n.rules = append(n.rules, rule)
+}
+
+// collect appends the rules of every suffix of value that leaves at least one
+// label in front of it, as "*.suffix" requires
+func (n *suffixNode) collect(value string, rules []*matchRule) []*matchRule {
+	for end := len(value); n != nil; {
+		dot := strings.LastIndexByte(value[:end], '.')
+		if dot < 0 {
+			break
+		}
+		n = n.children[value[dot+1:end]]
+		if n == nil {
+			break
+		}
+		rules = append(rules, n.rules...)
+		end = dot
+	}
+	return rules
+}
+
+// newRegexSet combines the regexes of rules into one alternation. Capture
+// groups are stripped so names may repeat across patterns.
+func newRegexSet(rules []*matchRule) regexSet {
+	set := regexSet{rules: rules}
+	if len(rules) == 0 {
+		return set
+	}
+
+	parts := make([]string, 0, len(rules))
+	for _, rule := range rules {
+		re, err := syntax.Parse(rule.pattern.regex.String(), syntax.Perl)
+		if err != nil {
+			// Every rule is checked individually without a prefilter
+			return set
+		}
+		parts = append(parts, "(?:"+stripCaptures(re).String()+")")
+	}
+
+	combined, err := regexp.Compile(strings.Join(parts, "|"))
+	if err == nil {
+		set.combined = combined
+	}
+	return set
+}
+
+// collect appends all rules when the combined regex matches value. Rules that
+// do not match on their own are filtered out later.
+func (s regexSet) collect(value string, rules []*matchRule) []*matchRule {
+	if len(s.rules) == 0 {
+		return rules
+	}
+	if s.combined != nil && !s.combined.MatchString(value) {
+		return rules
+	}
+	return append(rules, s.rules...)
+}
+
+// stripCaptures replaces capture groups with their contents
+func stripCaptures(re *syntax.Regexp) *syntax.Regexp {
+	for i, sub := range re.Sub {
+		re.Sub[i] = stripCaptures(sub)
+	}
+	if re.Op == syntax.OpCapture {
+		return re.Sub[0]
+	}
+	return re
+}
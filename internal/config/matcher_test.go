@@ -0,0 +1,213 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// loadTestConfig loads a config file with the given content
+func loadTestConfig(tb testing.TB, content string) *Config {
+	tb.Helper()
+
+	file := filepath.Join(tb.TempDir(), "config.yaml")
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		tb.Fatal(err)
+	}
+	cfg, err := LoadConfig(file)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return cfg
+}
+
+// linearMatch checks every monitored domain and pattern in evaluation order,
+// the behaviour the index must reproduce
+func linearMatch(c *Config, host, port string) *MonitoredDomain {
+	domains, patterns := c.evaluationOrder()
+	site := c.RegistrableDomain(host)
+
+	var result *MonitoredDomain
+	add := func(ruleSite string, labels map[string]string, paths []PathRule) bool {
+		if result == nil {
+			result = &MonitoredDomain{Host: host, Site: ruleSite, Port: port, Labels: map[string]string{}}
+		}
+		for key, value := range labels {
+			if _, exists := result.Labels[key]; !exists {
+				result.Labels[key] = value
+			}
+		}
+		if len(result.Paths) == 0 {
+			result.Paths = paths
+		}
+		return c.DomainMatching.Mode != "merge"
+	}
+
+	for _, domain := range domains {
+		if domain.Port != "" && domain.Port != port {
+			continue
+		}
+		if (domain.Host != "" && domain.Host == host) || (domain.Host == "" && domain.Site == site) {
+			if add(domain.Site, domain.Labels, domain.Paths) {
+				return result
+			}
+		}
+	}
+
+	for _, pattern := range patterns {
+		target := host
+		if pattern.Match == "site" {
+			target = site
+		}
+		if target == "" {
+			continue
+		}
+		match := pattern.regex.FindStringSubmatchIndex(target)
+		if match == nil {
+			continue
+		}
+		if add("", pattern.expandLabels(target, match), pattern.Paths) {
+			return result
+		}
+	}
+
+	return result
+}
+
+const matcherTestDomains = `
+monitored_domains:
+  - host: api.example.com
+    port: "443"
+    labels: {team: api}
+  - host: api.example.com
+    port: ""
+    labels: {team: api-any, tier: edge}
+  - site: example.org
+    port: "443"
+    labels: {team: org}
+    paths:
+      - prefix: /v1
+  - host: www.example.org
+    port: "80"
+    labels: {team: www}
+domain_patterns:
+  - pattern: "*.example.com"
+    labels: {team: wildcard, zone: com}
+  - pattern: "*.eu.example.com"
+    labels: {zone: eu}
+  - pattern: "cdn*.example.net"
+    labels: {team: cdn-$1}
+  - regex: '^(?P<svc>[a-z]+)-(?P<env>prod|stage)\.internal\.example\.com$'
+    labels: {team: $svc, env: $env}
+  - regex: '^shop\.'
+    labels: {team: shop}
+  - regex: '^example\.net$'
+    labels: {team: apex}
+  - regex: '(?i)^api\.example\.io$'
+    labels: {team: io}
+  - pattern: "*.co.uk"
+    match: site
+    labels: {country: uk}
+  - pattern: "*.example.org"
+    match: site
+    labels: {zone: org}
+`
+
+func TestDomainMatcherMatchesLinearScan(t *testing.T) {
+	hosts := []string{
+		"api.example.com", "www.example.com", "a.eu.example.com", "eu.example.com",
+		"example.com", "cdn1.example.net", "cdn.example.net", "auth-prod.internal.example.com",
+		"auth-dev.internal.example.com", "shop.example.co.uk", "news.bbc.co.uk", "www.example.org",
+		"static.example.org", "example.org", "example.net", "x.example.net", "api.example.io",
+		"API.Example.io", "unrelated.test", "10.0.0.1", "localhost",
+	}
+	ports := []string{"443", "80", "8080"}
+
+	for _, order := range []string{"config", "specificity"} {
+		for _, mode := range []string{"first", "merge"} {
+			t.Run(order+"/"+mode, func(t *testing.T) {
+				cfg := loadTestConfig(t, fmt.Sprintf("domain_matching:\n  order: %s\n  mode: %s\n%s", order, mode, matcherTestDomains))
+
+				matched := 0
+				for _, host := range hosts {
+					for _, port := range ports {
+						want := linearMatch(cfg, host, port)
+						if want != nil {
+							matched++
+						}
+						got, ok := cfg.IsMonitored(host, port)
+						if ok != (want != nil) {
+							t.Fatalf("IsMonitored(%s, %s) = %v, linear scan = %v", host, port, ok, want != nil)
+						}
+						if ok && !reflect.DeepEqual(got, want) {
+							t.Errorf("IsMonitored(%s, %s) = %+v, linear scan = %+v", host, port, got, want)
+						}
+					}
+				}
+				if matched == 0 {
+					t.Fatal("no host matched any rule")
+				}
+			})
+		}
+	}
+}
+
+// benchmarkConfig returns a config with n rules of the given kind and hosts
+// to look up, half of which match a rule
+func benchmarkConfig(b *testing.B, kind string, n int) (*Config, []string) {
+	var config strings.Builder
+	var hosts []string
+
+	switch kind {
+	case "exact":
+		config.WriteString("monitored_domains:\n")
+		for i := 0; i < n; i++ {
+			fmt.Fprintf(&config, "  - host: host%d.example.com\n    port: \"443\"\n    labels: {team: t%d}\n", i, i)
+		}
+	case "suffix":
+		config.WriteString("domain_patterns:\n")
+		for i := 0; i < n; i++ {
+			fmt.Fprintf(&config, "  - pattern: \"*.zone%d.example.com\"\n    labels: {team: t%d}\n", i, i)
+		}
+	case "regex":
+		config.WriteString("domain_patterns:\n")
+		for i := 0; i < n; i++ {
+			fmt.Fprintf(&config, "  - regex: '^(?P<svc>[a-z]+)\\.r%d\\.example\\.net$'\n    labels: {team: $svc}\n", i)
+		}
+	}
+
+	for i := 0; i < 1000; i++ {
+		rule := i * 7919 % n
+		switch kind {
+		case "exact":
+			hosts = append(hosts, fmt.Sprintf("host%d.example.com", rule))
+		case "suffix":
+			hosts = append(hosts, fmt.Sprintf("www.zone%d.example.com", rule))
+		case "regex":
+			hosts = append(hosts, fmt.Sprintf("api.r%d.example.net", rule))
+		}
+		hosts = append(hosts, fmt.Sprintf("miss%d.unrelated.test", i))
+	}
+
+	return loadTestConfig(b, config.String()), hosts
+}
+
+// BenchmarkIsMonitored measures a lookup in the index. The memo cache of
+// IsMonitored is bypassed, since it would hide the cost of the index.
+func BenchmarkIsMonitored(b *testing.B) {
+	for _, kind := range []string{"exact", "suffix", "regex"} {
+		for _, n := range []int{1000, 10000, 50000} {
+			b.Run(fmt.Sprintf("%s/rules=%d", kind, n), func(b *testing.B) {
+				cfg, hosts := benchmarkConfig(b, kind, n)
+				b.ResetTimer()
+
+				for i := 0; i < b.N; i++ {
+					cfg.matcher.lookup(hosts[i%len(hosts)], "443")
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"squid-log-exporter/internal/relabel"
+)
+
+// otherEndpoint is the endpoint of requests that match no path rule
+const otherEndpoint = "__other__"
+
+// PathRule maps URL paths of a monitored domain to an endpoint label. Exactly
+// one of Prefix, Glob or Regex is set. In a glob, {name} matches one path
+// segment, * matches within a segment and ** matches anything.
+type PathRule struct {
+	Prefix   string `yaml:"prefix,omitempty"`
+	Glob     string `yaml:"glob,omitempty"`
+	Regex    string `yaml:"regex,omitempty"`
+	Endpoint string `yaml:"endpoint,omitempty" expand:"false"` // default: the prefix or glob; may reference regex groups ($name)
+	regex    *regexp.Regexp
+}
+
+// compilePathRules validates path rules and fills in default endpoint names
+func compilePathRules(rules []PathRule, owner string) error {
+	for i := range rules {
+		rule := &rules[i]
+
+		set := 0
+		for _, value := range []string{rule.Prefix, rule.Glob, rule.Regex} {
+			if value != "" {
+				set++
+			}
+		}
+		if set != 1 {
+			return fmt.Errorf("%s: path rule #%d: exactly one of prefix, glob or regex must be set", owner, i+1)
+		}
+
+		switch {
+		case rule.Prefix != "":
+			if rule.Endpoint == "" {
+				rule.Endpoint = rule.Prefix
+			}
+
+		case rule.Glob != "":
+			rule.regex = pathGlobToRegexp(rule.Glob)
+			if rule.Endpoint == "" {
+				rule.Endpoint = rule.Glob
+			}
+
+		default:
+			regex, err := regexp.Compile(rule.Regex)
+			if err != nil {
+				return fmt.Errorf("%s: path rule #%d: invalid regex %s: %w", owner, i+1, rule.Regex, err)
+			}
+			rule.regex = regex
+			if rule.Endpoint == "" {
+				return fmt.Errorf("%s: path rule #%d: regex rules need an endpoint name", owner, i+1)
+			}
+		}
+	}
+
+	return nil
+}
+
+// pathGlobToRegexp converts a path glob into an anchored regex where each
+// {name} placeholder is a named group
+func pathGlobToRegexp(glob string) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("^")
+
+	for i := 0; i < len(glob); i++ {
+		switch {
+		case strings.HasPrefix(glob[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case glob[i] == '*':
+			b.WriteString("[^/]*")
+		case glob[i] == '{':
+			end := strings.IndexByte(glob[i:], '}')
+			name := ""
+			if end > 0 {
+				name = glob[i+1 : i+end]
+			}
+			if !relabel.IsValidLabelName(name) {
+				b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+				continue
+			}
+			fmt.Fprintf(&b, "(?P<%s>[^/]+)", name)
+			i += end
+		default:
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+
+	b.WriteString("$")
+	return regexp.MustCompile(b.String())
+}
+
+// Endpoint returns the endpoint label for a URL path (without query string):
+// the endpoint of the first matching path rule, "__other__" if none match, or
+// "" if the domain has no path rules
+func (d *MonitoredDomain) Endpoint(path string) string {
+	if len(d.Paths) == 0 {
+		return ""
+	}
+
+	for _, rule := range d.Paths {
+		if rule.regex == nil {
+			if strings.HasPrefix(path, rule.Prefix) {
+				return rule.Endpoint
+			}
+			continue
+		}
+
+		match := rule.regex.FindStringSubmatchIndex(path)
+		if match == nil {
+			continue
+		}
+		if rule.Regex != "" && strings.Contains(rule.Endpoint, "$") {
+			return string(rule.regex.ExpandString(nil, rule.Endpoint, path, match))
+		}
+		return rule.Endpoint
+	}
+
+	return otherEndpoint
+}
+
+// HasPathRules reports whether any monitored domain or pattern declares path rules
+func (c *Config) HasPathRules() bool {
+	return c.pathRules
+}
@@ -0,0 +1,394 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Rule actions
+const (
+	ActionLabel = "label"
+	ActionDrop  = "drop"
+	ActionGroup = "group"
+)
+
+// Rule matches log lines on parsed fields and labels, drops or groups them.
+// All fields set in Match must match (AND); a field matches if any of its
+// values does (OR).
+type Rule struct {
+	Name   string            `yaml:"name,omitempty"`
+	Match  RuleMatch         `yaml:"match"`
+	Action string            `yaml:"action,omitempty"` // label (default), drop or group
+	Group  string            `yaml:"group,omitempty"`  // metric group for action group
+	Labels map[string]string `yaml:"labels,omitempty"`
+}
+
+// RuleMatch lists the conditions of a rule. String values are globs where
+// only * is special; status accepts codes (404), classes (5xx) and ranges
+// (500-599).
+type RuleMatch struct {
+	ClientCIDR  []string `yaml:"client_cidr,omitempty"`
+	User        []string `yaml:"user,omitempty"`
+	Method      []string `yaml:"method,omitempty"`
+	ResultTag   []string `yaml:"result_tag,omitempty"` // e.g. TCP_MISS, TCP_*HIT
+	Status      []string `yaml:"status,omitempty"`
+	ContentType []string `yaml:"content_type,omitempty"`
+	UserAgent   []string `yaml:"user_agent,omitempty"`
+	Hierarchy   []string `yaml:"hierarchy,omitempty"` // e.g. HIER_DIRECT
+	Host        []string `yaml:"host,omitempty"`
+
+	networks []*net.IPNet
+	globs    [globFieldCount][]*regexp.Regexp
+	statuses [][2]int
+}
+
+// Fields matched with globs, in the order of RuleMatch.globFields and LogEntry.globValues
+const (
+	globUser = iota
+	globMethod
+	globResultTag
+	globContentType
+	globUserAgent
+	globHierarchy
+	globHost
+	globFieldCount
+)
+
+func (m *RuleMatch) globFields() [globFieldCount][]string {
+	return [globFieldCount][]string{
+		globUser:        m.User,
+		globMethod:      m.Method,
+		globResultTag:   m.ResultTag,
+		globContentType: m.ContentType,
+		globUserAgent:   m.UserAgent,
+		globHierarchy:   m.Hierarchy,
+		globHost:        m.Host,
+	}
+}
+
+// LogEntry holds the parsed fields of a log line that rules can match on
+type LogEntry struct {
+	ClientIP    string
+	User        string
+	Method      string
+	ResultTag   string
+	Status      string
+	ContentType string
+	UserAgent   string
+	Hierarchy   string // hierarchy code without the peer, e.g. HIER_DIRECT
+	Host        string
+}
+
+func (e *LogEntry) globValues() [globFieldCount]string {
+	return [globFieldCount]string{
+		globUser:        e.User,
+		globMethod:      strings.ToUpper(e.Method),
+		globResultTag:   e.ResultTag,
+		globContentType: e.ContentType,
+		globUserAgent:   e.UserAgent,
+		globHierarchy:   e.Hierarchy,
+		globHost:        e.Host,
+	}
+}
+
+// RuleResult is the outcome of applying all rules to a log line
+type RuleResult struct {
+	Drop     bool
+	DropRule string            // name of the rule that dropped the line
+	Matched  bool              // a label or group rule matched
+	Group    string            // group of the first matching group rule
+	Labels   map[string]string // labels of all matching rules, earlier rules win
+}
+
+// compileRules validates rules and prepares their matchers
+func (c *Config) compileRules() error {
+	for i := range c.Rules {
+		rule := &c.Rules[i]
+		if rule.Name == "" {
+			rule.Name = strconv.Itoa(i + 1)
+		}
+
+		switch rule.Action {
+		case "":
+			rule.Action = ActionLabel
+		case ActionLabel, ActionDrop:
+		case ActionGroup:
+			if rule.Group == "" {
+				return fmt.Errorf("rule %s: action group needs a group name", rule.Name)
+			}
+		default:
+			return fmt.Errorf("rule %s: invalid action %q (valid: label, drop, group)", rule.Name, rule.Action)
+		}
+		if rule.Action == ActionLabel && len(rule.Labels) == 0 {
+			return fmt.Errorf("rule %s: action label needs labels", rule.Name)
+		}
+		for key := range rule.Labels {
+			if key == "group" {
+				return fmt.Errorf("rule %s: label name %q is used by the exporter", rule.Name, key)
+			}
+			if msg := labelNameProblem(key); msg != "" {
+				return fmt.Errorf("rule %s: %s", rule.Name, msg)
+			}
+		}
+
+		if err := rule.Match.compile(); err != nil {
+			return fmt.Errorf("rule %s: %w", rule.Name, err)
+		}
+	}
+
+	return c.checkShadowedRules()
+}
+
+// checkShadowedRules rejects rules that can never change the metrics: rules
+// after a drop rule that matches every line they match, and label rules whose
+// labels are all set first by an earlier rule matching every line they match.
+// Rule labels only appear on the squid_group_* metrics, so such a label rule
+// would have no visible effect at all.
+func (c *Config) checkShadowedRules() error {
+	for i := range c.Rules {
+		rule := &c.Rules[i]
+		for j := 0; j < i; j++ {
+			earlier := &c.Rules[j]
+			if !earlier.Match.covers(&rule.Match) {
+				continue
+			}
+
+			if earlier.Action == ActionDrop {
+				return fmt.Errorf("rule %s never matches: rule %s drops every line it matches", rule.Name, earlier.Name)
+			}
+			if rule.Action == ActionLabel && hasAllKeys(earlier.Labels, rule.Labels) {
+				return fmt.Errorf("rule %s has no effect: rule %s matches every line it matches and sets all of its labels first",
+					rule.Name, earlier.Name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// covers reports whether m matches every line that other matches. Only
+// literally written values are compared, so it may miss a match but never
+// reports a false one.
+func (m *RuleMatch) covers(other *RuleMatch) bool {
+	if !includesValues(m.ClientCIDR, other.ClientCIDR) || !includesValues(m.Status, other.Status) {
+		return false
+	}
+
+	otherFields := other.globFields()
+	for field, values := range m.globFields() {
+		if !includesValues(values, otherFields[field]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// includesValues reports whether condition is unset or lists every value of
+// other
+func includesValues(condition, other []string) bool {
+	if len(condition) == 0 {
+		return true
+	}
+	if len(other) == 0 {
+		return false
+	}
+
+	set := make(map[string]bool, len(condition))
+	for _, value := range condition {
+		set[value] = true
+	}
+	for _, value := range other {
+		if !set[value] {
+			return false
+		}
+	}
+	return true
+}
+
+// hasAllKeys reports whether labels contains every key of keys
+func hasAllKeys(labels, keys map[string]string) bool {
+	for key := range keys {
+		if _, ok := labels[key]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *RuleMatch) compile() error {
+	m.networks = nil
+	for _, cidr := range m.ClientCIDR {
+		if !strings.Contains(cidr, "/") {
+			if strings.Contains(cidr, ":") {
+				cidr += "/128"
+			} else {
+				cidr += "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("invalid client_cidr %q: %w", cidr, err)
+		}
+		m.networks = append(m.networks, network)
+	}
+
+	m.statuses = nil
+	for _, status := range m.Status {
+		bounds, err := parseStatusRange(status)
+		if err != nil {
+			return err
+		}
+		m.statuses = append(m.statuses, bounds)
+	}
+
+	for field, values := range m.globFields() {
+		m.globs[field] = nil
+		for _, value := range values {
+			if field == globMethod {
+				value = strings.ToUpper(value)
+			}
+			m.globs[field] = append(m.globs[field], globToRegexp(value))
+		}
+	}
+
+	return nil
+}
+
+// parseStatusRange parses 404, 5xx or 500-599 into inclusive bounds
+func parseStatusRange(status string) ([2]int, error) {
+	invalid := fmt.Errorf("invalid status %q (use 404, 5xx or 500-599)", status)
+
+	if len(status) == 3 && strings.HasSuffix(strings.ToLower(status), "xx") {
+		class, err := strconv.Atoi(status[:1])
+		if err != nil {
+			return [2]int{}, invalid
+		}
+		return [2]int{class * 100, class*100 + 99}, nil
+	}
+
+	low, high, isRange := strings.Cut(status, "-")
+	from, err := strconv.Atoi(low)
+	if err != nil {
+		return [2]int{}, invalid
+	}
+	to := from
+	if isRange {
+		if to, err = strconv.Atoi(high); err != nil || to < from {
+			return [2]int{}, invalid
+		}
+	}
+	return [2]int{from, to}, nil
+}
+
+// matches reports whether every configured condition matches the entry
+func (m *RuleMatch) matches(entry *LogEntry, values *[globFieldCount]string) bool {
+	if len(m.networks) > 0 {
+		ip := net.ParseIP(entry.ClientIP)
+		if ip == nil || !containsIP(m.networks, ip) {
+			return false
+		}
+	}
+
+	if len(m.statuses) > 0 {
+		code, err := strconv.Atoi(entry.Status)
+		if err != nil || !inRanges(m.statuses, code) {
+			return false
+		}
+	}
+
+	for field, globs := range m.globs {
+		if len(globs) > 0 && !anyMatch(globs, values[field]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func inRanges(ranges [][2]int, code int) bool {
+	for _, r := range ranges {
+		if code >= r[0] && code <= r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+func anyMatch(globs []*regexp.Regexp, value string) bool {
+	for _, glob := range globs {
+		if glob.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// HasRules reports whether any rules are configured
+func (c *Config) HasRules() bool {
+	return len(c.Rules) > 0
+}
+
+// ApplyRules evaluates all rules in order. A drop rule stops evaluation; label
+// and group rules accumulate labels, and the first group rule sets the group.
+func (c *Config) ApplyRules(entry *LogEntry) RuleResult {
+	var result RuleResult
+	values := entry.globValues()
+
+	for i := range c.Rules {
+		rule := &c.Rules[i]
+		if !rule.Match.matches(entry, &values) {
+			continue
+		}
+
+		if rule.Action == ActionDrop {
+			return RuleResult{Drop: true, DropRule: rule.Name}
+		}
+
+		result.Matched = true
+		if rule.Action == ActionGroup && result.Group == "" {
+			result.Group = rule.Group
+		}
+		for key, value := range rule.Labels {
+			if result.Labels == nil {
+				result.Labels = make(map[string]string)
+			}
+			if _, exists := result.Labels[key]; !exists {
+				result.Labels[key] = value
+			}
+		}
+	}
+
+	return result
+}
+
+// GetRuleLabelKeys returns all unique label keys set by rules
+func (c *Config) GetRuleLabelKeys() []string {
+	keySet := make(map[string]bool)
+	for _, rule := range c.Rules {
+		for key := range rule.Labels {
+			keySet[key] = true
+		}
+	}
+
+	keys := make([]string, 0, len(keySet))
+	for key := range keySet {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,465 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"squid-log-exporter/internal/relabel"
+)
+
+// Severity of a configuration problem
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+// Problem is a configuration issue found by Validate. Line is 0 when the
+// problem cannot be tied to a specific line.
+type Problem struct {
+	Line     int
+	Severity string
+	Message  string
+}
+
+func (p Problem) String() string {
+	if p.Line > 0 {
+		return fmt.Sprintf("line %d: %s: %s", p.Line, p.Severity, p.Message)
+	}
+	return fmt.Sprintf("%s: %s", p.Severity, p.Message)
+}
+
+// reservedLabels are used by the exporter's own metrics and cannot be custom labels
+var reservedLabels = map[string]bool{
+	"host":      true,
+	"port":      true,
+	"code":      true,
+	"category":  true,
+	"direction": true,
+	"result":    true,
+	"window":    true,
+	"endpoint":  true,
+}
+
+// Validate checks a configuration file more thoroughly than LoadConfig:
+// unknown keys, duplicate monitored domains, overlapping patterns, invalid
+// label names and log format field index conflicts. All problems are
+// returned with line numbers where possible.
+func Validate(filename string) ([]Problem, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return []Problem{{Line: yamlErrorLine(err), Severity: SeverityError, Message: err.Error()}}, nil
+	}
+
+	var problems []Problem
+	if len(root.Content) > 0 {
+		doc := root.Content[0]
+		checkUnknownKeys(doc, reflect.TypeOf(Config{}), "", &problems)
+		checkMonitoredDomains(doc, &problems)
+		checkDomainPatterns(doc, &problems)
+		checkLogFormatFields(doc, &problems)
+		checkDomainFiles(doc, filepath.Dir(filename), &problems)
+		checkRules(doc, &problems)
+	}
+
+	if _, err := LoadConfig(filename); err != nil {
+		problems = append(problems, Problem{Severity: SeverityError, Message: err.Error()})
+	}
+
+	sort.SliceStable(problems, func(i, j int) bool {
+		return problems[i].Line < problems[j].Line
+	})
+
+	return problems, nil
+}
+
+// HasErrors reports whether any problem has error severity
+func HasErrors(problems []Problem) bool {
+	for _, p := range problems {
+		if p.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+// checkUnknownKeys walks the YAML tree alongside the Go type and reports keys
+// that do not correspond to a field
+func checkUnknownKeys(node *yaml.Node, t reflect.Type, path string, problems *[]Problem) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == reflect.TypeOf(time.Duration(0)) {
+		return
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		if node.Kind != yaml.MappingNode {
+			return
+		}
+		fields := structFields(t)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			field, ok := fields[key.Value]
+			if !ok {
+				// <key>_file reads a string field from a file
+				if base, isFile := strings.CutSuffix(key.Value, fileSuffix); isFile {
+					if baseField, exists := fields[base]; exists && isStringType(baseField.Type) {
+						continue
+					}
+				}
+				*problems = append(*problems, Problem{
+					Line:     key.Line,
+					Severity: SeverityError,
+					Message:  fmt.Sprintf("unknown key %q in %s", key.Value, describePath(path)),
+				})
+				continue
+			}
+			checkUnknownKeys(value, field.Type, joinPath(path, key.Value), problems)
+		}
+
+	case reflect.Slice:
+		if node.Kind != yaml.SequenceNode {
+			return
+		}
+		for i, item := range node.Content {
+			checkUnknownKeys(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i), problems)
+		}
+
+	case reflect.Map:
+		if node.Kind != yaml.MappingNode {
+			return
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			checkUnknownKeys(node.Content[i+1], t.Elem(), joinPath(path, node.Content[i].Value), problems)
+		}
+	}
+}
+
+// checkMonitoredDomains reports duplicate monitored domains and invalid label names
+func checkMonitoredDomains(doc *yaml.Node, problems *[]Problem) {
+	domains := mappingValue(doc, "monitored_domains")
+	if domains == nil || domains.Kind != yaml.SequenceNode {
+		return
+	}
+
+	seen := make(map[string]int)
+	for _, item := range domains.Content {
+		checkLabelNames(mappingValue(item, "labels"), problems)
+
+		host := scalarValue(mappingValue(item, "host"))
+		siteName := scalarValue(mappingValue(item, "site"))
+		port := scalarValue(mappingValue(item, "port"))
+
+		key := "host " + host
+		if host == "" {
+			key = "site " + siteName
+		}
+		if port != "" {
+			key += ":" + port
+		}
+
+		if line, ok := seen[key]; ok {
+			*problems = append(*problems, Problem{
+				Line:     item.Line,
+				Severity: SeverityError,
+				Message:  fmt.Sprintf("duplicate monitored domain %s (first defined at line %d)", key, line),
+			})
+			continue
+		}
+		seen[key] = item.Line
+	}
+}
+
+// checkDomainPatterns reports invalid label names, label templates that
+// reference unknown capture groups and glob patterns shadowed by an earlier pattern
+func checkDomainPatterns(doc *yaml.Node, problems *[]Problem) {
+	patterns := mappingValue(doc, "domain_patterns")
+	if patterns == nil || patterns.Kind != yaml.SequenceNode {
+		return
+	}
+
+	type compiled struct {
+		pattern string
+		match   string
+		line    int
+		regex   *regexp.Regexp
+	}
+	var previous []compiled
+
+	for _, item := range patterns.Content {
+		labels := mappingValue(item, "labels")
+		checkLabelNames(labels, problems)
+
+		pattern := scalarValue(mappingValue(item, "pattern"))
+		expr := scalarValue(mappingValue(item, "regex"))
+		match := scalarValue(mappingValue(item, "match"))
+
+		var regex *regexp.Regexp
+		switch {
+		case expr != "" && pattern == "":
+			var err error
+			if regex, err = regexp.Compile(expr); err != nil {
+				continue
+			}
+		case pattern != "" && expr == "":
+			regex = globToRegexp(pattern)
+		default:
+			continue
+		}
+		checkLabelTemplates(labels, regex, problems)
+
+		// Overlap is only detectable for globs: an earlier pattern shadows a
+		// later one if it matches an example host generated from it
+		if pattern == "" {
+			continue
+		}
+		example := strings.ReplaceAll(pattern, "*", "x")
+		for _, prev := range previous {
+			if prev.match == match && prev.regex.MatchString(example) {
+				*problems = append(*problems, Problem{
+					Line:     item.Line,
+					Severity: SeverityWarning,
+					Message: fmt.Sprintf("pattern %q overlaps pattern %q (line %d), which is checked first",
+						pattern, prev.pattern, prev.line),
+				})
+				break
+			}
+		}
+
+		previous = append(previous, compiled{
+			pattern: pattern,
+			match:   match,
+			line:    item.Line,
+			regex:   regex,
+		})
+	}
+}
+
+// templateRefRegex matches $name, ${name} and $1 references in label templates
+var templateRefRegex = regexp.MustCompile(`\$(\$|\{([a-zA-Z0-9_]+)\}|([a-zA-Z0-9_]+))`)
+
+// checkLabelTemplates warns about label values referencing capture groups
+// that the pattern does not define; they would expand to an empty string
+func checkLabelTemplates(labels *yaml.Node, regex *regexp.Regexp, problems *[]Problem) {
+	if labels == nil || labels.Kind != yaml.MappingNode {
+		return
+	}
+
+	groups := make(map[string]bool)
+	for i, name := range regex.SubexpNames() {
+		groups[fmt.Sprint(i)] = true
+		if name != "" {
+			groups[name] = true
+		}
+	}
+
+	for i := 0; i+1 < len(labels.Content); i += 2 {
+		value := labels.Content[i+1]
+		for _, ref := range templateRefRegex.FindAllStringSubmatch(value.Value, -1) {
+			name := ref[2] + ref[3]
+			if name == "" || groups[name] {
+				continue
+			}
+			*problems = append(*problems, Problem{
+				Line:     value.Line,
+				Severity: SeverityWarning,
+				Message:  fmt.Sprintf("label %q references unknown capture group %q", labels.Content[i].Value, name),
+			})
+		}
+	}
+}
+
+// checkLabelNames reports custom label names that are not valid Prometheus
+// label names or collide with the exporter's own labels
+func checkLabelNames(labels *yaml.Node, problems *[]Problem) {
+	if labels == nil || labels.Kind != yaml.MappingNode {
+		return
+	}
+
+	for i := 0; i+1 < len(labels.Content); i += 2 {
+		key := labels.Content[i]
+		if msg := labelNameProblem(key.Value); msg != "" {
+			*problems = append(*problems, Problem{
+				Line:     key.Line,
+				Severity: SeverityError,
+				Message:  msg,
+			})
+		}
+	}
+}
+
+// labelNameProblem describes why name cannot be a custom label, or returns ""
+func labelNameProblem(name string) string {
+	switch {
+	case !relabel.IsValidLabelName(name):
+		return fmt.Sprintf("invalid label name %q (must match %s)", name, relabel.LabelNamePattern)
+	case strings.HasPrefix(name, "__"):
+		return fmt.Sprintf("label name %q is reserved (names starting with __ are internal)", name)
+	case reservedLabels[name]:
+		return fmt.Sprintf("label name %q is used by the exporter and cannot be a custom label", name)
+	}
+	return ""
+}
+
+// checkDomainFiles reports invalid label names in monitored_domains_files.
+// Read errors and conflicts are reported by LoadConfig.
+func checkDomainFiles(doc *yaml.Node, baseDir string, problems *[]Problem) {
+	globs := mappingValue(doc, "monitored_domains_files")
+	if globs == nil || globs.Kind != yaml.SequenceNode {
+		return
+	}
+
+	for _, item := range globs.Content {
+		glob := item.Value
+		if !filepath.IsAbs(glob) {
+			glob = filepath.Join(baseDir, glob)
+		}
+		files, _ := filepath.Glob(glob)
+
+		for _, file := range files {
+			entries, err := readDomainsFile(file)
+			if err != nil {
+				continue
+			}
+
+			var labelSets []map[string]string
+			for _, domain := range entries.MonitoredDomains {
+				labelSets = append(labelSets, domain.Labels)
+			}
+			for _, pattern := range entries.DomainPatterns {
+				labelSets = append(labelSets, pattern.Labels)
+			}
+
+			names := make(map[string]bool)
+			for _, labels := range labelSets {
+				for name := range labels {
+					names[name] = true
+				}
+			}
+
+			sorted := make([]string, 0, len(names))
+			for name := range names {
+				sorted = append(sorted, name)
+			}
+			sort.Strings(sorted)
+
+			for _, name := range sorted {
+				if msg := labelNameProblem(name); msg != "" {
+					*problems = append(*problems, Problem{
+						Line:     item.Line,
+						Severity: SeverityError,
+						Message:  fmt.Sprintf("%s: %s", file, msg),
+					})
+				}
+			}
+		}
+	}
+}
+
+// checkRules reports invalid rule label names
+func checkRules(doc *yaml.Node, problems *[]Problem) {
+	rules := mappingValue(doc, "rules")
+	if rules == nil || rules.Kind != yaml.SequenceNode {
+		return
+	}
+
+	for _, item := range rules.Content {
+		checkLabelNames(mappingValue(item, "labels"), problems)
+	}
+}
+
+// checkLogFormatFields reports negative or duplicate field indexes
+func checkLogFormatFields(doc *yaml.Node, problems *[]Problem) {
+	fields := mappingValue(mappingValue(doc, "log_format"), "fields")
+	if fields == nil || fields.Kind != yaml.MappingNode {
+		return
+	}
+
+	byIndex := make(map[string]string)
+	for i := 0; i+1 < len(fields.Content); i += 2 {
+		name, index := fields.Content[i], fields.Content[i+1]
+
+		if strings.HasPrefix(index.Value, "-") {
+			*problems = append(*problems, Problem{
+				Line:     index.Line,
+				Severity: SeverityError,
+				Message:  fmt.Sprintf("field %q has negative index %s", name.Value, index.Value),
+			})
+			continue
+		}
+
+		if other, ok := byIndex[index.Value]; ok {
+			*problems = append(*problems, Problem{
+				Line:     index.Line,
+				Severity: SeverityError,
+				Message:  fmt.Sprintf("field %q uses index %s, already used by field %q", name.Value, index.Value, other),
+			})
+			continue
+		}
+		byIndex[index.Value] = name.Value
+	}
+}
+
+// mappingValue returns the value node for key in a mapping node
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+func scalarValue(node *yaml.Node) string {
+	if node == nil || node.Kind != yaml.ScalarNode {
+		return ""
+	}
+	return node.Value
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func describePath(path string) string {
+	if path == "" {
+		return "top level"
+	}
+	return path
+}
+
+// yamlErrorLine extracts the line number from a yaml.v3 error message
+func yamlErrorLine(err error) int {
+	var typeErr *yaml.TypeError
+	msg := err.Error()
+	if errors.As(err, &typeErr) && len(typeErr.Errors) > 0 {
+		msg = typeErr.Errors[0]
+	}
+
+	var line int
+	if idx := strings.Index(msg, "line "); idx >= 0 {
+		fmt.Sscanf(msg[idx:], "line %d", &line)
+	}
+	return line
+}
@@ -0,0 +1,136 @@
+package hll
+
+import (
+	"encoding/base64"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+// Sketch is a HyperLogLog cardinality estimator. With precision p it uses
+// 2^p one-byte registers and has a standard error of about 1.04/sqrt(2^p).
+type Sketch struct {
+	precision uint8
+	registers []uint8
+}
+
+// New creates an empty sketch with the given precision (4-16)
+func New(precision uint8) (*Sketch, error) {
+	if precision < 4 || precision > 16 {
+		return nil, fmt.Errorf("hll precision must be between 4 and 16, got %d", precision)
+	}
+	return &Sketch{
+		precision: precision,
+		registers: make([]uint8, 1<<precision),
+	}, nil
+}
+
+// Add inserts a value into the sketch
+func (s *Sketch) Add(value string) {
+	h := hash(value)
+	idx := h >> (64 - s.precision)
+	rank := uint8(bits.LeadingZeros64(h<<s.precision|1<<(s.precision-1))) + 1
+	if rank > s.registers[idx] {
+		s.registers[idx] = rank
+	}
+}
+
+// Merge folds other into s. Both sketches must have the same precision.
+func (s *Sketch) Merge(other *Sketch) error {
+	if other.precision != s.precision {
+		return fmt.Errorf("cannot merge hll sketches with precision %d and %d", s.precision, other.precision)
+	}
+	for i, r := range other.registers {
+		if r > s.registers[i] {
+			s.registers[i] = r
+		}
+	}
+	return nil
+}
+
+// Estimate returns the estimated number of distinct values added
+func (s *Sketch) Estimate() float64 {
+	m := float64(len(s.registers))
+
+	sum := 0.0
+	zeros := 0
+	for _, r := range s.registers {
+		sum += 1 / float64(uint64(1)<<r)
+		if r == 0 {
+			zeros++
+		}
+	}
+
+	estimate := alpha(m) * m * m / sum
+
+	// Small range correction (linear counting)
+	if estimate <= 2.5*m && zeros > 0 {
+		return m * math.Log(m/float64(zeros))
+	}
+
+	return estimate
+}
+
+// MarshalBinary encodes the sketch as its precision followed by the registers
+func (s *Sketch) MarshalBinary() ([]byte, error) {
+	data := make([]byte, 0, len(s.registers)+1)
+	data = append(data, s.precision)
+	return append(data, s.registers...), nil
+}
+
+// UnmarshalBinary decodes a sketch produced by MarshalBinary
+func (s *Sketch) UnmarshalBinary(data []byte) error {
+	if len(data) < 1 {
+		return fmt.Errorf("hll sketch data is empty")
+	}
+	precision := data[0]
+	if precision < 4 || precision > 16 || len(data)-1 != 1<<precision {
+		return fmt.Errorf("invalid hll sketch data (precision %d, %d registers)", precision, len(data)-1)
+	}
+	s.precision = precision
+	s.registers = append([]uint8(nil), data[1:]...)
+	return nil
+}
+
+// MarshalText encodes the sketch as base64 so it can be stored in JSON
+func (s *Sketch) MarshalText() ([]byte, error) {
+	data, _ := s.MarshalBinary()
+	return []byte(base64.StdEncoding.EncodeToString(data)), nil
+}
+
+// UnmarshalText decodes a sketch produced by MarshalText
+func (s *Sketch) UnmarshalText(text []byte) error {
+	data, err := base64.StdEncoding.DecodeString(string(text))
+	if err != nil {
+		return fmt.Errorf("invalid hll sketch encoding: %w", err)
+	}
+	return s.UnmarshalBinary(data)
+}
+
+func alpha(m float64) float64 {
+	switch m {
+	case 16:
+		return 0.673
+	case 32:
+		return 0.697
+	case 64:
+		return 0.709
+	default:
+		return 0.7213 / (1 + 1.079/m)
+	}
+}
+
+// hash is FNV-1a followed by a 64-bit finalizer; it is stable across
+// restarts so persisted sketches stay valid
+func hash(value string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(value))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
@@ -0,0 +1,94 @@
+package hll
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+// newSketch returns a sketch with values value0 to value(n-1) from offset
+func newSketch(t *testing.T, precision uint8, offset, n int) *Sketch {
+	t.Helper()
+
+	s, err := New(precision)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := offset; i < offset+n; i++ {
+		s.Add(fmt.Sprintf("value%d", i))
+	}
+	return s
+}
+
+// checkEstimate fails if estimate is more than three standard errors off n
+func checkEstimate(t *testing.T, precision uint8, n int, estimate float64) {
+	t.Helper()
+
+	standardError := 1.04 / math.Sqrt(float64(uint(1)<<precision))
+	if relative := math.Abs(estimate-float64(n)) / float64(n); relative > 3*standardError {
+		t.Errorf("precision %d: estimate %.0f for %d values, off by %.1f%% (3 standard errors: %.1f%%)",
+			precision, estimate, n, relative*100, 3*standardError*100)
+	}
+}
+
+func TestEstimateWithinStandardError(t *testing.T) {
+	for _, precision := range []uint8{10, 14} {
+		for _, n := range []int{10, 1000, 50000, 500000} {
+			checkEstimate(t, precision, n, newSketch(t, precision, 0, n).Estimate())
+		}
+	}
+}
+
+func TestAddingValuesAgainDoesNotChangeEstimate(t *testing.T) {
+	s := newSketch(t, 12, 0, 1000)
+	before := s.Estimate()
+	for i := 0; i < 1000; i++ {
+		s.Add(fmt.Sprintf("value%d", i))
+	}
+	if s.Estimate() != before {
+		t.Fatalf("estimate %v after adding the same values, was %v", s.Estimate(), before)
+	}
+}
+
+func TestMergeEstimatesUnion(t *testing.T) {
+	// Overlapping sets: 0-29999 and 20000-49999
+	a := newSketch(t, 12, 0, 30000)
+	b := newSketch(t, 12, 20000, 30000)
+
+	if err := a.Merge(b); err != nil {
+		t.Fatal(err)
+	}
+	checkEstimate(t, 12, 50000, a.Estimate())
+
+	// Merging is the same as adding everything to one sketch
+	if all := newSketch(t, 12, 0, 50000); all.Estimate() != a.Estimate() {
+		t.Errorf("merged estimate %v, single sketch %v", a.Estimate(), all.Estimate())
+	}
+
+	if err := a.Merge(newSketch(t, 10, 0, 1)); err == nil {
+		t.Error("sketches of different precision merged")
+	}
+}
+
+func TestMarshalRoundTrip(t *testing.T) {
+	s := newSketch(t, 8, 0, 300)
+
+	text, err := s.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Sketch
+	if err := decoded.UnmarshalText(text); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.precision != s.precision || string(decoded.registers) != string(s.registers) {
+		t.Fatal("sketch changed by MarshalText/UnmarshalText")
+	}
+
+	data, _ := s.MarshalBinary()
+	for _, invalid := range [][]byte{nil, {8}, data[:len(data)-1], append([]byte{17}, data[1:]...)} {
+		if err := decoded.UnmarshalBinary(invalid); err == nil {
+			t.Errorf("UnmarshalBinary accepted %d bytes of invalid data", len(invalid))
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package hll
+
+import (
+	"time"
+)
+
+// windowSlots is the number of sub-sketches a Window is split into. The
+// estimate covers between (slots-1)/slots and all of the window.
+const windowSlots = 6
+
+// Window estimates distinct values over a sliding time window using a ring
+// of sketches, each covering 1/windowSlots of the window
+type Window struct {
+	Length    time.Duration `json:"length"`
+	Precision uint8         `json:"precision"`
+	Slots     []Slot        `json:"slots"`
+}
+
+// Slot is a sketch for the period starting at Start
+type Slot struct {
+	Start  time.Time `json:"start"`
+	Sketch *Sketch   `json:"sketch"`
+}
+
+// NewWindow creates an empty sliding window
+func NewWindow(length time.Duration, precision uint8) *Window {
+	return &Window{
+		Length:    length,
+		Precision: precision,
+	}
+}
+
+// Add inserts value at time now
+func (w *Window) Add(now time.Time, value string) {
+	start := now.Truncate(w.slotLength())
+
+	for i := range w.Slots {
+		if w.Slots[i].Start.Equal(start) {
+			w.Slots[i].Sketch.Add(value)
+			return
+		}
+	}
+
+	sketch, err := New(w.Precision)
+	if err != nil {
+		return
+	}
+	sketch.Add(value)
+
+	w.expire(now)
+	w.Slots = append(w.Slots, Slot{Start: start, Sketch: sketch})
+}
+
+// Estimate returns the estimated number of distinct values in the window ending at now
+func (w *Window) Estimate(now time.Time) float64 {
+	merged, err := New(w.Precision)
+	if err != nil {
+		return 0
+	}
+
+	cutoff := now.Add(-w.Length)
+	for _, slot := range w.Slots {
+		if slot.Start.Add(w.slotLength()).After(cutoff) {
+			merged.Merge(slot.Sketch)
+		}
+	}
+
+	return merged.Estimate()
+}
+
+// Empty reports whether the window holds no data as of now
+func (w *Window) Empty(now time.Time) bool {
+	w.expire(now)
+	return len(w.Slots) == 0
+}
+
+// expire drops slots that ended before the window
+func (w *Window) expire(now time.Time) {
+	cutoff := now.Add(-w.Length)
+	kept := w.Slots[:0]
+	for _, slot := range w.Slots {
+		if slot.Start.Add(w.slotLength()).After(cutoff) {
+			kept = append(kept, slot)
+		}
+	}
+	w.Slots = kept
+}
+
+func (w *Window) slotLength() time.Duration {
+	length := w.Length / windowSlots
+	if length <= 0 {
+		return time.Second
+	}
+	return length
+}
@@ -0,0 +1,74 @@
+package hll
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestWindowSlotsExpire(t *testing.T) {
+	// One hour in six slots of ten minutes
+	w := NewWindow(time.Hour, 10)
+	start := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	w.Add(start, "a")
+	w.Add(start.Add(5*time.Minute), "b")  // same slot as a
+	w.Add(start.Add(30*time.Minute), "c") // a later slot
+
+	estimate := func(at time.Duration) float64 {
+		return math.Round(w.Estimate(start.Add(at)))
+	}
+
+	if got := estimate(30 * time.Minute); got != 3 {
+		t.Errorf("estimate after 30m = %v, want 3", got)
+	}
+	// The first slot ends at 10m and is counted until it is an hour old
+	if got := estimate(69 * time.Minute); got != 3 {
+		t.Errorf("estimate after 69m = %v, want 3", got)
+	}
+	if got := estimate(70 * time.Minute); got != 1 {
+		t.Errorf("estimate after 70m = %v, want 1", got)
+	}
+	if w.Empty(start.Add(80 * time.Minute)) {
+		t.Error("window empty while the slot of c is in it")
+	}
+	if !w.Empty(start.Add(100 * time.Minute)) {
+		t.Errorf("window not empty after every slot expired: %d slots", len(w.Slots))
+	}
+	if got := estimate(100 * time.Minute); got != 0 {
+		t.Errorf("estimate after expiry = %v, want 0", got)
+	}
+}
+
+func TestWindowAddDropsExpiredSlots(t *testing.T) {
+	w := NewWindow(time.Hour, 10)
+	start := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 24; i++ {
+		w.Add(start.Add(time.Duration(i)*10*time.Minute), "a")
+	}
+	if len(w.Slots) > windowSlots+1 {
+		t.Fatalf("%d slots kept for a window of %d", len(w.Slots), windowSlots)
+	}
+}
+
+func TestWindowJSONRoundTrip(t *testing.T) {
+	w := NewWindow(time.Hour, 10)
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	w.Add(now, "a")
+	w.Add(now.Add(20*time.Minute), "b")
+
+	data, err := json.Marshal(w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Window
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	at := now.Add(30 * time.Minute)
+	if decoded.Estimate(at) != w.Estimate(at) || len(decoded.Slots) != 2 {
+		t.Fatalf("decoded window estimates %v with %d slots, want %v with 2", decoded.Estimate(at), len(decoded.Slots), w.Estimate(at))
+	}
+}
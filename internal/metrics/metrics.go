@@ -1,23 +1,39 @@
 package metrics
 
 import (
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"squid-log-exporter/internal/topk"
 )
 
 type Metrics struct {
 	// Global metrics
-	connectionsTotal       prometheus.Counter
-	requestDurationTotal   *prometheus.CounterVec
-	cacheStatusTotal       *prometheus.CounterVec
-	httpResponsesTotal     *prometheus.CounterVec
+	connectionsTotal     prometheus.Counter
+	requestDurationTotal *prometheus.CounterVec
+	cacheStatusTotal     *prometheus.CounterVec
+	httpResponsesTotal   *prometheus.CounterVec
+	cacheRequestsTotal   *prometheus.CounterVec
+	cacheBytesTotal      *prometheus.CounterVec
 
 	// Basic metrics for ALL domains
 	allDomainsRequestsCounter      *prometheus.CounterVec
 	allDomainsHTTPResponsesCounter *prometheus.CounterVec
 	allDomainsBytesCounter         *prometheus.CounterVec
+	allDomainsCacheRequestsCounter *prometheus.CounterVec
+	allDomainsCacheBytesCounter    *prometheus.CounterVec
+
+	// Basic metrics per registrable domain (site)
+	siteRequestsCounter      *prometheus.CounterVec
+	siteHTTPResponsesCounter *prometheus.CounterVec
+	siteBytesCounter         *prometheus.CounterVec
+	siteCacheRequestsCounter *prometheus.CounterVec
+	siteCacheBytesCounter    *prometheus.CounterVec
 
 	// Extended metrics for MONITORED domains (with dynamic labels)
 	monitoredDomainsRequestsCounter      *prometheus.CounterVec
@@ -28,30 +44,105 @@ type Metrics struct {
 	monitoredDomainsP90Duration          *prometheus.GaugeVec
 	monitoredDomainsP95Duration          *prometheus.GaugeVec
 	monitoredDomainsP99Duration          *prometheus.GaugeVec
-	monitoredDomainsCacheHitRatio        *prometheus.GaugeVec
+	monitoredDomainsCacheRequestsCounter *prometheus.CounterVec
+	monitoredDomainsCacheBytesCounter    *prometheus.CounterVec
+
+	// Per-endpoint metrics for monitored domains with path rules
+	monitoredEndpointsRequestsCounter      *prometheus.CounterVec
+	monitoredEndpointsHTTPResponsesCounter *prometheus.CounterVec
+	monitoredEndpointsAvgDuration          *prometheus.GaugeVec
+	monitoredEndpointsP50Duration          *prometheus.GaugeVec
+	monitoredEndpointsP90Duration          *prometheus.GaugeVec
+	monitoredEndpointsP95Duration          *prometheus.GaugeVec
+	monitoredEndpointsP99Duration          *prometheus.GaugeVec
+
+	// Distinct value estimates per window
+	uniqueClients                 *prometheus.GaugeVec
+	uniqueUsers                   *prometheus.GaugeVec
+	uniqueHosts                   *prometheus.GaugeVec
+	monitoredDomainsUniqueClients *prometheus.GaugeVec
+	monitoredDomainsUniqueUsers   *prometheus.GaugeVec
+
+	// Heavy hitters per window
+	topDomainsRequests      *prometheus.GaugeVec
+	topDomainsRequestsError *prometheus.GaugeVec
+	topDomainsBytes         *prometheus.GaugeVec
+	topDomainsBytesError    *prometheus.GaugeVec
+
+	// Configuration reloads
+	configReloadSuccess   prometheus.Gauge
+	configReloadTimestamp prometheus.Gauge
 
-	// Custom label keys for monitored domains
-	customLabelKeys []string
+	// Domain tracking state
+	trackedDomains *prometheus.GaugeVec
+	domainsEvicted *prometheus.CounterVec
 
-	// State tracking
-	lastSeen map[string]float64
+	// Exporter self-observability
+	linesRead            prometheus.Counter
+	linesParsed          prometheus.Counter
+	linesRejected        *prometheus.CounterVec
+	bytesRead            prometheus.Counter
+	parseDuration        prometheus.Histogram
+	parseFailures        prometheus.Counter
+	logFileOffset        prometheus.Gauge
+	logFileSize          prometheus.Gauge
+	logFileLag           prometheus.Gauge
+	logRotations         prometheus.Counter
+	positionSaveFailures prometheus.Counter
+
+	// Custom label keys for monitored domains. Monitored metrics live in their
+	// own registry, replaced when the label keys change, since a registry
+	// requires label names to stay fixed for its lifetime.
+	customLabelKeys   []string
+	monitoredRegistry *prometheus.Registry
+
+	// Rule groups; labelled by the rule label keys from config, so they also
+	// live in their own registry
+	groupRequestsCounter      *prometheus.CounterVec
+	groupBytesCounter         *prometheus.CounterVec
+	groupHTTPResponsesCounter *prometheus.CounterVec
+	ruleLabelKeys             []string
+	groupRegistry             *prometheus.Registry
+	droppedLinesCounter       *prometheus.CounterVec
+
+	// Relabeling applied to all exposed series
+	router *router
+
+	// Registry of the metrics above
+	gatherer prometheus.Gatherer
 	mu       sync.RWMutex
+
+	// Held while a parse cycle is applied and checkpointed, so scrapes never
+	// see counts that are not committed yet
+	commitMu sync.RWMutex
 }
 
-// NewMetrics creates metrics with optional custom label keys
+// NewMetrics creates metrics with optional custom label keys, registered in
+// the default registry
 func NewMetrics(customLabelKeys []string) *Metrics {
+	return newMetrics(customLabelKeys, prometheus.DefaultRegisterer, prometheus.DefaultGatherer)
+}
+
+// NewIsolatedMetrics creates metrics in a private registry without the Go
+// runtime and process collectors, for offline subcommands such as replay
+func NewIsolatedMetrics(customLabelKeys []string) *Metrics {
+	registry := prometheus.NewRegistry()
+	return newMetrics(customLabelKeys, registry, registry)
+}
+
+func newMetrics(customLabelKeys []string, registerer prometheus.Registerer, gatherer prometheus.Gatherer) *Metrics {
 	m := &Metrics{
-		lastSeen:        make(map[string]float64),
-		customLabelKeys: customLabelKeys,
+		gatherer: gatherer,
+		router:   newRouter(),
 	}
 
 	// Global counters
-	m.connectionsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	m.connectionsTotal = m.newCounter(prometheus.CounterOpts{
 		Name: "squid_connections_total",
 		Help: "Total number of connections",
 	})
 
-	m.requestDurationTotal = prometheus.NewCounterVec(
+	m.requestDurationTotal = m.newCounterVec(
 		prometheus.CounterOpts{
 			Name: "squid_request_duration_seconds_total",
 			Help: "Total request duration in seconds by interval",
@@ -59,7 +150,7 @@ func NewMetrics(customLabelKeys []string) *Metrics {
 		[]string{"interval"},
 	)
 
-	m.cacheStatusTotal = prometheus.NewCounterVec(
+	m.cacheStatusTotal = m.newCounterVec(
 		prometheus.CounterOpts{
 			Name: "squid_cache_status_total",
 			Help: "Total number of requests by cache status",
@@ -67,7 +158,7 @@ func NewMetrics(customLabelKeys []string) *Metrics {
 		[]string{"status"},
 	)
 
-	m.httpResponsesTotal = prometheus.NewCounterVec(
+	m.httpResponsesTotal = m.newCounterVec(
 		prometheus.CounterOpts{
 			Name: "squid_http_responses_total",
 			Help: "Total number of HTTP responses by status code and category",
@@ -75,8 +166,24 @@ func NewMetrics(customLabelKeys []string) *Metrics {
 		[]string{"code", "category"},
 	)
 
+	m.cacheRequestsTotal = m.newCounterVec(
+		prometheus.CounterOpts{
+			Name: "squid_cache_requests_total",
+			Help: "Total number of cacheable requests by cache result (hit/miss)",
+		},
+		[]string{"result"},
+	)
+
+	m.cacheBytesTotal = m.newCounterVec(
+		prometheus.CounterOpts{
+			Name: "squid_cache_bytes_total",
+			Help: "Total bytes delivered for cacheable requests by cache result (hit/miss)",
+		},
+		[]string{"result"},
+	)
+
 	// All domains metrics
-	m.allDomainsRequestsCounter = prometheus.NewCounterVec(
+	m.allDomainsRequestsCounter = m.newCounterVec(
 		prometheus.CounterOpts{
 			Name: "squid_all_domains_requests_total",
 			Help: "Total requests for all domains (basic tracking)",
@@ -84,7 +191,7 @@ func NewMetrics(customLabelKeys []string) *Metrics {
 		[]string{"host", "port"},
 	)
 
-	m.allDomainsHTTPResponsesCounter = prometheus.NewCounterVec(
+	m.allDomainsHTTPResponsesCounter = m.newCounterVec(
 		prometheus.CounterOpts{
 			Name: "squid_all_domains_http_responses_total",
 			Help: "HTTP responses for all domains by category",
@@ -92,7 +199,7 @@ func NewMetrics(customLabelKeys []string) *Metrics {
 		[]string{"host", "port", "category"},
 	)
 
-	m.allDomainsBytesCounter = prometheus.NewCounterVec(
+	m.allDomainsBytesCounter = m.newCounterVec(
 		prometheus.CounterOpts{
 			Name: "squid_all_domains_bytes_total",
 			Help: "Total bytes transferred for all domains",
@@ -100,11 +207,292 @@ func NewMetrics(customLabelKeys []string) *Metrics {
 		[]string{"host", "port", "direction"},
 	)
 
-	// Monitored domains metrics with dynamic custom labels
+	m.allDomainsCacheRequestsCounter = m.newCounterVec(
+		prometheus.CounterOpts{
+			Name: "squid_all_domains_cache_requests_total",
+			Help: "Cacheable requests for all domains by cache result (hit/miss)",
+		},
+		[]string{"host", "port", "result"},
+	)
+
+	m.allDomainsCacheBytesCounter = m.newCounterVec(
+		prometheus.CounterOpts{
+			Name: "squid_all_domains_cache_bytes_total",
+			Help: "Bytes delivered for cacheable requests for all domains by cache result (hit/miss)",
+		},
+		[]string{"host", "port", "result"},
+	)
+
+	// Site (registrable domain) metrics
+	m.siteRequestsCounter = m.newCounterVec(
+		prometheus.CounterOpts{
+			Name: "squid_site_requests_total",
+			Help: "Total requests per registrable domain (eTLD+1)",
+		},
+		[]string{"site"},
+	)
+
+	m.siteHTTPResponsesCounter = m.newCounterVec(
+		prometheus.CounterOpts{
+			Name: "squid_site_http_responses_total",
+			Help: "HTTP responses per registrable domain by category",
+		},
+		[]string{"site", "category"},
+	)
+
+	m.siteBytesCounter = m.newCounterVec(
+		prometheus.CounterOpts{
+			Name: "squid_site_bytes_total",
+			Help: "Total bytes transferred per registrable domain",
+		},
+		[]string{"site", "direction"},
+	)
+
+	m.siteCacheRequestsCounter = m.newCounterVec(
+		prometheus.CounterOpts{
+			Name: "squid_site_cache_requests_total",
+			Help: "Cacheable requests per registrable domain by cache result (hit/miss)",
+		},
+		[]string{"site", "result"},
+	)
+
+	m.siteCacheBytesCounter = m.newCounterVec(
+		prometheus.CounterOpts{
+			Name: "squid_site_cache_bytes_total",
+			Help: "Bytes delivered for cacheable requests per registrable domain by cache result (hit/miss)",
+		},
+		[]string{"site", "result"},
+	)
+
+	// Distinct value estimates
+	m.uniqueClients = m.newGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "squid_unique_clients",
+			Help: "Estimated number of distinct client IPs in the window",
+		},
+		[]string{"window"},
+	)
+
+	m.uniqueUsers = m.newGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "squid_unique_users",
+			Help: "Estimated number of distinct users in the window",
+		},
+		[]string{"window"},
+	)
+
+	m.uniqueHosts = m.newGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "squid_unique_hosts",
+			Help: "Estimated number of distinct destination hosts in the window",
+		},
+		[]string{"window"},
+	)
+
+	// Top domains
+	topLabels := []string{"rank", "host", "port"}
+	m.topDomainsRequests = m.newGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "squid_top_domains_requests",
+			Help: "Estimated requests for the top domains in the last completed window",
+		},
+		topLabels,
+	)
+
+	m.topDomainsRequestsError = m.newGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "squid_top_domains_requests_error",
+			Help: "Upper bound on the overestimation of squid_top_domains_requests",
+		},
+		topLabels,
+	)
+
+	m.topDomainsBytes = m.newGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "squid_top_domains_bytes",
+			Help: "Estimated bytes transferred for the top domains in the last completed window",
+		},
+		topLabels,
+	)
+
+	m.topDomainsBytesError = m.newGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "squid_top_domains_bytes_error",
+			Help: "Upper bound on the overestimation of squid_top_domains_bytes",
+		},
+		topLabels,
+	)
+
+	// Configuration reloads
+	m.configReloadSuccess = m.newGauge(prometheus.GaugeOpts{
+		Name: "squid_exporter_config_last_reload_successful",
+		Help: "Whether the last configuration reload attempt was successful",
+	})
+
+	m.configReloadTimestamp = m.newGauge(prometheus.GaugeOpts{
+		Name: "squid_exporter_config_last_reload_success_timestamp_seconds",
+		Help: "Timestamp of the last successful configuration reload",
+	})
+
+	// Domain tracking
+	m.trackedDomains = m.newGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "squid_exporter_tracked_domains",
+			Help: "Number of domains currently tracked individually",
+		},
+		[]string{"kind"},
+	)
+
+	m.domainsEvicted = m.newCounterVec(
+		prometheus.CounterOpts{
+			Name: "squid_exporter_domains_evicted_total",
+			Help: "Total number of tracked domains whose series were deleted, by reason (ttl/lru)",
+		},
+		[]string{"kind", "reason"},
+	)
+
+	// Exporter self-observability
+	m.linesRead = m.newCounter(prometheus.CounterOpts{
+		Name: "squid_exporter_lines_read_total",
+		Help: "Total log lines read",
+	})
+
+	m.linesParsed = m.newCounter(prometheus.CounterOpts{
+		Name: "squid_exporter_lines_parsed_total",
+		Help: "Total log lines parsed successfully, including lines dropped by rules",
+	})
+
+	m.linesRejected = m.newCounterVec(
+		prometheus.CounterOpts{
+			Name: "squid_exporter_lines_rejected_total",
+			Help: "Total log lines that could not be parsed, by reason (field_count/result_code/url)",
+		},
+		[]string{"reason"},
+	)
+
+	m.bytesRead = m.newCounter(prometheus.CounterOpts{
+		Name: "squid_exporter_bytes_read_total",
+		Help: "Total bytes of log lines read",
+	})
+
+	m.parseDuration = m.newHistogram(prometheus.HistogramOpts{
+		Name:    "squid_exporter_parse_duration_seconds",
+		Help:    "Duration of parse cycles",
+		Buckets: prometheus.ExponentialBuckets(0.01, 4, 8),
+	})
+
+	m.parseFailures = m.newCounter(prometheus.CounterOpts{
+		Name: "squid_exporter_parse_failures_total",
+		Help: "Total parse cycles that failed",
+	})
+
+	m.logFileOffset = m.newGauge(prometheus.GaugeOpts{
+		Name: "squid_exporter_log_file_offset_bytes",
+		Help: "Current read offset in the log file",
+	})
+
+	m.logFileSize = m.newGauge(prometheus.GaugeOpts{
+		Name: "squid_exporter_log_file_size_bytes",
+		Help: "Size of the log file when the offset was last saved",
+	})
+
+	m.logFileLag = m.newGauge(prometheus.GaugeOpts{
+		Name: "squid_exporter_log_file_lag_bytes",
+		Help: "Bytes of the log file not yet read (size minus offset)",
+	})
+
+	m.logRotations = m.newCounter(prometheus.CounterOpts{
+		Name: "squid_exporter_log_rotations_total",
+		Help: "Total log rotations detected",
+	})
+
+	m.positionSaveFailures = m.newCounter(prometheus.CounterOpts{
+		Name: "squid_exporter_position_save_failures_total",
+		Help: "Total failed attempts to save the position file",
+	})
+
+	m.droppedLinesCounter = m.newCounterVec(
+		prometheus.CounterOpts{
+			Name: "squid_rules_dropped_lines_total",
+			Help: "Total log lines dropped by match rules, by rule name",
+		},
+		[]string{"rule"},
+	)
+
+	// Register all
+	registerer.MustRegister(
+		// Global counters
+		m.connectionsTotal,
+		m.requestDurationTotal,
+		m.cacheStatusTotal,
+		m.httpResponsesTotal,
+		m.cacheRequestsTotal,
+		m.cacheBytesTotal,
+		// All domains
+		m.allDomainsRequestsCounter,
+		m.allDomainsHTTPResponsesCounter,
+		m.allDomainsBytesCounter,
+		m.allDomainsCacheRequestsCounter,
+		m.allDomainsCacheBytesCounter,
+		// Sites
+		m.siteRequestsCounter,
+		m.siteHTTPResponsesCounter,
+		m.siteBytesCounter,
+		m.siteCacheRequestsCounter,
+		m.siteCacheBytesCounter,
+		// Distinct value estimates
+		m.uniqueClients,
+		m.uniqueUsers,
+		m.uniqueHosts,
+		// Top domains
+		m.topDomainsRequests,
+		m.topDomainsRequestsError,
+		m.topDomainsBytes,
+		m.topDomainsBytesError,
+		// Configuration reloads
+		m.configReloadSuccess,
+		m.configReloadTimestamp,
+		// Domain tracking
+		m.trackedDomains,
+		m.domainsEvicted,
+		// Exporter self-observability
+		m.linesRead,
+		m.linesParsed,
+		m.linesRejected,
+		m.bytesRead,
+		m.parseDuration,
+		m.parseFailures,
+		m.logFileOffset,
+		m.logFileSize,
+		m.logFileLag,
+		m.logRotations,
+		m.positionSaveFailures,
+		// Rules
+		m.droppedLinesCounter,
+	)
+
+	// Monitored domains
+	m.newMonitoredMetrics(customLabelKeys)
+
+	// Rule groups
+	m.newGroupMetrics(nil)
+
+	return m
+}
+
+// newMonitoredMetrics creates the monitored domain vectors, whose label set
+// depends on the custom label keys from config
+func (m *Metrics) newMonitoredMetrics(customLabelKeys []string) {
+	m.customLabelKeys = customLabelKeys
+	m.monitoredRegistry = prometheus.NewRegistry()
+	defer func() {
+		m.monitoredRegistry.MustRegister(m.monitoredCollectors()...)
+	}()
+
 	// Base labels: host, port + custom labels from config
 	monitoredLabels := append([]string{"host", "port"}, customLabelKeys...)
 
-	m.monitoredDomainsRequestsCounter = prometheus.NewCounterVec(
+	m.monitoredDomainsRequestsCounter = m.newCounterVec(
 		prometheus.CounterOpts{
 			Name: "squid_monitored_domains_requests_total",
 			Help: "Total requests for monitored domains (extended tracking)",
@@ -113,7 +501,7 @@ func NewMetrics(customLabelKeys []string) *Metrics {
 	)
 
 	monitoredHTTPLabels := append([]string{"host", "port", "code", "category"}, customLabelKeys...)
-	m.monitoredDomainsHTTPResponsesCounter = prometheus.NewCounterVec(
+	m.monitoredDomainsHTTPResponsesCounter = m.newCounterVec(
 		prometheus.CounterOpts{
 			Name: "squid_monitored_domains_http_responses_total",
 			Help: "HTTP responses for monitored domains with detailed breakdown",
@@ -122,7 +510,7 @@ func NewMetrics(customLabelKeys []string) *Metrics {
 	)
 
 	monitoredBytesLabels := append([]string{"host", "port", "direction"}, customLabelKeys...)
-	m.monitoredDomainsBytesCounter = prometheus.NewCounterVec(
+	m.monitoredDomainsBytesCounter = m.newCounterVec(
 		prometheus.CounterOpts{
 			Name: "squid_monitored_domains_bytes_total",
 			Help: "Bytes transferred for monitored domains",
@@ -130,7 +518,7 @@ func NewMetrics(customLabelKeys []string) *Metrics {
 		monitoredBytesLabels,
 	)
 
-	m.monitoredDomainsAvgDuration = prometheus.NewGaugeVec(
+	m.monitoredDomainsAvgDuration = m.newGaugeVec(
 		prometheus.GaugeOpts{
 			Name: "squid_monitored_domains_duration_seconds_avg",
 			Help: "Average request duration for monitored domains",
@@ -138,7 +526,7 @@ func NewMetrics(customLabelKeys []string) *Metrics {
 		monitoredLabels,
 	)
 
-	m.monitoredDomainsP50Duration = prometheus.NewGaugeVec(
+	m.monitoredDomainsP50Duration = m.newGaugeVec(
 		prometheus.GaugeOpts{
 			Name: "squid_monitored_domains_duration_seconds_p50",
 			Help: "50th percentile (median) request duration for monitored domains",
@@ -146,7 +534,7 @@ func NewMetrics(customLabelKeys []string) *Metrics {
 		monitoredLabels,
 	)
 
-	m.monitoredDomainsP90Duration = prometheus.NewGaugeVec(
+	m.monitoredDomainsP90Duration = m.newGaugeVec(
 		prometheus.GaugeOpts{
 			Name: "squid_monitored_domains_duration_seconds_p90",
 			Help: "90th percentile request duration for monitored domains",
@@ -154,7 +542,7 @@ func NewMetrics(customLabelKeys []string) *Metrics {
 		monitoredLabels,
 	)
 
-	m.monitoredDomainsP95Duration = prometheus.NewGaugeVec(
+	m.monitoredDomainsP95Duration = m.newGaugeVec(
 		prometheus.GaugeOpts{
 			Name: "squid_monitored_domains_duration_seconds_p95",
 			Help: "95th percentile request duration for monitored domains",
@@ -162,7 +550,7 @@ func NewMetrics(customLabelKeys []string) *Metrics {
 		monitoredLabels,
 	)
 
-	m.monitoredDomainsP99Duration = prometheus.NewGaugeVec(
+	m.monitoredDomainsP99Duration = m.newGaugeVec(
 		prometheus.GaugeOpts{
 			Name: "squid_monitored_domains_duration_seconds_p99",
 			Help: "99th percentile request duration for monitored domains",
@@ -170,26 +558,102 @@ func NewMetrics(customLabelKeys []string) *Metrics {
 		monitoredLabels,
 	)
 
-	m.monitoredDomainsCacheHitRatio = prometheus.NewGaugeVec(
+	monitoredCacheLabels := append([]string{"host", "port", "result"}, customLabelKeys...)
+	m.monitoredDomainsCacheRequestsCounter = m.newCounterVec(
+		prometheus.CounterOpts{
+			Name: "squid_monitored_domains_cache_requests_total",
+			Help: "Cacheable requests for monitored domains by cache result (hit/miss)",
+		},
+		monitoredCacheLabels,
+	)
+
+	m.monitoredDomainsCacheBytesCounter = m.newCounterVec(
+		prometheus.CounterOpts{
+			Name: "squid_monitored_domains_cache_bytes_total",
+			Help: "Bytes delivered for cacheable requests for monitored domains by cache result (hit/miss)",
+		},
+		monitoredCacheLabels,
+	)
+
+	monitoredUniqueLabels := append([]string{"host", "port", "window"}, customLabelKeys...)
+	m.monitoredDomainsUniqueClients = m.newGaugeVec(
 		prometheus.GaugeOpts{
-			Name: "squid_monitored_domains_cache_hit_ratio",
-			Help: "Cache hit ratio for monitored domains",
+			Name: "squid_monitored_domains_unique_clients",
+			Help: "Estimated number of distinct client IPs per monitored domain in the window",
 		},
-		monitoredLabels,
+		monitoredUniqueLabels,
 	)
 
-	// Register all
-	prometheus.MustRegister(
-		// Global counters
-		m.connectionsTotal,
-		m.requestDurationTotal,
-		m.cacheStatusTotal,
-		m.httpResponsesTotal,
-		// All domains
-		m.allDomainsRequestsCounter,
-		m.allDomainsHTTPResponsesCounter,
-		m.allDomainsBytesCounter,
-		// Monitored domains
+	m.monitoredDomainsUniqueUsers = m.newGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "squid_monitored_domains_unique_users",
+			Help: "Estimated number of distinct users per monitored domain in the window",
+		},
+		monitoredUniqueLabels,
+	)
+
+	endpointLabels := append([]string{"host", "port", "endpoint"}, customLabelKeys...)
+	m.monitoredEndpointsRequestsCounter = m.newCounterVec(
+		prometheus.CounterOpts{
+			Name: "squid_monitored_endpoints_requests_total",
+			Help: "Total requests per endpoint of monitored domains with path rules",
+		},
+		endpointLabels,
+	)
+
+	endpointHTTPLabels := append([]string{"host", "port", "endpoint", "code", "category"}, customLabelKeys...)
+	m.monitoredEndpointsHTTPResponsesCounter = m.newCounterVec(
+		prometheus.CounterOpts{
+			Name: "squid_monitored_endpoints_http_responses_total",
+			Help: "HTTP responses per endpoint of monitored domains with path rules",
+		},
+		endpointHTTPLabels,
+	)
+
+	m.monitoredEndpointsAvgDuration = m.newGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "squid_monitored_endpoints_duration_seconds_avg",
+			Help: "Average request duration per endpoint of monitored domains",
+		},
+		endpointLabels,
+	)
+
+	m.monitoredEndpointsP50Duration = m.newGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "squid_monitored_endpoints_duration_seconds_p50",
+			Help: "50th percentile (median) request duration per endpoint of monitored domains",
+		},
+		endpointLabels,
+	)
+
+	m.monitoredEndpointsP90Duration = m.newGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "squid_monitored_endpoints_duration_seconds_p90",
+			Help: "90th percentile request duration per endpoint of monitored domains",
+		},
+		endpointLabels,
+	)
+
+	m.monitoredEndpointsP95Duration = m.newGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "squid_monitored_endpoints_duration_seconds_p95",
+			Help: "95th percentile request duration per endpoint of monitored domains",
+		},
+		endpointLabels,
+	)
+
+	m.monitoredEndpointsP99Duration = m.newGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "squid_monitored_endpoints_duration_seconds_p99",
+			Help: "99th percentile request duration per endpoint of monitored domains",
+		},
+		endpointLabels,
+	)
+}
+
+// monitoredCollectors returns the vectors created by newMonitoredMetrics
+func (m *Metrics) monitoredCollectors() []prometheus.Collector {
+	return []prometheus.Collector{
 		m.monitoredDomainsRequestsCounter,
 		m.monitoredDomainsHTTPResponsesCounter,
 		m.monitoredDomainsBytesCounter,
@@ -198,107 +662,373 @@ func NewMetrics(customLabelKeys []string) *Metrics {
 		m.monitoredDomainsP90Duration,
 		m.monitoredDomainsP95Duration,
 		m.monitoredDomainsP99Duration,
-		m.monitoredDomainsCacheHitRatio,
+		m.monitoredDomainsCacheRequestsCounter,
+		m.monitoredDomainsCacheBytesCounter,
+		m.monitoredDomainsUniqueClients,
+		m.monitoredDomainsUniqueUsers,
+		m.monitoredEndpointsRequestsCounter,
+		m.monitoredEndpointsHTTPResponsesCounter,
+		m.monitoredEndpointsAvgDuration,
+		m.monitoredEndpointsP50Duration,
+		m.monitoredEndpointsP90Duration,
+		m.monitoredEndpointsP95Duration,
+		m.monitoredEndpointsP99Duration,
+	}
+}
+
+// newGroupMetrics creates the rule group vectors, whose label set depends on
+// the rule label keys from config
+func (m *Metrics) newGroupMetrics(ruleLabelKeys []string) {
+	m.ruleLabelKeys = ruleLabelKeys
+	m.groupRegistry = prometheus.NewRegistry()
+
+	groupLabels := append([]string{"group"}, ruleLabelKeys...)
+	m.groupRequestsCounter = m.newCounterVec(
+		prometheus.CounterOpts{
+			Name: "squid_group_requests_total",
+			Help: "Total requests matched by label or group rules",
+		},
+		groupLabels,
 	)
 
-	return m
+	m.groupBytesCounter = m.newCounterVec(
+		prometheus.CounterOpts{
+			Name: "squid_group_bytes_total",
+			Help: "Bytes delivered for requests matched by label or group rules",
+		},
+		groupLabels,
+	)
+
+	groupHTTPLabels := append([]string{"group", "category"}, ruleLabelKeys...)
+	m.groupHTTPResponsesCounter = m.newCounterVec(
+		prometheus.CounterOpts{
+			Name: "squid_group_http_responses_total",
+			Help: "HTTP responses by category for requests matched by label or group rules",
+		},
+		groupHTTPLabels,
+	)
+
+	m.groupRegistry.MustRegister(m.groupRequestsCounter, m.groupBytesCounter, m.groupHTTPResponsesCounter)
 }
 
-func makeKey(labels ...string) string {
-	return strings.Join(labels, "|")
+// SetRuleLabelKeys re-creates the rule group vectors when the rule label key
+// set changes. Existing group series are dropped.
+func (m *Metrics) SetRuleLabelKeys(ruleLabelKeys []string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if strings.Join(ruleLabelKeys, "|") == strings.Join(m.ruleLabelKeys, "|") {
+		return false
+	}
+
+	m.router.forget(m.groupRequestsCounter, m.groupBytesCounter, m.groupHTTPResponsesCounter)
+	m.newGroupMetrics(ruleLabelKeys)
+	return true
+}
+
+// SetCustomLabelKeys re-creates the monitored domain vectors when the custom
+// label key set changes (e.g. after a config reload). Existing monitored
+// series are dropped since their label set no longer applies.
+func (m *Metrics) SetCustomLabelKeys(customLabelKeys []string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if strings.Join(customLabelKeys, "|") == strings.Join(m.customLabelKeys, "|") {
+		return false
+	}
+
+	m.router.forget(m.monitoredCollectors()...)
+	m.newMonitoredMetrics(customLabelKeys)
+
+	return true
+}
+
+// Gatherer returns a gatherer for all exporter metrics, including the
+// monitored domain and rule group metrics whose registries may be replaced
+// on reload
+func (m *Metrics) Gatherer() prometheus.Gatherer {
+	outputs := prometheus.NewRegistry()
+	outputs.MustRegister(m.router)
+
+	gatherer := relabelGatherer{
+		router: m.router,
+		gatherers: []prometheus.Gatherer{
+			m.gatherer,
+			prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+				m.mu.RLock()
+				registry := m.monitoredRegistry
+				m.mu.RUnlock()
+				return registry.Gather()
+			}),
+			prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+				m.mu.RLock()
+				registry := m.groupRegistry
+				m.mu.RUnlock()
+				return registry.Gather()
+			}),
+		},
+		outputs: outputs,
+	}
+
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		m.commitMu.RLock()
+		defer m.commitMu.RUnlock()
+		return gatherer.Gather()
+	})
+}
+
+// BeginCommit holds back scrapes until EndCommit, while the counts of a
+// checkpoint are added and the state to commit with its position is taken
+func (m *Metrics) BeginCommit() {
+	m.commitMu.Lock()
+}
+
+// EndCommit lets scrapes proceed after BeginCommit
+func (m *Metrics) EndCommit() {
+	m.commitMu.Unlock()
 }
 
 // Global metrics methods
-func (m *Metrics) SetConnections(count int) {
+
+// AddConnections adds the requests of one parse cycle
+func (m *Metrics) AddConnections(count int) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	key := "connections"
-	lastValue := m.lastSeen[key]
-	delta := float64(count) - lastValue
-	if delta > 0 {
-		m.connectionsTotal.Add(delta)
+	if count > 0 {
+		m.connectionsTotal.Add(float64(count))
 	}
-	m.lastSeen[key] = float64(count)
 }
 
-func (m *Metrics) SetRequestDuration(interval string, count int) {
+// AddRequestDuration adds the requests of one parse cycle in a duration interval
+func (m *Metrics) AddRequestDuration(interval string, count int) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	key := makeKey("duration", interval)
-	lastValue := m.lastSeen[key]
-	delta := float64(count) - lastValue
-	if delta > 0 {
-		m.requestDurationTotal.WithLabelValues(interval).Add(delta)
+	if count > 0 {
+		m.add(m.requestDurationTotal, float64(count), interval)
 	}
-	m.lastSeen[key] = float64(count)
 }
 
-func (m *Metrics) SetCacheStatus(status string, count int) {
+// AddCacheStatus adds the requests of one parse cycle with a cache status
+func (m *Metrics) AddCacheStatus(status string, count int) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	key := makeKey("cache", status)
-	lastValue := m.lastSeen[key]
-	delta := float64(count) - lastValue
-	if delta > 0 {
-		m.cacheStatusTotal.WithLabelValues(status).Add(delta)
+	if count > 0 {
+		m.add(m.cacheStatusTotal, float64(count), status)
 	}
-	m.lastSeen[key] = float64(count)
 }
 
-func (m *Metrics) SetHTTPResponse(code, category string, count int) {
+// AddHTTPResponse adds the responses of one parse cycle with a status code
+func (m *Metrics) AddHTTPResponse(code, category string, count int) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	key := makeKey("http", code, category)
-	lastValue := m.lastSeen[key]
-	delta := float64(count) - lastValue
-	if delta > 0 {
-		m.httpResponsesTotal.WithLabelValues(code, category).Add(delta)
+	if count > 0 {
+		m.add(m.httpResponsesTotal, float64(count), code, category)
 	}
-	m.lastSeen[key] = float64(count)
 }
 
-// UpdateAllDomains updates metrics for all domains tracking
-func (m *Metrics) UpdateAllDomains(host, port string, requests, bytesIn, bytesOut float64, responsesByCategory map[string]int) {
+// AddCacheResults adds one parse cycle of cache hits and misses to the global
+// request and byte counters
+func (m *Metrics) AddCacheResults(hits, misses int, hitBytes, missBytes float64) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	key := makeKey("all_req", host, port)
-	lastValue := m.lastSeen[key]
-	delta := requests - lastValue
-	if delta > 0 {
-		m.allDomainsRequestsCounter.WithLabelValues(host, port).Add(delta)
+	m.addCacheCounters(m.cacheRequestsTotal, m.cacheBytesTotal, nil, nil, hits, misses, hitBytes, missBytes)
+}
+
+// addCacheCounters adds per-cycle cache results to a request and a byte
+// counter vector whose labels are prefix, result, suffix
+func (m *Metrics) addCacheCounters(requests, bytes *prometheus.CounterVec, prefix, suffix []string, hits, misses int, hitBytes, missBytes float64) {
+	for _, r := range []struct {
+		result   string
+		requests int
+		bytes    float64
+	}{
+		{"hit", hits, hitBytes},
+		{"miss", misses, missBytes},
+	} {
+		if r.requests == 0 {
+			continue
+		}
+		values := append(append(append([]string{}, prefix...), r.result), suffix...)
+		m.add(requests, float64(r.requests), values...)
+		if r.bytes > 0 {
+			m.add(bytes, r.bytes, values...)
+		}
 	}
-	m.lastSeen[key] = requests
+}
 
-	keyIn := makeKey("all_bytes_in", host, port)
-	lastValueIn := m.lastSeen[keyIn]
-	deltaIn := bytesIn - lastValueIn
-	if deltaIn > 0 {
-		m.allDomainsBytesCounter.WithLabelValues(host, port, "in").Add(deltaIn)
+// UpdateAllDomains updates metrics for all domains tracking
+func (m *Metrics) UpdateAllDomains(
+	host, port string,
+	requests, bytesIn, bytesOut float64,
+	responsesByCategory map[string]int,
+	cacheHits, cacheMisses int,
+	cacheHitBytes, cacheMissBytes float64,
+) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.addCacheCounters(m.allDomainsCacheRequestsCounter, m.allDomainsCacheBytesCounter,
+		[]string{host, port}, nil, cacheHits, cacheMisses, cacheHitBytes, cacheMissBytes)
+
+	if requests > 0 {
+		m.add(m.allDomainsRequestsCounter, requests, host, port)
+	}
+	if bytesIn > 0 {
+		m.add(m.allDomainsBytesCounter, bytesIn, host, port, "in")
+	}
+	if bytesOut > 0 {
+		m.add(m.allDomainsBytesCounter, bytesOut, host, port, "out")
 	}
-	m.lastSeen[keyIn] = bytesIn
 
-	keyOut := makeKey("all_bytes_out", host, port)
-	lastValueOut := m.lastSeen[keyOut]
-	deltaOut := bytesOut - lastValueOut
-	if deltaOut > 0 {
-		m.allDomainsBytesCounter.WithLabelValues(host, port, "out").Add(deltaOut)
+	for category, count := range responsesByCategory {
+		if count > 0 {
+			m.add(m.allDomainsHTTPResponsesCounter, float64(count), host, port, category)
+		}
 	}
-	m.lastSeen[keyOut] = bytesOut
+}
+
+// UpdateSite adds one parse cycle of traffic for a registrable domain
+func (m *Metrics) UpdateSite(
+	site string,
+	requests, bytesIn, bytesOut float64,
+	responsesByCategory map[string]int,
+	cacheHits, cacheMisses int,
+	cacheHitBytes, cacheMissBytes float64,
+) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
+	if requests > 0 {
+		m.add(m.siteRequestsCounter, requests, site)
+	}
+	if bytesIn > 0 {
+		m.add(m.siteBytesCounter, bytesIn, site, "in")
+	}
+	if bytesOut > 0 {
+		m.add(m.siteBytesCounter, bytesOut, site, "out")
+	}
 	for category, count := range responsesByCategory {
-		keyCat := makeKey("all_http_cat", host, port, category)
-		lastValueCat := m.lastSeen[keyCat]
-		deltaCat := float64(count) - lastValueCat
-		if deltaCat > 0 {
-			m.allDomainsHTTPResponsesCounter.WithLabelValues(host, port, category).Add(deltaCat)
+		if count > 0 {
+			m.add(m.siteHTTPResponsesCounter, float64(count), site, category)
 		}
-		m.lastSeen[keyCat] = float64(count)
 	}
+
+	m.addCacheCounters(m.siteCacheRequestsCounter, m.siteCacheBytesCounter,
+		[]string{site}, nil, cacheHits, cacheMisses, cacheHitBytes, cacheMissBytes)
+}
+
+// SetUniqueCount sets the global distinct estimate for a dimension (clients/users/hosts)
+func (m *Metrics) SetUniqueCount(dimension, window string, value float64) {
+	switch dimension {
+	case "clients":
+		m.set(m.uniqueClients, value, window)
+	case "users":
+		m.set(m.uniqueUsers, value, window)
+	case "hosts":
+		m.set(m.uniqueHosts, value, window)
+	}
+}
+
+// SetMonitoredUniqueCount sets the distinct estimate for a dimension (clients/users) of a monitored domain
+func (m *Metrics) SetMonitoredUniqueCount(dimension, host, port string, customLabels map[string]string, window string, value float64) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	vec := m.monitoredDomainsUniqueClients
+	if dimension == "users" {
+		vec = m.monitoredDomainsUniqueUsers
+	}
+
+	labels := []string{host, port, window}
+	for _, key := range m.customLabelKeys {
+		labels = append(labels, customLabels[key])
+	}
+	m.set(vec, value, labels...)
+}
+
+// DeleteMonitoredUniqueCounts removes distinct estimates for a monitored domain with no data left
+func (m *Metrics) DeleteMonitoredUniqueCounts(host, port string) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	labels := prometheus.Labels{"host": host, "port": port}
+	m.deletePartialMatch(m.monitoredDomainsUniqueClients, labels)
+	m.deletePartialMatch(m.monitoredDomainsUniqueUsers, labels)
+}
+
+// SetTopDomains replaces the ranked top domains by requests or bytes.
+// Keys are "host:port".
+func (m *Metrics) SetTopDomains(by string, items []topk.Item) {
+	value, errorBound := m.topDomainsRequests, m.topDomainsRequestsError
+	if by == "bytes" {
+		value, errorBound = m.topDomainsBytes, m.topDomainsBytesError
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.resetVec(value)
+	m.resetVec(errorBound)
+
+	for i, item := range items {
+		host, port := item.Key, ""
+		if idx := strings.LastIndex(item.Key, ":"); idx >= 0 {
+			host, port = item.Key[:idx], item.Key[idx+1:]
+		}
+		rank := strconv.Itoa(i + 1)
+		m.set(value, item.Count, rank, host, port)
+		m.set(errorBound, item.Error, rank, host, port)
+	}
+}
+
+// SetConfigReload records the outcome of a configuration (re)load
+func (m *Metrics) SetConfigReload(success bool) {
+	if !success {
+		m.configReloadSuccess.Set(0)
+		return
+	}
+	m.configReloadSuccess.Set(1)
+	m.configReloadTimestamp.Set(float64(time.Now().Unix()))
+}
+
+// SetTrackedDomains reports the number of individually tracked domains of a kind (host/site)
+func (m *Metrics) SetTrackedDomains(kind string, count int) {
+	m.set(m.trackedDomains, float64(count), kind)
+}
+
+// DeleteDomain removes all all_domains series for host:port after eviction
+func (m *Metrics) DeleteDomain(host, port, reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	labels := prometheus.Labels{"host": host, "port": port}
+	m.deletePartialMatch(m.allDomainsRequestsCounter, labels)
+	m.deletePartialMatch(m.allDomainsHTTPResponsesCounter, labels)
+	m.deletePartialMatch(m.allDomainsBytesCounter, labels)
+	m.deletePartialMatch(m.allDomainsCacheRequestsCounter, labels)
+	m.deletePartialMatch(m.allDomainsCacheBytesCounter, labels)
+
+	m.add(m.domainsEvicted, 1, "host", reason)
+}
+
+// DeleteSite removes all squid_site_* series for a registrable domain after eviction
+func (m *Metrics) DeleteSite(site, reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	labels := prometheus.Labels{"site": site}
+	m.deletePartialMatch(m.siteRequestsCounter, labels)
+	m.deletePartialMatch(m.siteHTTPResponsesCounter, labels)
+	m.deletePartialMatch(m.siteBytesCounter, labels)
+	m.deletePartialMatch(m.siteCacheRequestsCounter, labels)
+	m.deletePartialMatch(m.siteCacheBytesCounter, labels)
+
+	m.add(m.domainsEvicted, 1, "site", reason)
 }
 
 // buildLabelValues builds label values array in correct order
@@ -318,6 +1048,7 @@ func (m *Metrics) UpdateMonitoredDomain(
 	responsesByCode map[string]map[string]int,
 	avgDuration, p50Duration, p90Duration, p95Duration, p99Duration float64,
 	cacheHits, cacheMisses int,
+	cacheHitBytes, cacheMissBytes float64,
 ) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -326,67 +1057,146 @@ func (m *Metrics) UpdateMonitoredDomain(
 	baseLabels := m.buildLabelValues(host, port, customLabels)
 
 	// Requests
-	key := makeKey("mon_req", host, port)
-	lastValue := m.lastSeen[key]
-	delta := requests - lastValue
-	if delta > 0 {
-		m.monitoredDomainsRequestsCounter.WithLabelValues(baseLabels...).Add(delta)
+	if requests > 0 {
+		m.add(m.monitoredDomainsRequestsCounter, requests, baseLabels...)
 	}
-	m.lastSeen[key] = requests
 
 	// Bytes
-	keyIn := makeKey("mon_bytes_in", host, port)
-	lastValueIn := m.lastSeen[keyIn]
-	deltaIn := bytesIn - lastValueIn
-	if deltaIn > 0 {
+	if bytesIn > 0 {
 		bytesInLabels := []string{host, port, "in"}
 		for _, key := range m.customLabelKeys {
 			bytesInLabels = append(bytesInLabels, customLabels[key])
 		}
-		m.monitoredDomainsBytesCounter.WithLabelValues(bytesInLabels...).Add(deltaIn)
+		m.add(m.monitoredDomainsBytesCounter, bytesIn, bytesInLabels...)
 	}
-	m.lastSeen[keyIn] = bytesIn
-
-	keyOut := makeKey("mon_bytes_out", host, port)
-	lastValueOut := m.lastSeen[keyOut]
-	deltaOut := bytesOut - lastValueOut
-	if deltaOut > 0 {
+	if bytesOut > 0 {
 		bytesOutLabels := []string{host, port, "out"}
 		for _, key := range m.customLabelKeys {
 			bytesOutLabels = append(bytesOutLabels, customLabels[key])
 		}
-		m.monitoredDomainsBytesCounter.WithLabelValues(bytesOutLabels...).Add(deltaOut)
+		m.add(m.monitoredDomainsBytesCounter, bytesOut, bytesOutLabels...)
 	}
-	m.lastSeen[keyOut] = bytesOut
 
 	// HTTP responses
 	for code, categories := range responsesByCode {
 		for category, count := range categories {
-			keyCode := makeKey("mon_http", host, port, code, category)
-			lastValueCode := m.lastSeen[keyCode]
-			deltaCode := float64(count) - lastValueCode
-			if deltaCode > 0 {
+			if count > 0 {
 				httpLabels := []string{host, port, code, category}
 				for _, key := range m.customLabelKeys {
 					httpLabels = append(httpLabels, customLabels[key])
 				}
-				m.monitoredDomainsHTTPResponsesCounter.WithLabelValues(httpLabels...).Add(deltaCode)
+				m.add(m.monitoredDomainsHTTPResponsesCounter, float64(count), httpLabels...)
 			}
-			m.lastSeen[keyCode] = float64(count)
 		}
 	}
 
 	// Durations (uses baseLabels - host, port, custom_labels)
-	m.monitoredDomainsAvgDuration.WithLabelValues(baseLabels...).Set(avgDuration)
-	m.monitoredDomainsP50Duration.WithLabelValues(baseLabels...).Set(p50Duration)
-	m.monitoredDomainsP90Duration.WithLabelValues(baseLabels...).Set(p90Duration)
-	m.monitoredDomainsP95Duration.WithLabelValues(baseLabels...).Set(p95Duration)
-	m.monitoredDomainsP99Duration.WithLabelValues(baseLabels...).Set(p99Duration)
-
-	// Cache hit ratio (uses baseLabels - host, port, custom_labels)
-	totalCache := cacheHits + cacheMisses
-	if totalCache > 0 {
-		ratio := float64(cacheHits) / float64(totalCache)
-		m.monitoredDomainsCacheHitRatio.WithLabelValues(baseLabels...).Set(ratio)
+	m.set(m.monitoredDomainsAvgDuration, avgDuration, baseLabels...)
+	m.set(m.monitoredDomainsP50Duration, p50Duration, baseLabels...)
+	m.set(m.monitoredDomainsP90Duration, p90Duration, baseLabels...)
+	m.set(m.monitoredDomainsP95Duration, p95Duration, baseLabels...)
+	m.set(m.monitoredDomainsP99Duration, p99Duration, baseLabels...)
+
+	// Cache results (host, port, result, custom_labels)
+	m.addCacheCounters(m.monitoredDomainsCacheRequestsCounter, m.monitoredDomainsCacheBytesCounter,
+		[]string{host, port}, baseLabels[2:], cacheHits, cacheMisses, cacheHitBytes, cacheMissBytes)
+}
+
+// UpdateMonitoredEndpoint adds one parse cycle of an endpoint of a monitored
+// domain and sets its duration gauges
+func (m *Metrics) UpdateMonitoredEndpoint(
+	host, port, endpoint string,
+	customLabels map[string]string,
+	requests float64,
+	responsesByCode map[string]map[string]int,
+	avgDuration, p50Duration, p90Duration, p95Duration, p99Duration float64,
+) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	custom := make([]string, 0, len(m.customLabelKeys))
+	for _, key := range m.customLabelKeys {
+		custom = append(custom, customLabels[key])
+	}
+	labels := append([]string{host, port, endpoint}, custom...)
+
+	if requests > 0 {
+		m.add(m.monitoredEndpointsRequestsCounter, requests, labels...)
+	}
+
+	for code, categories := range responsesByCode {
+		for category, count := range categories {
+			httpLabels := append([]string{host, port, endpoint, code, category}, custom...)
+			m.add(m.monitoredEndpointsHTTPResponsesCounter, float64(count), httpLabels...)
+		}
+	}
+
+	m.set(m.monitoredEndpointsAvgDuration, avgDuration, labels...)
+	m.set(m.monitoredEndpointsP50Duration, p50Duration, labels...)
+	m.set(m.monitoredEndpointsP90Duration, p90Duration, labels...)
+	m.set(m.monitoredEndpointsP95Duration, p95Duration, labels...)
+	m.set(m.monitoredEndpointsP99Duration, p99Duration, labels...)
+}
+
+// AddGroup adds one parse cycle of lines matched by label or group rules
+func (m *Metrics) AddGroup(group string, ruleLabels map[string]string, requests int, bytes float64, responsesByCategory map[string]int) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	custom := make([]string, 0, len(m.ruleLabelKeys))
+	for _, key := range m.ruleLabelKeys {
+		custom = append(custom, ruleLabels[key])
+	}
+	labels := append([]string{group}, custom...)
+
+	m.add(m.groupRequestsCounter, float64(requests), labels...)
+	if bytes > 0 {
+		m.add(m.groupBytesCounter, bytes, labels...)
+	}
+	for category, count := range responsesByCategory {
+		httpLabels := append([]string{group, category}, custom...)
+		m.add(m.groupHTTPResponsesCounter, float64(count), httpLabels...)
 	}
 }
+
+// AddDroppedLines counts lines dropped by a rule in one parse cycle
+func (m *Metrics) AddDroppedLines(rule string, count int) {
+	m.add(m.droppedLinesCounter, float64(count), rule)
+}
+
+// AddLinesRead counts the lines and bytes read and the lines parsed in one parse cycle
+func (m *Metrics) AddLinesRead(read, parsed int, bytes int64) {
+	m.linesRead.Add(float64(read))
+	m.linesParsed.Add(float64(parsed))
+	m.bytesRead.Add(float64(bytes))
+}
+
+// AddRejectedLines counts lines rejected for a reason in one parse cycle
+func (m *Metrics) AddRejectedLines(reason string, count int) {
+	m.add(m.linesRejected, float64(count), reason)
+}
+
+// ObserveParseCycle records the duration and outcome of a parse cycle
+func (m *Metrics) ObserveParseCycle(duration time.Duration, err error) {
+	m.parseDuration.Observe(duration.Seconds())
+	if err != nil {
+		m.parseFailures.Inc()
+	}
+}
+
+// SetLogFilePosition reports the read offset against the log file size
+func (m *Metrics) SetLogFilePosition(offset, size int64) {
+	m.logFileOffset.Set(float64(offset))
+	m.logFileSize.Set(float64(size))
+	m.logFileLag.Set(float64(size - offset))
+}
+
+// AddLogRotation counts a detected log rotation
+func (m *Metrics) AddLogRotation() {
+	m.logRotations.Inc()
+}
+
+// AddPositionSaveFailure counts a failed position save
+func (m *Metrics) AddPositionSaveFailure() {
+	m.positionSaveFailures.Inc()
+}
@@ -0,0 +1,882 @@
+package metrics
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+
+	"squid-log-exporter/internal/relabel"
+)
+
+// seriesKind is the type of a metric family, as far as relabeling cares
+type seriesKind int
+
+const (
+	counterKind seriesKind = iota
+	gaugeKind
+	histogramKind
+)
+
+// family is a metric family written by the exporter or created by
+// relabeling. Plain metrics without labels have no vector; their series are
+// relabeled when gathered.
+type family struct {
+	name     string
+	help     string
+	kind     seriesKind
+	labels   []string
+	identity []int // positions of the host, port and site labels
+	vec      prometheus.Collector
+}
+
+// target is a relabeled series and the number of series written to it
+type target struct {
+	key    string
+	family *family
+	values []string
+	refs   int
+	owner  string // the only series a gauge is written from
+}
+
+// source is a series as written by the exporter and the relabeled series it
+// is written to. Series that relabeling drops have no source.
+type source struct {
+	key        string
+	values     []string
+	generation int
+	target     *target
+}
+
+// router applies relabel_configs when series are written, so dropped series
+// are never created and series that collide share one counter. Series that
+// keep their name and label names are written to the exporter's vector;
+// others go to vectors created on first use.
+type router struct {
+	mu         sync.Mutex
+	configs    []relabel.Config
+	generation int
+
+	families map[prometheus.Collector]*family
+	byName   map[string]*family
+	outputs  map[string]*family // by name and label names
+	targets  map[string]*target
+	sources  map[prometheus.Collector]map[string]map[string]*source // by vector, identity and label values
+	warned   map[string]bool
+}
+
+func newRouter() *router {
+	return &router{
+		families: make(map[prometheus.Collector]*family),
+		byName:   make(map[string]*family),
+		outputs:  make(map[string]*family),
+		targets:  make(map[string]*target),
+		sources:  make(map[prometheus.Collector]map[string]map[string]*source),
+		warned:   make(map[string]bool),
+	}
+}
+
+// register records a family written by the exporter; vec is nil for plain
+// metrics. A family registered again under the same name replaces the old one.
+func (r *router) register(vec prometheus.Collector, name, help string, kind seriesKind, labels []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	f := &family{name: name, help: help, kind: kind, labels: labels, vec: vec}
+	for i, label := range labels {
+		if label == "host" || label == "port" || label == "site" {
+			f.identity = append(f.identity, i)
+		}
+	}
+	if vec != nil {
+		r.families[vec] = f
+	}
+	r.byName[name] = f
+}
+
+// setConfigs replaces the relabel configs and routes the series written so
+// far again: relabeled series the new configs no longer produce are deleted,
+// while series relabeled to the same series keep their value. Relabeled
+// series restored from the state but not written since are deleted as well.
+func (r *router) setConfigs(configs []relabel.Config) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Without configs series are written as they are, without a source
+	if len(r.configs) == 0 {
+		r.adopt()
+	}
+
+	r.configs = configs
+	r.generation++
+	r.warned = make(map[string]bool)
+
+	for vec, byIdentity := range r.sources {
+		f := r.families[vec]
+		for identity, byValues := range byIdentity {
+			for valuesKey, src := range byValues {
+				r.reroute(f, src)
+				if src.target == nil {
+					delete(byValues, valuesKey)
+				}
+			}
+			if len(byValues) == 0 {
+				delete(byIdentity, identity)
+			}
+		}
+	}
+
+	if len(configs) == 0 {
+		// Every series now writes to itself, and keeps doing so unrouted
+		r.sources = make(map[prometheus.Collector]map[string]map[string]*source)
+		r.targets = make(map[string]*target)
+	}
+	r.pruneOutputs()
+}
+
+// adopt creates sources for the series written to the exporter's vectors
+// while no configs were set. The caller must hold r.mu.
+func (r *router) adopt() {
+	for vec, f := range r.families {
+		for _, values := range collectLabelValues(vec, f.labels) {
+			src := &source{key: f.name + "\xff" + strings.Join(values, "\xff"), values: values, generation: r.generation}
+			key := f.name + "{" + strings.Join(f.labels, ",") + "}" + strings.Join(values, "\xff")
+			src.target = &target{key: key, family: f, values: values, refs: 1}
+			if f.kind == gaugeKind {
+				src.target.owner = src.key
+			}
+			r.targets[key] = src.target
+			r.store(vec, f, src)
+		}
+	}
+}
+
+// pruneOutputs deletes the output vectors and series that no series is
+// written to. The caller must hold r.mu.
+func (r *router) pruneOutputs() {
+	used := make(map[*family]bool)
+	for _, t := range r.targets {
+		used[t.family] = true
+	}
+
+	for key, output := range r.outputs {
+		if !used[output] {
+			delete(r.outputs, key)
+			continue
+		}
+		for _, values := range collectLabelValues(output.vec, output.labels) {
+			if r.targets[key+strings.Join(values, "\xff")] == nil {
+				deleteSeries(output.vec, values)
+			}
+		}
+	}
+}
+
+func (r *router) currentConfigs() []relabel.Config {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.configs
+}
+
+// relabeled reports whether the series of a family are relabeled when
+// written rather than when gathered
+func (r *router) relabeled(name string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f := r.byName[name]
+	return f != nil && f.vec != nil
+}
+
+// route returns the vector and label values a series of vec is written to,
+// or a nil vector if relabeling drops it
+func (r *router) route(vec prometheus.Collector, values []string) (prometheus.Collector, []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	f := r.families[vec]
+	if len(r.configs) == 0 || f == nil {
+		return vec, values
+	}
+
+	valuesKey := strings.Join(values, "\xff")
+	src := r.sources[vec][f.identityKey(values)][valuesKey]
+	switch {
+	case src == nil:
+		src = &source{key: f.name + "\xff" + valuesKey, values: append([]string(nil), values...)}
+		r.reroute(f, src)
+		if src.target == nil {
+			// Dropped series are not remembered but relabeled on every write
+			return nil, nil
+		}
+		r.store(vec, f, src)
+	case src.generation != r.generation:
+		r.reroute(f, src)
+		if src.target == nil {
+			delete(r.sources[vec][f.identityKey(values)], valuesKey)
+			return nil, nil
+		}
+	}
+	return src.target.family.vec, src.target.values
+}
+
+// store adds src to the sources of vec. The caller must hold r.mu.
+func (r *router) store(vec prometheus.Collector, f *family, src *source) {
+	byIdentity := r.sources[vec]
+	if byIdentity == nil {
+		byIdentity = make(map[string]map[string]*source)
+		r.sources[vec] = byIdentity
+	}
+	identity := f.identityKey(src.values)
+	byValues := byIdentity[identity]
+	if byValues == nil {
+		byValues = make(map[string]*source)
+		byIdentity[identity] = byValues
+	}
+	byValues[strings.Join(src.values, "\xff")] = src
+}
+
+// reroute relabels src under the current configs and releases the series
+// it was written to before, if that changed. The caller must hold r.mu.
+func (r *router) reroute(f *family, src *source) {
+	src.generation = r.generation
+	current := r.resolve(f, src.values, src.key)
+	if current == src.target {
+		return
+	}
+	if current != nil {
+		current.refs++
+	}
+	r.release(src)
+	src.target = current
+}
+
+// resolve relabels a series and returns the series it is written to, or nil
+// if it is dropped or would overwrite a gauge written from another series
+func (r *router) resolve(f *family, values []string, sourceKey string) *target {
+	labels := make([]relabel.Label, 0, len(values)+1)
+	labels = append(labels, relabel.Label{Name: "__name__", Value: f.name})
+	for i, name := range f.labels {
+		labels = append(labels, relabel.Label{Name: name, Value: values[i]})
+	}
+
+	labels, keep := relabel.Process(labels, r.configs)
+	if !keep {
+		return nil
+	}
+
+	name := ""
+	set := make(map[string]string, len(labels))
+	names := make([]string, 0, len(labels))
+	for _, label := range labels {
+		switch {
+		case label.Name == "__name__":
+			name = label.Value
+		case strings.HasPrefix(label.Name, "__"):
+			// Internal labels are removed after relabeling
+		default:
+			set[label.Name] = label.Value
+			names = append(names, label.Name)
+		}
+	}
+	if name == "" {
+		return nil
+	}
+
+	dst := r.family(f, name, names)
+	if dst == nil {
+		return nil
+	}
+
+	dstValues := make([]string, len(dst.labels))
+	for i, label := range dst.labels {
+		dstValues[i] = set[label]
+	}
+	key := dst.name + "{" + strings.Join(dst.labels, ",") + "}" + strings.Join(dstValues, "\xff")
+
+	t := r.targets[key]
+	switch {
+	case t == nil:
+		t = &target{key: key, family: dst, values: dstValues}
+		if dst.kind == gaugeKind {
+			t.owner = sourceKey
+		}
+		r.targets[key] = t
+	case t.owner != "" && t.owner != sourceKey:
+		r.warnOnce("gauge "+key, "relabel_configs map %s and other series to the same gauge series %s; keeping the first", f.name, name)
+		return nil
+	}
+	return t
+}
+
+// family returns the family a relabeled series of f named name with the
+// given label names is written to, creating it if needed. It returns nil
+// if the name is already used by a family of another type.
+func (r *router) family(f *family, name string, names []string) *family {
+	if existing := r.byName[name]; existing != nil {
+		if existing.kind != f.kind {
+			r.warnOnce("type "+name, "relabel_configs rename %s to %s, which has another type; dropping its series", f.name, name)
+			return nil
+		}
+		if existing.vec != nil && sameLabels(existing.labels, names) {
+			return existing
+		}
+	}
+
+	key := name + "{" + strings.Join(names, ",") + "}"
+	if output := r.outputs[key]; output != nil {
+		return output
+	}
+
+	help := f.help
+	if existing := r.byName[name]; existing != nil {
+		help = existing.help
+	}
+	for _, output := range r.outputs {
+		if output.name != name {
+			continue
+		}
+		if output.kind != f.kind {
+			r.warnOnce("type "+name, "relabel_configs rename %s to %s, which has another type; dropping its series", f.name, name)
+			return nil
+		}
+		help = output.help
+		break
+	}
+
+	return r.newOutput(name, help, f.kind, names)
+}
+
+// newOutput creates a vector for series renamed or relabeled to another
+// label set. The caller must hold r.mu.
+func (r *router) newOutput(name, help string, kind seriesKind, names []string) *family {
+	output := &family{name: name, help: help, kind: kind, labels: names}
+	if kind == gaugeKind {
+		output.vec = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name, Help: help}, names)
+	} else {
+		output.vec = prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: help}, names)
+	}
+	r.outputs[name+"{"+strings.Join(names, ",")+"}"] = output
+	return output
+}
+
+// restoreOutput returns a counter of an output family for a saved series,
+// creating the family if needed. The caller must hold r.mu.
+func (r *router) restoreOutput(name, help string, labels map[string]string) prometheus.Counter {
+	names := make([]string, 0, len(labels))
+	for label := range labels {
+		names = append(names, label)
+	}
+	sort.Strings(names)
+
+	output := r.outputs[name+"{"+strings.Join(names, ",")+"}"]
+	if output == nil {
+		if existing := r.byName[name]; existing != nil {
+			if existing.kind != counterKind {
+				return nil
+			}
+			help = existing.help
+		}
+		for _, other := range r.outputs {
+			if other.name == name {
+				if other.kind != counterKind {
+					return nil
+				}
+				help = other.help
+				break
+			}
+		}
+		output = r.newOutput(name, help, counterKind, names)
+	}
+
+	vec, ok := output.vec.(*prometheus.CounterVec)
+	if !ok {
+		return nil
+	}
+	counter, err := vec.GetMetricWith(labels)
+	if err != nil {
+		return nil
+	}
+	return counter
+}
+
+// forget drops the series written from vecs, e.g. before they are re-created
+// with other label names, and deletes relabeled series nothing else writes to
+func (r *router) forget(vecs ...prometheus.Collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	removed := make(map[prometheus.Collector]bool, len(vecs))
+	for _, vec := range vecs {
+		removed[vec] = true
+		for _, byValues := range r.sources[vec] {
+			for _, src := range byValues {
+				r.release(src)
+			}
+		}
+		delete(r.sources, vec)
+		delete(r.families, vec)
+	}
+	for key, t := range r.targets {
+		if removed[t.family.vec] {
+			delete(r.targets, key)
+		}
+	}
+	r.generation++
+}
+
+// delete removes the relabeled series written from the series of vec that
+// match labels, which must be its host and port or site labels. It reports
+// whether any such series was written while relabeling was active.
+func (r *router) delete(vec prometheus.Collector, labels prometheus.Labels) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	f := r.families[vec]
+	if f == nil {
+		return false
+	}
+	values := make([]string, len(f.labels))
+	for i, name := range f.labels {
+		values[i] = labels[name]
+	}
+	identity := f.identityKey(values)
+
+	byValues := r.sources[vec][identity]
+	if byValues == nil {
+		return false
+	}
+	for _, src := range byValues {
+		r.release(src)
+	}
+	delete(r.sources[vec], identity)
+	return true
+}
+
+// reset removes the relabeled series written from vec
+func (r *router) reset(vec prometheus.Collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, byValues := range r.sources[vec] {
+		for _, src := range byValues {
+			r.release(src)
+		}
+	}
+	delete(r.sources, vec)
+}
+
+// release drops the reference of src to its relabeled series, deleting it
+// if no other series writes to it. The caller must hold r.mu.
+func (r *router) release(src *source) {
+	t := src.target
+	src.target = nil
+	if t == nil {
+		return
+	}
+	t.refs--
+	if t.refs > 0 {
+		return
+	}
+	if r.targets[t.key] == t {
+		delete(r.targets, t.key)
+	}
+	deleteSeries(t.family.vec, t.values)
+}
+
+// deleteSeries deletes a series of a counter or gauge vector
+func deleteSeries(vec prometheus.Collector, values []string) {
+	switch vec := vec.(type) {
+	case *prometheus.CounterVec:
+		vec.DeleteLabelValues(values...)
+	case *prometheus.GaugeVec:
+		vec.DeleteLabelValues(values...)
+	}
+}
+
+// collectLabelValues returns the label values of the series of a vector, in
+// the order of labels
+func collectLabelValues(vec prometheus.Collector, labels []string) [][]string {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		vec.Collect(ch)
+		close(ch)
+	}()
+
+	var series [][]string
+	for metric := range ch {
+		var out dto.Metric
+		if err := metric.Write(&out); err != nil {
+			continue
+		}
+		set := make(map[string]string, len(out.Label))
+		for _, pair := range out.Label {
+			set[pair.GetName()] = pair.GetValue()
+		}
+		values := make([]string, len(labels))
+		for i, label := range labels {
+			values[i] = set[label]
+		}
+		series = append(series, values)
+	}
+	return series
+}
+
+// identityKey returns the host, port and site values of a series
+func (f *family) identityKey(values []string) string {
+	parts := make([]string, len(f.identity))
+	for i, position := range f.identity {
+		parts[i] = values[position]
+	}
+	return strings.Join(parts, "\xff")
+}
+
+// warnOnce logs a relabeling conflict once per config. The caller must hold r.mu.
+func (r *router) warnOnce(key, format string, args ...any) {
+	if r.warned[key] {
+		return
+	}
+	r.warned[key] = true
+	log.Printf("Warning: "+format, args...)
+}
+
+func sameLabels(labels, names []string) bool {
+	if len(labels) != len(names) {
+		return false
+	}
+	for _, name := range names {
+		found := false
+		for _, label := range labels {
+			if label == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Describe sends nothing: the output vectors are created on first write and
+// collected unchecked
+func (r *router) Describe(chan<- *prometheus.Desc) {}
+
+// Collect collects the vectors created for relabeled series
+func (r *router) Collect(ch chan<- prometheus.Metric) {
+	r.mu.Lock()
+	vecs := make([]prometheus.Collector, 0, len(r.outputs))
+	for _, output := range r.outputs {
+		vecs = append(vecs, output.vec)
+	}
+	r.mu.Unlock()
+
+	for _, vec := range vecs {
+		vec.Collect(ch)
+	}
+}
+
+// outputCounters returns the counter series of the output vectors with the
+// help of their family
+func (r *router) outputCounters() []CounterValue {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var values []CounterValue
+	for _, output := range r.outputs {
+		if output.kind != counterKind {
+			continue
+		}
+		for _, value := range collectCounters(output.name, output.vec) {
+			value.Help = output.help
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// SetRelabelConfigs replaces the relabeling steps applied to every exposed
+// series. The configs must already be compiled.
+func (m *Metrics) SetRelabelConfigs(configs []relabel.Config) {
+	m.router.setConfigs(configs)
+}
+
+// newCounterVec creates a counter vector whose series are relabeled when written
+func (m *Metrics) newCounterVec(opts prometheus.CounterOpts, labels []string) *prometheus.CounterVec {
+	vec := prometheus.NewCounterVec(opts, labels)
+	m.router.register(vec, opts.Name, opts.Help, counterKind, labels)
+	return vec
+}
+
+// newGaugeVec creates a gauge vector whose series are relabeled when written
+func (m *Metrics) newGaugeVec(opts prometheus.GaugeOpts, labels []string) *prometheus.GaugeVec {
+	vec := prometheus.NewGaugeVec(opts, labels)
+	m.router.register(vec, opts.Name, opts.Help, gaugeKind, labels)
+	return vec
+}
+
+// newCounter creates a counter, relabeled when gathered
+func (m *Metrics) newCounter(opts prometheus.CounterOpts) prometheus.Counter {
+	m.router.register(nil, opts.Name, opts.Help, counterKind, nil)
+	return prometheus.NewCounter(opts)
+}
+
+// newGauge creates a gauge, relabeled when gathered
+func (m *Metrics) newGauge(opts prometheus.GaugeOpts) prometheus.Gauge {
+	m.router.register(nil, opts.Name, opts.Help, gaugeKind, nil)
+	return prometheus.NewGauge(opts)
+}
+
+// newHistogram creates a histogram, relabeled when gathered
+func (m *Metrics) newHistogram(opts prometheus.HistogramOpts) prometheus.Histogram {
+	m.router.register(nil, opts.Name, opts.Help, histogramKind, nil)
+	return prometheus.NewHistogram(opts)
+}
+
+// add adds value to the relabeled series of vec with the given label values
+func (m *Metrics) add(vec *prometheus.CounterVec, value float64, values ...string) {
+	if dst, dstValues := m.router.route(vec, values); dst != nil {
+		dst.(*prometheus.CounterVec).WithLabelValues(dstValues...).Add(value)
+	}
+}
+
+// set sets the relabeled series of vec with the given label values
+func (m *Metrics) set(vec *prometheus.GaugeVec, value float64, values ...string) {
+	if dst, dstValues := m.router.route(vec, values); dst != nil {
+		dst.(*prometheus.GaugeVec).WithLabelValues(dstValues...).Set(value)
+	}
+}
+
+// deletePartialMatch removes the series of vec matching labels, which must
+// be its host and port or site labels, and the relabeled series written
+// from them
+func (m *Metrics) deletePartialMatch(vec interface {
+	prometheus.Collector
+	DeletePartialMatch(prometheus.Labels) int
+}, labels prometheus.Labels) {
+	if !m.router.delete(vec, labels) || len(m.router.currentConfigs()) == 0 {
+		vec.DeletePartialMatch(labels)
+	}
+}
+
+// resetVec removes all series of vec and the relabeled series written from them
+func (m *Metrics) resetVec(vec *prometheus.GaugeVec) {
+	m.router.reset(vec)
+	vec.Reset()
+}
+
+// relabelGatherer applies relabel_configs to the plain metrics of its
+// gatherers, whose series are not relabeled when written, and merges the
+// families of all gatherers. Counter and histogram series that end up with
+// the same name and labels are merged by adding their values; of gauges,
+// only the first is kept.
+type relabelGatherer struct {
+	router    *router
+	gatherers []prometheus.Gatherer
+	outputs   prometheus.Gatherer
+}
+
+func (g relabelGatherer) Gather() ([]*dto.MetricFamily, error) {
+	configs := g.router.currentConfigs()
+	g.router.mu.Lock()
+	noOutputs := len(g.router.outputs) == 0
+	g.router.mu.Unlock()
+	if len(configs) == 0 && noOutputs {
+		return prometheus.Gatherers(g.gatherers).Gather()
+	}
+
+	merged := newFamilyMerger(g.router)
+	var errs prometheus.MultiError
+	for _, gatherer := range g.gatherers {
+		families, err := gatherer.Gather()
+		errs.Append(err)
+		for _, family := range families {
+			if len(configs) == 0 || g.router.relabeled(family.GetName()) {
+				for _, metric := range family.Metric {
+					merged.add(family, family.GetName(), metric, metric.Label)
+				}
+				continue
+			}
+			for _, metric := range family.Metric {
+				name, pairs, keep := relabelMetric(family.GetName(), metric, configs)
+				if keep {
+					merged.add(family, name, metric, pairs)
+				}
+			}
+		}
+	}
+
+	families, err := g.outputs.Gather()
+	errs.Append(err)
+	for _, family := range families {
+		for _, metric := range family.Metric {
+			merged.add(family, family.GetName(), metric, metric.Label)
+		}
+	}
+
+	return merged.families(), errs.MaybeUnwrap()
+}
+
+// relabelMetric applies configs to a gathered series
+func relabelMetric(name string, metric *dto.Metric, configs []relabel.Config) (string, []*dto.LabelPair, bool) {
+	labels := []relabel.Label{{Name: "__name__", Value: name}}
+	for _, pair := range metric.Label {
+		labels = append(labels, relabel.Label{Name: pair.GetName(), Value: pair.GetValue()})
+	}
+
+	labels, keep := relabel.Process(labels, configs)
+	if !keep {
+		return "", nil, false
+	}
+
+	name = ""
+	pairs := make([]*dto.LabelPair, 0, len(labels))
+	for _, label := range labels {
+		switch {
+		case label.Name == "__name__":
+			name = label.Value
+		case strings.HasPrefix(label.Name, "__"):
+			// Internal labels are removed after relabeling
+		default:
+			pairs = append(pairs, &dto.LabelPair{Name: proto.String(label.Name), Value: proto.String(label.Value)})
+		}
+	}
+	return name, pairs, name != ""
+}
+
+// familyMerger combines gathered series into families by name
+type familyMerger struct {
+	router *router
+	byName map[string]*dto.MetricFamily
+	seen   map[string]*dto.Metric
+}
+
+func newFamilyMerger(r *router) *familyMerger {
+	return &familyMerger{
+		router: r,
+		byName: make(map[string]*dto.MetricFamily),
+		seen:   make(map[string]*dto.Metric),
+	}
+}
+
+func (f *familyMerger) add(family *dto.MetricFamily, name string, metric *dto.Metric, pairs []*dto.LabelPair) {
+	target := f.byName[name]
+	if target == nil {
+		target = &dto.MetricFamily{Name: proto.String(name), Help: family.Help, Type: family.Type}
+		f.byName[name] = target
+	} else if target.GetType() != family.GetType() {
+		// Relabeling merged families of different types; keep the first
+		return
+	}
+
+	pairs = append([]*dto.LabelPair(nil), pairs...)
+	sort.Slice(pairs, func(i, j int) bool {
+		return pairs[i].GetName() < pairs[j].GetName()
+	})
+
+	key := seriesKey(name, pairs)
+	if existing := f.seen[key]; existing != nil {
+		if !mergeMetric(existing, metric) {
+			f.router.mu.Lock()
+			f.router.warnOnce("merge "+key, "relabel_configs map several series to %s, which cannot be merged; keeping the first", key)
+			f.router.mu.Unlock()
+		}
+		return
+	}
+
+	relabeled := proto.Clone(metric).(*dto.Metric)
+	relabeled.Label = pairs
+	f.seen[key] = relabeled
+	target.Metric = append(target.Metric, relabeled)
+}
+
+func (f *familyMerger) families() []*dto.MetricFamily {
+	result := make([]*dto.MetricFamily, 0, len(f.byName))
+	for _, family := range f.byName {
+		sort.Slice(family.Metric, func(i, j int) bool {
+			return labelsString(family.Metric[i].Label) < labelsString(family.Metric[j].Label)
+		})
+		result = append(result, family)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].GetName() < result[j].GetName()
+	})
+	return result
+}
+
+func seriesKey(name string, pairs []*dto.LabelPair) string {
+	return name + "{" + labelsString(pairs) + "}"
+}
+
+func labelsString(pairs []*dto.LabelPair) string {
+	parts := make([]string, len(pairs))
+	for i, pair := range pairs {
+		parts[i] = pair.GetName() + "=" + pair.GetValue()
+	}
+	return strings.Join(parts, "\xff")
+}
+
+// mergeMetric adds the value of src into dst and reports whether it could.
+// Gauges are not merged, since the sum of two gauges is rarely meaningful.
+// Summary quantiles cannot be merged and are dropped.
+func mergeMetric(dst, src *dto.Metric) bool {
+	switch {
+	case dst.Counter != nil && src.Counter != nil:
+		dst.Counter.Value = proto.Float64(dst.Counter.GetValue() + src.Counter.GetValue())
+	case dst.Untyped != nil && src.Untyped != nil:
+		dst.Untyped.Value = proto.Float64(dst.Untyped.GetValue() + src.Untyped.GetValue())
+	case dst.Summary != nil && src.Summary != nil:
+		dst.Summary.SampleCount = proto.Uint64(dst.Summary.GetSampleCount() + src.Summary.GetSampleCount())
+		dst.Summary.SampleSum = proto.Float64(dst.Summary.GetSampleSum() + src.Summary.GetSampleSum())
+		dst.Summary.Quantile = nil
+	case dst.Histogram != nil && src.Histogram != nil:
+		dst.Histogram.SampleCount = proto.Uint64(dst.Histogram.GetSampleCount() + src.Histogram.GetSampleCount())
+		dst.Histogram.SampleSum = proto.Float64(dst.Histogram.GetSampleSum() + src.Histogram.GetSampleSum())
+		dst.Histogram.Bucket = mergeBuckets(dst.Histogram.Bucket, src.Histogram.Bucket)
+	default:
+		return false
+	}
+	return true
+}
+
+// mergeBuckets returns the union of two sets of cumulative buckets. At each
+// upper bound, a histogram without that bucket contributes the count of its
+// next lower bucket, which is all it is known to hold below the bound.
+func mergeBuckets(a, b []*dto.Bucket) []*dto.Bucket {
+	bounds := make([]float64, 0, len(a)+len(b))
+	seen := make(map[float64]bool, len(a)+len(b))
+	for _, buckets := range [][]*dto.Bucket{a, b} {
+		for _, bucket := range buckets {
+			if !seen[bucket.GetUpperBound()] {
+				seen[bucket.GetUpperBound()] = true
+				bounds = append(bounds, bucket.GetUpperBound())
+			}
+		}
+	}
+	sort.Float64s(bounds)
+
+	merged := make([]*dto.Bucket, len(bounds))
+	for i, bound := range bounds {
+		merged[i] = &dto.Bucket{
+			UpperBound:      proto.Float64(bound),
+			CumulativeCount: proto.Uint64(cumulativeCount(a, bound) + cumulativeCount(b, bound)),
+		}
+	}
+	return merged
+}
+
+// cumulativeCount returns the count of the highest bucket at or below bound
+func cumulativeCount(buckets []*dto.Bucket, bound float64) uint64 {
+	var count uint64
+	for _, bucket := range buckets {
+		if bucket.GetUpperBound() > bound {
+			break
+		}
+		count = bucket.GetCumulativeCount()
+	}
+	return count
+}
@@ -0,0 +1,227 @@
+package metrics
+
+import (
+	"strconv"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+
+	"squid-log-exporter/internal/relabel"
+)
+
+// newRelabeledMetrics returns isolated metrics with compiled relabel configs
+func newRelabeledMetrics(t *testing.T, configs ...relabel.Config) *Metrics {
+	t.Helper()
+
+	for i := range configs {
+		if err := configs[i].Compile(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m := NewIsolatedMetrics(nil)
+	m.SetRelabelConfigs(configs)
+	return m
+}
+
+// gather returns the exposed series of a family by their label string
+func gather(t *testing.T, m *Metrics, name string) map[string]*dto.Metric {
+	t.Helper()
+
+	families, err := m.Gatherer().Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	series := make(map[string]*dto.Metric)
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.Metric {
+			series[labelsString(metric.Label)] = metric
+		}
+	}
+	return series
+}
+
+func TestRelabelDropsSeriesBeforeTheyAreCreated(t *testing.T) {
+	m := newRelabeledMetrics(t, relabel.Config{
+		SourceLabels: []string{"host"},
+		Regex:        "noisy\\..*",
+		Action:       relabel.Drop,
+	})
+
+	m.UpdateAllDomains("noisy.example.com", "443", 5, 0, 100, nil, 0, 0, 0, 0)
+	m.UpdateAllDomains("api.example.com", "443", 2, 0, 10, nil, 0, 0, 0, 0)
+
+	if n := len(collectCounters("", m.allDomainsRequestsCounter)); n != 1 {
+		t.Fatalf("squid_all_domains_requests_total has %d series, want 1", n)
+	}
+	series := gather(t, m, "squid_all_domains_requests_total")
+	if len(series) != 1 || series["host=api.example.com\xffport=443"] == nil {
+		t.Fatalf("exposed series = %v", series)
+	}
+}
+
+func TestRelabelAddsCollidingCounters(t *testing.T) {
+	m := newRelabeledMetrics(t, relabel.Config{Regex: "port", Action: relabel.LabelDrop})
+
+	m.UpdateAllDomains("api.example.com", "80", 2, 0, 0, nil, 0, 0, 0, 0)
+	m.UpdateAllDomains("api.example.com", "443", 3, 0, 0, nil, 0, 0, 0, 0)
+	m.UpdateAllDomains("api.example.com", "443", 1, 0, 0, nil, 0, 0, 0, 0)
+
+	series := gather(t, m, "squid_all_domains_requests_total")
+	metric := series["host=api.example.com"]
+	if len(series) != 1 || metric.GetCounter().GetValue() != 6 {
+		t.Fatalf("exposed series = %v, want one series of 6", series)
+	}
+
+	// The merged series stays until every series written to it expired
+	m.DeleteDomain("api.example.com", "80", "ttl")
+	if series := gather(t, m, "squid_all_domains_requests_total"); len(series) != 1 {
+		t.Fatalf("series deleted while api.example.com:443 still writes to it")
+	}
+	m.DeleteDomain("api.example.com", "443", "ttl")
+	if series := gather(t, m, "squid_all_domains_requests_total"); len(series) != 0 {
+		t.Fatalf("exposed series = %v after both sources expired", series)
+	}
+}
+
+func TestRelabelKeepsFirstOfCollidingGauges(t *testing.T) {
+	m := newRelabeledMetrics(t, relabel.Config{Regex: "window", Action: relabel.LabelDrop})
+
+	m.SetUniqueCount("clients", "1h", 10)
+	m.SetUniqueCount("clients", "24h", 50)
+	m.SetUniqueCount("clients", "1h", 12)
+
+	series := gather(t, m, "squid_unique_clients")
+	if len(series) != 1 || series[""].GetGauge().GetValue() != 12 {
+		t.Fatalf("exposed series = %v, want only the 1h window", series)
+	}
+}
+
+func TestRelabelRenamedSeriesAreRestored(t *testing.T) {
+	rename := relabel.Config{
+		SourceLabels: []string{"__name__"},
+		Regex:        "squid_site_requests_total",
+		TargetLabel:  "__name__",
+		Replacement:  proto.String("squid_registrable_domain_requests_total"),
+	}
+	m := newRelabeledMetrics(t, rename)
+	m.UpdateSite("example.com", 4, 0, 0, nil, 0, 0, 0, 0)
+
+	restored := newRelabeledMetrics(t, rename)
+	if skipped := restored.RestoreCounters(m.Counters()); skipped != 0 {
+		t.Fatalf("%d series skipped", skipped)
+	}
+	restored.UpdateSite("example.com", 1, 0, 0, nil, 0, 0, 0, 0)
+
+	series := gather(t, restored, "squid_registrable_domain_requests_total")
+	if series["site=example.com"].GetCounter().GetValue() != 5 {
+		t.Fatalf("exposed series = %v, want 5", series)
+	}
+	if len(gather(t, restored, "squid_site_requests_total")) != 0 {
+		t.Fatal("renamed series also exposed under the old name")
+	}
+}
+
+func TestMergeMetricRefusesGauges(t *testing.T) {
+	dst := &dto.Metric{Gauge: &dto.Gauge{Value: proto.Float64(1)}}
+	if mergeMetric(dst, &dto.Metric{Gauge: &dto.Gauge{Value: proto.Float64(2)}}) {
+		t.Fatal("gauges merged")
+	}
+	if dst.Gauge.GetValue() != 1 {
+		t.Fatalf("gauge = %v, want 1", dst.Gauge.GetValue())
+	}
+}
+
+func TestMergeMetricHistogramBucketUnion(t *testing.T) {
+	bucket := func(bound float64, count uint64) *dto.Bucket {
+		return &dto.Bucket{UpperBound: proto.Float64(bound), CumulativeCount: proto.Uint64(count)}
+	}
+	dst := &dto.Metric{Histogram: &dto.Histogram{
+		SampleCount: proto.Uint64(4),
+		Bucket:      []*dto.Bucket{bucket(1, 1), bucket(4, 4)},
+	}}
+	src := &dto.Metric{Histogram: &dto.Histogram{
+		SampleCount: proto.Uint64(3),
+		Bucket:      []*dto.Bucket{bucket(2, 2), bucket(4, 3)},
+	}}
+
+	if !mergeMetric(dst, src) {
+		t.Fatal("histograms not merged")
+	}
+	want := map[float64]uint64{1: 1, 2: 3, 4: 7}
+	if len(dst.Histogram.Bucket) != len(want) {
+		t.Fatalf("%d buckets, want %d", len(dst.Histogram.Bucket), len(want))
+	}
+	for _, b := range dst.Histogram.Bucket {
+		if want[b.GetUpperBound()] != b.GetCumulativeCount() {
+			t.Errorf("bucket le=%v = %d, want %d", b.GetUpperBound(), b.GetCumulativeCount(), want[b.GetUpperBound()])
+		}
+	}
+	if dst.Histogram.GetSampleCount() != 7 {
+		t.Errorf("sample count = %d, want 7", dst.Histogram.GetSampleCount())
+	}
+}
+
+func TestRelabelDroppedSeriesAreNotRemembered(t *testing.T) {
+	m := newRelabeledMetrics(t, relabel.Config{
+		SourceLabels: []string{"host"},
+		Regex:        "noisy\\..*",
+		Action:       relabel.Drop,
+	})
+
+	for i := 0; i < 3; i++ {
+		m.UpdateAllDomains("noisy.example.com", strconv.Itoa(i), 1, 0, 0, nil, 0, 0, 0, 0)
+	}
+	if n := len(m.router.sources[m.allDomainsRequestsCounter]); n != 0 {
+		t.Fatalf("%d dropped hosts remembered", n)
+	}
+}
+
+func TestRelabelReloadReroutesWrittenSeries(t *testing.T) {
+	compile := func(configs ...relabel.Config) []relabel.Config {
+		for i := range configs {
+			if err := configs[i].Compile(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return configs
+	}
+	rename := relabel.Config{
+		SourceLabels: []string{"__name__"},
+		Regex:        "squid_site_requests_total",
+		TargetLabel:  "__name__",
+		Replacement:  proto.String("squid_registrable_domain_requests_total"),
+	}
+	dropSite := relabel.Config{SourceLabels: []string{"site"}, Regex: "example\\.com", Action: relabel.Drop}
+
+	m := newRelabeledMetrics(t, rename)
+	m.UpdateSite("example.com", 4, 0, 0, nil, 0, 0, 0, 0)
+	m.UpdateSite("example.org", 2, 0, 0, nil, 0, 0, 0, 0)
+
+	// A drop added on reload removes the relabeled series it drops, while
+	// the others keep their value
+	m.SetRelabelConfigs(compile(rename, dropSite))
+	series := gather(t, m, "squid_registrable_domain_requests_total")
+	if len(series) != 1 || series["site=example.org"].GetCounter().GetValue() != 2 {
+		t.Fatalf("exposed series after reload = %v, want only example.org with 2", series)
+	}
+
+	// Without the rename, series are written under their own name again
+	m.SetRelabelConfigs(nil)
+	if series := gather(t, m, "squid_registrable_domain_requests_total"); len(series) != 0 {
+		t.Fatalf("renamed series still exposed without relabel configs: %v", series)
+	}
+	m.UpdateSite("example.com", 1, 0, 0, nil, 0, 0, 0, 0)
+	if series := gather(t, m, "squid_site_requests_total"); len(series) != 1 {
+		t.Fatalf("exposed series = %v, want example.com", series)
+	}
+
+	// Series written without configs are dropped by a drop added later
+	m.SetRelabelConfigs(compile(dropSite))
+	if series := gather(t, m, "squid_site_requests_total"); len(series) != 0 {
+		t.Fatalf("dropped series still exposed after reload: %v", series)
+	}
+}
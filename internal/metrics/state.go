@@ -0,0 +1,134 @@
+package metrics
+
+import (
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// CounterValue is the value of one counter series in a state snapshot
+type CounterValue struct {
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Value  float64           `json:"value"`
+
+	// Help is set for series that relabeling moved to another family
+	Help string `json:"help,omitempty"`
+}
+
+// trafficCounters returns the counters that describe proxy traffic by name.
+// The exporter's own squid_exporter_* counters restart with the process.
+// The caller must hold m.mu.
+func (m *Metrics) trafficCounters() map[string]prometheus.Collector {
+	return map[string]prometheus.Collector{
+		"squid_connections_total":                        m.connectionsTotal,
+		"squid_request_duration_seconds_total":           m.requestDurationTotal,
+		"squid_cache_status_total":                       m.cacheStatusTotal,
+		"squid_http_responses_total":                     m.httpResponsesTotal,
+		"squid_cache_requests_total":                     m.cacheRequestsTotal,
+		"squid_cache_bytes_total":                        m.cacheBytesTotal,
+		"squid_all_domains_requests_total":               m.allDomainsRequestsCounter,
+		"squid_all_domains_http_responses_total":         m.allDomainsHTTPResponsesCounter,
+		"squid_all_domains_bytes_total":                  m.allDomainsBytesCounter,
+		"squid_all_domains_cache_requests_total":         m.allDomainsCacheRequestsCounter,
+		"squid_all_domains_cache_bytes_total":            m.allDomainsCacheBytesCounter,
+		"squid_site_requests_total":                      m.siteRequestsCounter,
+		"squid_site_http_responses_total":                m.siteHTTPResponsesCounter,
+		"squid_site_bytes_total":                         m.siteBytesCounter,
+		"squid_site_cache_requests_total":                m.siteCacheRequestsCounter,
+		"squid_site_cache_bytes_total":                   m.siteCacheBytesCounter,
+		"squid_rules_dropped_lines_total":                m.droppedLinesCounter,
+		"squid_monitored_domains_requests_total":         m.monitoredDomainsRequestsCounter,
+		"squid_monitored_domains_http_responses_total":   m.monitoredDomainsHTTPResponsesCounter,
+		"squid_monitored_domains_bytes_total":            m.monitoredDomainsBytesCounter,
+		"squid_monitored_domains_cache_requests_total":   m.monitoredDomainsCacheRequestsCounter,
+		"squid_monitored_domains_cache_bytes_total":      m.monitoredDomainsCacheBytesCounter,
+		"squid_monitored_endpoints_requests_total":       m.monitoredEndpointsRequestsCounter,
+		"squid_monitored_endpoints_http_responses_total": m.monitoredEndpointsHTTPResponsesCounter,
+		"squid_group_requests_total":                     m.groupRequestsCounter,
+		"squid_group_bytes_total":                        m.groupBytesCounter,
+		"squid_group_http_responses_total":               m.groupHTTPResponsesCounter,
+	}
+}
+
+// Counters returns the current value of every traffic counter series, as
+// written after relabeling, sorted by name
+func (m *Metrics) Counters() []CounterValue {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var values []CounterValue
+	for name, collector := range m.trafficCounters() {
+		values = append(values, collectCounters(name, collector)...)
+	}
+	values = append(values, m.router.outputCounters()...)
+
+	sort.SliceStable(values, func(i, j int) bool {
+		return values[i].Name < values[j].Name
+	})
+	return values
+}
+
+// collectCounters returns the counter series of a collector
+func collectCounters(name string, collector prometheus.Collector) []CounterValue {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		collector.Collect(ch)
+		close(ch)
+	}()
+
+	var values []CounterValue
+	for metric := range ch {
+		var out dto.Metric
+		if err := metric.Write(&out); err != nil || out.Counter == nil {
+			continue
+		}
+		value := CounterValue{Name: name, Value: out.Counter.GetValue()}
+		if len(out.Label) > 0 {
+			value.Labels = make(map[string]string, len(out.Label))
+			for _, pair := range out.Label {
+				value.Labels[pair.GetName()] = pair.GetValue()
+			}
+		}
+		values = append(values, value)
+	}
+	return values
+}
+
+// RestoreCounters adds saved counter values to the current counters. Series
+// that relabeling moved to another family are restored to it. Series of
+// unknown metrics or whose labels no longer match, e.g. after the custom
+// label keys changed, are skipped; the number skipped is returned.
+func (m *Metrics) RestoreCounters(values []CounterValue) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	counters := m.trafficCounters()
+	m.router.mu.Lock()
+	defer m.router.mu.Unlock()
+
+	skipped := 0
+	for _, value := range values {
+		var counter prometheus.Counter
+		switch collector := counters[value.Name].(type) {
+		case prometheus.Counter:
+			if len(value.Labels) == 0 {
+				counter = collector
+			}
+		case *prometheus.CounterVec:
+			counter, _ = collector.GetMetricWith(value.Labels)
+		}
+		if counter == nil && value.Help != "" {
+			counter = m.router.restoreOutput(value.Name, value.Help, value.Labels)
+		}
+
+		if counter == nil || value.Value < 0 {
+			skipped++
+			continue
+		}
+		counter.Add(value.Value)
+	}
+
+	return skipped
+}
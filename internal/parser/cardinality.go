@@ -0,0 +1,180 @@
+package parser
+
+import (
+	"fmt"
+	"time"
+
+	"squid-log-exporter/internal/hll"
+)
+
+// Distinct value dimensions
+var (
+	globalDimensions = []string{"clients", "users", "hosts"}
+	domainDimensions = []string{"clients", "users"}
+)
+
+// cardinalityTracker holds sliding-window HyperLogLog sketches globally and
+// per monitored domain. It is saved in the state committed with the
+// position, so estimates survive restarts.
+type cardinalityTracker struct {
+	Global  map[string][]*hll.Window      `json:"global"`  // dimension -> windows
+	Domains map[string]*domainCardinality `json:"domains"` // host:port -> sketches
+
+	windows   []time.Duration
+	precision uint8
+}
+
+// domainCardinality holds the sketches of one monitored domain
+type domainCardinality struct {
+	Host       string                   `json:"host"`
+	Port       string                   `json:"port"`
+	Labels     map[string]string        `json:"labels"`
+	Dimensions map[string][]*hll.Window `json:"dimensions"`
+}
+
+// newCardinalityTracker creates an empty tracker
+func newCardinalityTracker(windows []time.Duration, precision uint8) *cardinalityTracker {
+	return &cardinalityTracker{
+		Global:    make(map[string][]*hll.Window),
+		Domains:   make(map[string]*domainCardinality),
+		windows:   windows,
+		precision: precision,
+	}
+}
+
+// addCardinality feeds the distinct clients, users and hosts of the lines up
+// to a checkpoint into the sketches
+func (p *Parser) addCardinality(stats *Stats, now time.Time) {
+	cfg := p.config.Cardinality
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.cardinality == nil {
+		p.cardinality = newCardinalityTracker(cfg.Windows, cfg.Precision)
+	}
+	t := p.cardinality
+
+	for value := range stats.Clients {
+		t.add(t.Global, "clients", now, value)
+	}
+	for value := range stats.Users {
+		t.add(t.Global, "users", now, value)
+	}
+
+	for host, ports := range stats.DomainData {
+		t.add(t.Global, "hosts", now, host)
+
+		for port, data := range ports {
+			monitoredDomain, isMonitored := p.config.IsMonitored(host, port)
+			if !isMonitored {
+				continue
+			}
+
+			key := host + ":" + port
+			domain := t.Domains[key]
+			if domain == nil {
+				domain = &domainCardinality{
+					Host:       host,
+					Port:       port,
+					Dimensions: make(map[string][]*hll.Window),
+				}
+				t.Domains[key] = domain
+			}
+			domain.Labels = monitoredDomain.Labels
+
+			for value := range data.Clients {
+				t.add(domain.Dimensions, "clients", now, value)
+			}
+			for value := range data.Users {
+				t.add(domain.Dimensions, "users", now, value)
+			}
+		}
+	}
+}
+
+// publishCardinality publishes the estimates of the sketches and drops
+// monitored domains whose windows are all empty
+func (p *Parser) publishCardinality(now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	t := p.cardinality
+	if t == nil {
+		return
+	}
+
+	for _, dimension := range globalDimensions {
+		for _, window := range t.windowsFor(t.Global, dimension) {
+			p.metrics.SetUniqueCount(dimension, formatWindow(window.Length), window.Estimate(now))
+		}
+	}
+
+	for key, domain := range t.Domains {
+		empty := true
+		for _, dimension := range domainDimensions {
+			for _, window := range t.windowsFor(domain.Dimensions, dimension) {
+				if !window.Empty(now) {
+					empty = false
+				}
+				p.metrics.SetMonitoredUniqueCount(dimension, domain.Host, domain.Port, domain.Labels,
+					formatWindow(window.Length), window.Estimate(now))
+			}
+		}
+
+		if empty {
+			p.metrics.DeleteMonitoredUniqueCounts(domain.Host, domain.Port)
+			delete(t.Domains, key)
+		}
+	}
+}
+
+// addDistinct records a distinct value, ignoring Squid's "-" placeholder
+func addDistinct(set map[string]struct{}, value string) {
+	if value == "" || value == "-" {
+		return
+	}
+	set[value] = struct{}{}
+}
+
+// add inserts value into every configured window of a dimension
+func (t *cardinalityTracker) add(dimensions map[string][]*hll.Window, dimension string, now time.Time, value string) {
+	for _, window := range t.windowsFor(dimensions, dimension) {
+		window.Add(now, value)
+	}
+}
+
+// windowsFor returns the windows of a dimension matching the configured
+// lengths, dropping restored windows that are no longer configured
+func (t *cardinalityTracker) windowsFor(dimensions map[string][]*hll.Window, dimension string) []*hll.Window {
+	existing := make(map[time.Duration]*hll.Window)
+	for _, window := range dimensions[dimension] {
+		if window.Precision == t.precision {
+			existing[window.Length] = window
+		}
+	}
+
+	windows := make([]*hll.Window, 0, len(t.windows))
+	for _, length := range t.windows {
+		window := existing[length]
+		if window == nil {
+			window = hll.NewWindow(length, t.precision)
+		}
+		windows = append(windows, window)
+	}
+	dimensions[dimension] = windows
+
+	return windows
+}
+
+// formatWindow renders a window length as a compact label value (5m, 1h, 24h)
+func formatWindow(d time.Duration) string {
+	switch {
+	case d%time.Hour == 0:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	case d%time.Minute == 0:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	default:
+		return fmt.Sprintf("%ds", d/time.Second)
+	}
+}
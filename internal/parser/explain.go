@@ -0,0 +1,129 @@
+package parser
+
+import (
+	"errors"
+	"sort"
+
+	"squid-log-exporter/internal/config"
+)
+
+// LineReport describes how the parser reads a log line, for debugging log
+// formats and rules
+type LineReport struct {
+	Line            string            `json:"line"`
+	Fields          []string          `json:"fields"`
+	Mapping         []FieldMapping    `json:"mapping"`
+	Error           string            `json:"error,omitempty"`
+	RejectReason    string            `json:"reject_reason,omitempty"` // as in squid_exporter_lines_rejected_total
+	URLError        string            `json:"url_error,omitempty"`     // the line is still counted, without a domain
+	Method          string            `json:"method,omitempty"`
+	URL             string            `json:"url,omitempty"`
+	ClientIP        string            `json:"client_ip,omitempty"`
+	User            string            `json:"user,omitempty"`
+	Host            string            `json:"host,omitempty"`
+	Port            string            `json:"port,omitempty"`
+	Path            string            `json:"path,omitempty"`
+	Site            string            `json:"site,omitempty"` // with global.site_aggregation
+	CacheStatus     string            `json:"cache_status,omitempty"`
+	CacheResult     string            `json:"cache_result,omitempty"` // hit, miss or empty
+	HTTPCode        string            `json:"http_code,omitempty"`
+	Category        string            `json:"category,omitempty"`
+	Bytes           int64             `json:"bytes"`
+	DurationSeconds float64           `json:"duration_seconds"`
+	Monitored       *MonitoredMatch   `json:"monitored,omitempty"`
+	DroppedBy       string            `json:"dropped_by,omitempty"` // name of the drop rule
+	RuleGroup       string            `json:"rule_group,omitempty"`
+	RuleLabels      map[string]string `json:"rule_labels,omitempty"`
+}
+
+// FieldMapping is a semantic field of the log format and its value in a line
+type FieldMapping struct {
+	Name  string `json:"name"`
+	Index int    `json:"index"`
+	Value string `json:"value"`
+}
+
+// MonitoredMatch is the monitored domain or pattern a line matched
+type MonitoredMatch struct {
+	Labels   map[string]string `json:"labels"`
+	Endpoint string            `json:"endpoint,omitempty"` // with path rules
+}
+
+// ExplainLine parses a log line with cfg without counting it
+func ExplainLine(cfg *config.Config, line string) LineReport {
+	report := LineReport{Line: line, Fields: splitPreservingQuotes(line)}
+
+	for name, idx := range cfg.LogFormat.Fields {
+		report.Mapping = append(report.Mapping, FieldMapping{
+			Name:  name,
+			Index: idx,
+			Value: cfg.LogFormat.GetField(report.Fields, name),
+		})
+	}
+	sort.Slice(report.Mapping, func(i, j int) bool {
+		if report.Mapping[i].Index != report.Mapping[j].Index {
+			return report.Mapping[i].Index < report.Mapping[j].Index
+		}
+		return report.Mapping[i].Name < report.Mapping[j].Name
+	})
+
+	entry, err := decodeLine(cfg, line)
+	if err != nil {
+		report.Error = err.Error()
+		var lineErr lineError
+		if errors.As(err, &lineErr) {
+			report.RejectReason = lineErr.reason
+		}
+		return report
+	}
+
+	if entry.urlErr != nil {
+		report.URLError = entry.urlErr.Error()
+		report.RejectReason = rejectURL
+	}
+
+	report.Method = entry.method
+	report.URL = entry.url
+	report.ClientIP = entry.clientIP
+	report.User = entry.user
+	report.CacheStatus = entry.cacheStatus
+	report.CacheResult = cacheResult(entry.cacheStatus)
+	report.HTTPCode = entry.httpCode
+	report.Category = entry.category
+	report.Bytes = entry.bytes
+	report.DurationSeconds = entry.durationSeconds
+	if entry.hasTarget {
+		report.Host, report.Port, report.Path = entry.host, entry.port, entry.path
+	}
+
+	if entry.rules.Drop {
+		report.DroppedBy = entry.rules.DropRule
+		return report
+	}
+	report.RuleGroup = entry.rules.Group
+	report.RuleLabels = entry.rules.Labels
+
+	if !entry.hasTarget {
+		return report
+	}
+	if cfg.Global.SiteAggregation {
+		report.Site = cfg.RegistrableDomain(entry.host)
+	}
+
+	if domain, ok := cfg.IsMonitored(entry.host, entry.port); ok {
+		report.Monitored = &MonitoredMatch{Labels: domain.Labels}
+		if entry.path != "" {
+			report.Monitored.Endpoint = domain.Endpoint(entry.path)
+		}
+	}
+
+	return report
+}
+
+// ExplainLine parses a log line with the current config without counting it
+func (p *Parser) ExplainLine(line string) LineReport {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return ExplainLine(p.config, line)
+}
@@ -0,0 +1,96 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// parserHealth records the outcome of parse cycles for the readiness check
+type parserHealth struct {
+	mu          sync.Mutex
+	started     time.Time
+	lastParse   time.Time // end of the last parse cycle, zero before the first
+	logFileErr  error     // the log file could not be opened or stat'ed
+	parseErr    error     // the last parse cycle failed
+	positionErr error     // the last position save failed
+	lastRead    time.Time // last cycle that read at least one line
+}
+
+// logFileError marks a parse failure caused by the log file itself
+type logFileError struct {
+	err error
+}
+
+func (e logFileError) Error() string { return e.err.Error() }
+func (e logFileError) Unwrap() error { return e.err }
+
+// finish records the end of a parse cycle
+func (h *parserHealth) finish(lines int, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.lastParse = time.Now()
+	h.logFileErr, h.parseErr = nil, nil
+	if errors.As(err, new(logFileError)) {
+		h.logFileErr = err
+	} else {
+		h.parseErr = err
+	}
+	if lines > 0 {
+		h.lastRead = h.lastParse
+	}
+}
+
+// positionSaved records the result of a position save
+func (h *parserHealth) positionSaved(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.positionErr = err
+}
+
+// Ready returns nil if the parser is working, or an error listing every
+// reason it is not: the first parse has not finished, the log file is
+// unreadable, the last parse failed, the position file cannot be written,
+// or no lines were read within input.stale_after.
+func (p *Parser) Ready() error {
+	p.mu.RLock()
+	staleAfter := p.config.Input.StaleAfter
+	p.mu.RUnlock()
+
+	h := &p.health
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.lastParse.IsZero() {
+		return fmt.Errorf("initial parse has not finished")
+	}
+
+	var reasons []string
+	if h.logFileErr != nil {
+		reasons = append(reasons, fmt.Sprintf("log file is unreadable: %v", h.logFileErr))
+	}
+	if h.parseErr != nil {
+		reasons = append(reasons, fmt.Sprintf("last parse failed: %v", h.parseErr))
+	}
+	if h.positionErr != nil {
+		reasons = append(reasons, fmt.Sprintf("position file cannot be written: %v", h.positionErr))
+	}
+	if staleAfter > 0 {
+		lastRead := h.lastRead
+		if lastRead.IsZero() {
+			lastRead = h.started
+		}
+		if idle := time.Since(lastRead); idle > staleAfter {
+			reasons = append(reasons, fmt.Sprintf("no lines read for %s (stale_after %s)", idle.Round(time.Second), staleAfter))
+		}
+	}
+
+	if len(reasons) > 0 {
+		return fmt.Errorf("%s", strings.Join(reasons, "; "))
+	}
+	return nil
+}
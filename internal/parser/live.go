@@ -0,0 +1,200 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Orderings accepted by Top
+const (
+	TopByRequests = "requests"
+	TopByBytes    = "bytes"
+	TopByErrors   = "errors"
+)
+
+// ErrLiveTopDisabled is returned by Top when live_top is not enabled
+var ErrLiveTopDisabled = errors.New("live_top is not enabled")
+
+// liveKey identifies the traffic of one client to one host
+type liveKey struct {
+	host   string
+	port   string
+	client netip.Addr // zero for the overflow entry
+}
+
+// liveCounts are the totals of a liveKey within one parse cycle
+type liveCounts struct {
+	requests int64
+	bytes    int64
+	errors   int64 // 4xx and 5xx responses
+}
+
+// liveBucket holds the aggregates of one parse cycle
+type liveBucket struct {
+	start  time.Time
+	end    time.Time
+	counts map[liveKey]*liveCounts
+}
+
+// liveTop is a ring of per-cycle aggregates, oldest first, covering at most
+// live_top.retention
+type liveTop struct {
+	mu      sync.Mutex
+	buckets []*liveBucket
+	lastEnd time.Time
+}
+
+// TopEntry is one host in a Top result
+type TopEntry struct {
+	Host     string `json:"host"`
+	Port     string `json:"port"`
+	Requests int64  `json:"requests"`
+	Bytes    int64  `json:"bytes"`
+	Errors   int64  `json:"errors"`
+}
+
+// TopResult is the answer to a Top query. From is the start of the oldest
+// parse cycle included, which may be later than To minus the window.
+type TopResult struct {
+	By      string     `json:"by"`
+	Window  string     `json:"window"`
+	Client  string     `json:"client,omitempty"`
+	From    time.Time  `json:"from"`
+	To      time.Time  `json:"to"`
+	Entries []TopEntry `json:"entries"`
+}
+
+// addLive counts a request in the per-cycle live aggregates. Once max_entries
+// host/client pairs exist, new pairs are counted under host "__other__".
+func (p *Parser) addLive(stats *Stats, host, port, clientIP string, bytes int64, category string) {
+	client, _ := netip.ParseAddr(clientIP)
+	key := liveKey{host: host, port: port, client: client.Unmap()}
+
+	counts := stats.Live[key]
+	if counts == nil {
+		if len(stats.Live) >= p.config.LiveTop.MaxEntries {
+			key = liveKey{host: "__other__", port: "0"}
+			counts = stats.Live[key]
+		}
+		if counts == nil {
+			counts = &liveCounts{}
+			stats.Live[key] = counts
+		}
+	}
+
+	counts.requests++
+	counts.bytes += bytes
+	if category == "4xx" || category == "5xx" {
+		counts.errors++
+	}
+}
+
+// updateLive appends the aggregates of a parse cycle to the ring and drops
+// cycles older than the retention
+func (p *Parser) updateLive(counts map[liveKey]*liveCounts, now time.Time) {
+	retention := p.config.LiveTop.Retention
+
+	p.live.mu.Lock()
+	defer p.live.mu.Unlock()
+
+	start := p.live.lastEnd
+	if start.IsZero() {
+		start = p.health.started
+	}
+	p.live.lastEnd = now
+	p.live.buckets = append(p.live.buckets, &liveBucket{start: start, end: now, counts: counts})
+
+	drop := 0
+	for drop < len(p.live.buckets) && now.Sub(p.live.buckets[drop].end) > retention {
+		drop++
+	}
+	p.live.buckets = append(p.live.buckets[:0], p.live.buckets[drop:]...)
+}
+
+// Top ranks hosts by requests, bytes or errors over the parse cycles that
+// ended within window. With a valid client prefix only matching clients are
+// counted.
+func (p *Parser) Top(by string, window time.Duration, limit int, client netip.Prefix) (*TopResult, error) {
+	p.mu.RLock()
+	liveTop := p.config.LiveTop
+	p.mu.RUnlock()
+
+	if !liveTop.Enabled {
+		return nil, ErrLiveTopDisabled
+	}
+	switch by {
+	case TopByRequests, TopByBytes, TopByErrors:
+	default:
+		return nil, fmt.Errorf("invalid by %q (valid: requests, bytes, errors)", by)
+	}
+	if window <= 0 || window > liveTop.Retention {
+		return nil, fmt.Errorf("window must be positive and at most live_top.retention (%s)", liveTop.Retention)
+	}
+
+	now := time.Now()
+	result := &TopResult{By: by, Window: window.String(), From: now, To: now, Entries: []TopEntry{}}
+	if client.IsValid() {
+		result.Client = client.String()
+	}
+
+	totals := make(map[[2]string]*TopEntry)
+
+	p.live.mu.Lock()
+	for _, bucket := range p.live.buckets {
+		if now.Sub(bucket.end) > window {
+			continue
+		}
+		if bucket.start.Before(result.From) {
+			result.From = bucket.start
+		}
+		for key, counts := range bucket.counts {
+			if client.IsValid() && !client.Contains(key.client) {
+				continue
+			}
+			entry := totals[[2]string{key.host, key.port}]
+			if entry == nil {
+				entry = &TopEntry{Host: key.host, Port: key.port}
+				totals[[2]string{key.host, key.port}] = entry
+			}
+			entry.Requests += counts.requests
+			entry.Bytes += counts.bytes
+			entry.Errors += counts.errors
+		}
+	}
+	p.live.mu.Unlock()
+
+	value := func(entry *TopEntry) int64 {
+		switch by {
+		case TopByBytes:
+			return entry.Bytes
+		case TopByErrors:
+			return entry.Errors
+		}
+		return entry.Requests
+	}
+
+	entries := make([]*TopEntry, 0, len(totals))
+	for _, entry := range totals {
+		if value(entry) > 0 {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if value(entries[i]) != value(entries[j]) {
+			return value(entries[i]) > value(entries[j])
+		}
+		return entries[i].Host+":"+entries[i].Port < entries[j].Host+":"+entries[j].Port
+	})
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	for _, entry := range entries {
+		result.Entries = append(result.Entries, *entry)
+	}
+
+	return result, nil
+}
@@ -19,6 +19,7 @@ package parser
 
 import (
         "bufio"
+        "errors"
         "fmt"
         "io"
         "log"
@@ -28,6 +29,7 @@ import (
         "strconv"
         "strings"
         "sync"
+        "time"
 
         "squid-log-exporter/internal/config"
         "squid-log-exporter/internal/metrics"
@@ -40,8 +42,17 @@ type Parser struct {
         config          *config.Config
         positionTracker *position.Tracker
         logFile         string
-        allDomainsSeen  map[string]bool
+        positionFile    string
+        trackedDomains  *domainTracker
+        trackedSites    *domainTracker
+        top             *topDomains
+        cardinality     *cardinalityTracker
+        health          parserHealth
+        status          parserStatus
+        live            liveTop
+        loaded          bool // the checkpoint was read at startup
         mu              sync.RWMutex
+        parseMu         sync.Mutex // held for a whole parse cycle and during config swaps
 }
 
 // DomainData holds statistics for a domain
@@ -54,36 +65,122 @@ type DomainData struct {
         Durations            []float64
         CacheHits            int
         CacheMisses          int
+        CacheHitBytes        int64
+        CacheMissBytes       int64
+        Clients              map[string]struct{} // only with cardinality enabled
+        Users                map[string]struct{}
+        Endpoints            map[string]*EndpointData // only for monitored domains with path rules
+}
+
+// EndpointData holds statistics for one endpoint of a monitored domain
+type EndpointData struct {
+        Requests        int
+        ResponsesByCode map[string]map[string]int // code -> category -> count
+        Durations       []float64
 }
 
 // NewParser creates a new parser instance
 func NewParser(logFile string, positionFile string, m *metrics.Metrics, cfg *config.Config) *Parser {
+        m.SetRuleLabelKeys(cfg.GetRuleLabelKeys())
+
         return &Parser{
                 metrics:         m,
                 config:          cfg,
                 positionTracker: position.NewTracker(positionFile),
                 logFile:         logFile,
-                allDomainsSeen:  make(map[string]bool),
+                positionFile:    positionFile,
+                trackedDomains:  newDomainTracker(cfg.Global.MaxDomains, cfg.Global.DomainTTL, cfg.Global.EvictLRU),
+                trackedSites:    newDomainTracker(cfg.Global.MaxDomains, cfg.Global.DomainTTL, cfg.Global.EvictLRU),
+                health:          parserHealth{started: time.Now()},
+        }
+}
+
+// SetConfig atomically replaces the configuration between parse cycles.
+// Monitored domain metrics are re-created if the custom label keys changed.
+func (p *Parser) SetConfig(cfg *config.Config) {
+        p.parseMu.Lock()
+        defer p.parseMu.Unlock()
+
+        if p.metrics.SetCustomLabelKeys(cfg.GetCustomLabelKeys()) {
+                log.Printf("Custom label keys changed to %v, monitored domain metrics re-created", cfg.GetCustomLabelKeys())
+        }
+        if p.metrics.SetRuleLabelKeys(cfg.GetRuleLabelKeys()) {
+                log.Printf("Rule label keys changed to %v, rule group metrics re-created", cfg.GetRuleLabelKeys())
+        }
+
+        p.mu.Lock()
+        defer p.mu.Unlock()
+
+        p.trackedDomains.max = cfg.Global.MaxDomains
+        p.trackedDomains.ttl = cfg.Global.DomainTTL
+        p.trackedDomains.lru = cfg.Global.EvictLRU
+        p.trackedSites.max = cfg.Global.MaxDomains
+        p.trackedSites.ttl = cfg.Global.DomainTTL
+        p.trackedSites.lru = cfg.Global.EvictLRU
+
+        // Sketches are rebuilt lazily with the new settings; cardinality
+        // windows that are no longer configured are dropped on the next update
+        if p.config.TopDomains != cfg.TopDomains {
+                p.top = nil
+        }
+        if !cfg.Cardinality.Enabled {
+                p.cardinality = nil
+        } else if p.cardinality != nil {
+                p.cardinality.windows = cfg.Cardinality.Windows
+                p.cardinality.precision = cfg.Cardinality.Precision
+        }
+
+        if !cfg.LiveTop.Enabled {
+                p.live.mu.Lock()
+                p.live.buckets = nil
+                p.live.lastEnd = time.Time{}
+                p.live.mu.Unlock()
         }
+
+        p.config = cfg
 }
 
 // Parse reads and processes the Squid log file
 func (p *Parser) Parse() error {
-        // Load last position
-        if err := p.positionTracker.Load(); err != nil {
-                log.Printf("Warning: failed to load position: %v, starting from beginning", err)
+        p.parseMu.Lock()
+        defer p.parseMu.Unlock()
+
+        start := time.Now()
+        linesRead, err := p.parse()
+        p.health.finish(linesRead, err)
+        p.metrics.ObserveParseCycle(time.Since(start), err)
+        p.status.finish(time.Since(start), linesRead)
+
+        return err
+}
+
+// parse runs one parse cycle and returns the number of lines read
+func (p *Parser) parse() (int, error) {
+        // Load the last checkpoint once at startup; afterwards the tracker
+        // holds the position reached by this process
+        if !p.loaded {
+                p.loaded = true
+                if err := p.positionTracker.Load(); err != nil {
+                        log.Printf("Warning: failed to load position: %v, starting from beginning", err)
+                } else if state := p.positionTracker.State(); state != nil {
+                        // The state was committed with the position, so both
+                        // describe the same lines
+                        if err := p.restoreState(state); err != nil {
+                                log.Printf("Warning: not restoring state: %v, counters start from zero", err)
+                        }
+                }
         }
 
         file, err := os.Open(p.logFile)
         if err != nil {
-                return fmt.Errorf("failed to open log file: %w", err)
+                return 0, logFileError{fmt.Errorf("failed to open log file: %w", err)}
         }
         defer file.Close()
 
         // Get current file inode
         currentInode, err := position.GetFileInode(p.logFile)
         if err != nil {
-                return fmt.Errorf("failed to get file inode: %w", err)
+                return 0, logFileError{fmt.Errorf("failed to get file inode: %w", err)}
         }
 
         lastPos, lastInode := p.positionTracker.GetPosition()
@@ -94,6 +191,7 @@ func (p *Parser) Parse() error {
         if currentInode != lastInode && lastInode != 0 {
                 log.Printf("Log rotation detected (inode changed: %d -> %d), starting from beginning", lastInode, currentInode)
                 lastPos = 0
+                p.metrics.AddLogRotation()
         }
 
         // Seek to last position
@@ -108,59 +206,141 @@ func (p *Parser) Parse() error {
                 log.Printf("Starting from beginning (lastPos=0)") // DEBUG
         }
 
-        // Statistics
-        stats := &Stats{
+        // Statistics, added to the metrics at every checkpoint of the cycle
+        cycle := newParseCycle(time.Now())
+        stats := cycle.newStats()
+
+        // pos is the offset after the last line returned by the scanner, so
+        // checkpoints within the cycle point exactly past the lines counted
+        pos := lastPos
+        scanner := newLineScanner(file)
+        scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+                advance, token, err := bufio.ScanLines(data, atEOF)
+                pos += int64(advance)
+                return advance, token, err
+        })
+
+        linesRead, lineCount := 0, 0
+
+        for scanner.Scan() {
+                if p.readLine(scanner.Text(), stats) {
+                        stats.LinesParsed++
+                }
+
+                // A long catch-up read is checkpointed along the way, so a
+                // crash re-reads at most checkpointLines lines
+                if stats.LinesRead >= checkpointLines {
+                        linesRead += stats.LinesRead
+                        lineCount += stats.LinesParsed
+                        p.checkpoint(file, stats, cycle, false, pos, currentInode)
+                        stats = cycle.newStats()
+                }
+        }
+
+        linesRead += stats.LinesRead
+        lineCount += stats.LinesParsed
+
+        if err := scanner.Err(); err != nil {
+                return linesRead, fmt.Errorf("scanner error: %w", err)
+        }
+
+        p.checkpoint(file, stats, cycle, true, pos, currentInode)
+
+        log.Printf("Parsed %d new lines", lineCount)
+
+        return linesRead, nil
+}
+
+// checkpointLines is the number of lines read after which a cycle commits
+// the counts so far with their position
+const checkpointLines = 100000
+
+// checkpoint adds the counts of stats to the metrics and commits them with
+// the position after the last line they include; the last checkpoint of a
+// cycle also publishes what is computed once per cycle. Scrapes wait while
+// the counts are added and the state is serialized, but not for the disk
+// writes: a crash before the checkpoint is on disk restarts from the
+// previous one, which again holds the position and counts of the same lines.
+func (p *Parser) checkpoint(file *os.File, stats *Stats, cycle *parseCycle, last bool, pos int64, inode uint64) {
+        p.metrics.BeginCommit()
+        p.addCounts(stats, cycle)
+        if last {
+                p.finishCycle(cycle)
+        }
+        state, err := p.snapshotState()
+        p.metrics.EndCommit()
+        if err != nil {
+                log.Printf("Warning: not saving state: %v", err)
+        }
+
+        log.Printf("Saving position: %d (parsed %d lines)", pos, stats.LinesParsed) // DEBUG
+        if err := p.savePosition(file, pos, inode, state); err != nil {
+                log.Printf("Warning: failed to save position: %v", err)
+        }
+}
+
+// newStats creates empty statistics for one parse cycle
+func newStats() *Stats {
+        return &Stats{
                 Connections:      0,
                 RequestDurations: make(map[string]int),
                 CacheStatuses:    make(map[string]int),
                 HTTPResponses:    make(map[string]map[string]int),
                 HTTPByCategory:   make(map[string]int),
+                Clients:          make(map[string]struct{}),
+                Users:            make(map[string]struct{}),
                 DomainData:       make(map[string]map[string]*DomainData),
+                Groups:           make(map[string]*GroupData),
+                Dropped:          make(map[string]int),
+                Rejected:         make(map[string]int),
+                Live:             make(map[liveKey]*liveCounts),
         }
+}
 
-        scanner := bufio.NewScanner(file)
+// newLineScanner returns a scanner for log lines of up to 1 MiB
+func newLineScanner(r io.Reader) *bufio.Scanner {
+        scanner := bufio.NewScanner(r)
         const maxScanTokenSize = 1024 * 1024
         buf := make([]byte, maxScanTokenSize)
         scanner.Buffer(buf, maxScanTokenSize)
+        return scanner
+}
 
-        lineCount := 0
-
-        for scanner.Scan() {
-                line := scanner.Text()
-
-                if err := p.parseLine(line, stats); err != nil {
-                        log.Printf("Warning: failed to parse line: %v", err)
-                        continue
-                }
-
-                lineCount++
-
-                // Save position every 1000 lines
-                if lineCount%1000 == 0 {
-                        currentPos, _ := file.Seek(0, io.SeekCurrent)
-                        if err := p.positionTracker.Save(p.logFile, currentPos, currentInode); err != nil {
-                                log.Printf("Warning: failed to save position: %v", err)
-                        }
+// readLine counts a line read from the log and parses it. It returns false if
+// the line was rejected.
+func (p *Parser) readLine(line string, stats *Stats) bool {
+        stats.LinesRead++
+        stats.BytesRead += int64(len(line)) + 1
+
+        if err := p.parseLine(line, stats); err != nil {
+                var lineErr lineError
+                if errors.As(err, &lineErr) {
+                        stats.Rejected[lineErr.reason]++
+                        p.status.rejected(lineErr.reason, err, line)
                 }
+                log.Printf("Warning: failed to parse line: %v", err)
+                return false
         }
 
-        if err := scanner.Err(); err != nil {
-                return fmt.Errorf("scanner error: %w", err)
-        }
-
-        // Update metrics
-        p.updateMetrics(stats)
+        return true
+}
 
-        // Save final position
-        finalPos, _ := file.Seek(0, io.SeekCurrent)
-        log.Printf("Saving final position: %d (parsed %d lines)", finalPos, lineCount) // DEBUG
-        if err := p.positionTracker.Save(p.logFile, finalPos, currentInode); err != nil {
-                log.Printf("Warning: failed to save final position: %v", err)
+// savePosition commits the read position with the serialized state, if any,
+// and reports it against the file size. Failures are recorded for the
+// readiness check and metrics.
+func (p *Parser) savePosition(file *os.File, pos int64, inode uint64, state []byte) error {
+        if info, err := file.Stat(); err == nil {
+                p.metrics.SetLogFilePosition(pos, info.Size())
+                p.status.setPosition(inode, pos, info.Size())
         }
 
-        log.Printf("Parsed %d new lines", lineCount)
+        err := p.positionTracker.Commit(p.logFile, pos, inode, state)
+        p.health.positionSaved(err)
+        if err != nil {
+                p.metrics.AddPositionSaveFailure()
+        }
 
-        return nil
+        return err
 }
 
 // Stats holds all parsed statistics
@@ -170,42 +350,111 @@ type Stats struct {
         CacheStatuses    map[string]int
         HTTPResponses    map[string]map[string]int
         HTTPByCategory   map[string]int
+        CacheHits        int
+        CacheMisses      int
+        CacheHitBytes    int64
+        CacheMissBytes   int64
+        Clients          map[string]struct{} // only with cardinality enabled
+        Users            map[string]struct{}
         DomainData       map[string]map[string]*DomainData // host -> port -> data
+        Groups           map[string]*GroupData             // lines matched by label/group rules
+        Dropped          map[string]int                    // rule -> lines dropped
+        Rejected         map[string]int                    // reason -> lines that failed to parse
+        Live             map[liveKey]*liveCounts           // only with live_top enabled
+        LinesRead        int
+        LinesParsed      int
+        BytesRead        int64
 }
 
-// parseLine parses a single Squid access log line using configured format
-func (p *Parser) parseLine(line string, stats *Stats) error {
+// GroupData holds statistics for lines with the same rule group and labels
+type GroupData struct {
+        Group               string
+        Labels              map[string]string
+        Requests            int
+        Bytes               int64
+        ResponsesByCategory map[string]int
+}
+
+// Reasons for rejecting a log line
+const (
+        rejectFieldCount = "field_count"
+        rejectResultCode = "result_code"
+        rejectURL        = "url"
+        rejectTimestamp  = "timestamp" // backfill only
+)
+
+// lineError is a line that could not be parsed, with the reason it was rejected
+type lineError struct {
+        reason string
+        err    error
+}
+
+func (e lineError) Error() string { return e.err.Error() }
+func (e lineError) Unwrap() error { return e.err }
+
+// errNoTarget is returned by parseTarget for lines without a destination host
+var errNoTarget = errors.New("no target host")
+
+// logLine holds the values of a log line that the parser uses
+type logLine struct {
+        fields          []string
+        durationSeconds float64
+        clientIP        string
+        user            string
+        cacheStatus     string
+        httpCode        string
+        category        string
+        bytes           int64
+        method          string
+        url             string
+        host            string
+        port            string
+        path            string
+        hasTarget       bool
+        urlErr          error // http(s) URL that did not parse; the line is counted without a domain
+        rules           config.RuleResult
+}
+
+// decodeLine splits a log line with the configured format, derives the values
+// the parser counts and applies the rules
+func decodeLine(cfg *config.Config, line string) (*logLine, error) {
         // Split by spaces, but preserve quoted strings
         fields := splitPreservingQuotes(line)
 
         // Get minimum required fields
         minFields := 0
-        for _, idx := range p.config.LogFormat.Fields {
+        for _, idx := range cfg.LogFormat.Fields {
                 if idx > minFields {
                         minFields = idx
                 }
         }
 
         if len(fields) <= minFields {
-                return fmt.Errorf("invalid log line format: expected at least %d fields, got %d", minFields+1, len(fields))
+                return nil, lineError{rejectFieldCount, fmt.Errorf("invalid log line format: expected at least %d fields, got %d", minFields+1, len(fields))}
         }
 
         // Extract fields using configured positions
-        elapsed := p.config.LogFormat.GetField(fields, "duration")
-        resultCode := p.config.LogFormat.GetField(fields, "result_code")
-        bytes := p.config.LogFormat.GetField(fields, "bytes")
-        method := p.config.LogFormat.GetField(fields, "method")
-        urlStr := p.config.LogFormat.GetField(fields, "url")
+        entry := &logLine{fields: fields}
+        elapsed := cfg.LogFormat.GetField(fields, "duration")
+        resultCode := cfg.LogFormat.GetField(fields, "result_code")
+        bytes := cfg.LogFormat.GetField(fields, "bytes")
+        entry.method = cfg.LogFormat.GetField(fields, "method")
+        entry.url = cfg.LogFormat.GetField(fields, "url")
+        entry.clientIP = cfg.LogFormat.GetField(fields, "client_ip")
+        entry.user = cfg.LogFormat.GetField(fields, "rfc931")
+        if entry.user == "" {
+                entry.user = cfg.LogFormat.GetField(fields, "user")
+        }
 
         // Parse result code (e.g., "TCP_TUNNEL/200")
         parts := strings.Split(resultCode, "/")
         if len(parts) != 2 {
-                return fmt.Errorf("invalid result code format: %s", resultCode)
+                return nil, lineError{rejectResultCode, fmt.Errorf("invalid result code format: %s", resultCode)}
         }
 
-        cacheStatus := parts[0]
-        httpCode := parts[1]
-        category := categorizeHTTPCode(httpCode)
+        entry.cacheStatus = parts[0]
+        entry.httpCode = parts[1]
+        entry.category = categorizeHTTPCode(entry.httpCode)
 
         // Parse duration
         duration, err := strconv.ParseFloat(elapsed, 64)
@@ -214,17 +463,68 @@ func (p *Parser) parseLine(line string, stats *Stats) error {
         }
 
         // Convert to seconds based on config
-        var durationSeconds float64
-        if p.config.LogFormat.DurationUnit == "ms" {
-                durationSeconds = duration / 1000.0
+        if cfg.LogFormat.DurationUnit == "ms" {
+                entry.durationSeconds = duration / 1000.0
         } else {
-                durationSeconds = duration
+                entry.durationSeconds = duration
         }
 
         // Parse bytes
-        bytesInt, err := strconv.ParseInt(bytes, 10, 64)
+        entry.bytes, err = strconv.ParseInt(bytes, 10, 64)
+        if err != nil {
+                entry.bytes = 0
+        }
+
+        entry.host, entry.port, entry.path, err = parseTarget(entry.method, entry.url)
+        if err != nil && err != errNoTarget {
+                entry.urlErr = lineError{rejectURL, err}
+        }
+        entry.hasTarget = err == nil
+
+        if cfg.HasRules() {
+                hierarchy, _, _ := strings.Cut(cfg.LogFormat.GetField(fields, "hierarchy"), "/")
+                entry.rules = cfg.ApplyRules(&config.LogEntry{
+                        ClientIP:    entry.clientIP,
+                        User:        entry.user,
+                        Method:      entry.method,
+                        ResultTag:   entry.cacheStatus,
+                        Status:      entry.httpCode,
+                        ContentType: cfg.LogFormat.GetField(fields, "content_type"),
+                        UserAgent:   cfg.LogFormat.GetField(fields, "user_agent"),
+                        Hierarchy:   hierarchy,
+                        Host:        entry.host,
+                })
+        }
+
+        return entry, nil
+}
+
+// parseLine parses a single Squid access log line using configured format
+func (p *Parser) parseLine(line string, stats *Stats) error {
+        entry, err := decodeLine(p.config, line)
         if err != nil {
-                bytesInt = 0
+                return err
+        }
+
+        // A bad URL is counted as rejected, but the line still counts globally
+        if entry.urlErr != nil {
+                stats.Rejected[rejectURL]++
+                p.status.rejected(rejectURL, entry.urlErr, line)
+                log.Printf("Warning: counting line without a domain: %v", entry.urlErr)
+        }
+
+        clientIP, user := entry.clientIP, entry.user
+        cacheStatus, httpCode, category := entry.cacheStatus, entry.httpCode, entry.category
+        bytesInt, durationSeconds := entry.bytes, entry.durationSeconds
+        host, port, path := entry.host, entry.port, entry.path
+
+        // Match rules run before anything is counted so dropped lines leave no trace
+        if entry.rules.Drop {
+                stats.Dropped[entry.rules.DropRule]++
+                return nil
+        }
+        if entry.rules.Matched {
+                updateGroupStats(stats, entry.rules, bytesInt, category)
         }
 
         // Update global stats
@@ -233,23 +533,71 @@ func (p *Parser) parseLine(line string, stats *Stats) error {
         stats.RequestDurations[durationBucket]++
         stats.CacheStatuses[cacheStatus]++
 
+        switch cacheResult(cacheStatus) {
+        case "hit":
+                stats.CacheHits++
+                stats.CacheHitBytes += bytesInt
+        case "miss":
+                stats.CacheMisses++
+                stats.CacheMissBytes += bytesInt
+        }
+
         if stats.HTTPResponses[httpCode] == nil {
                 stats.HTTPResponses[httpCode] = make(map[string]int)
         }
         stats.HTTPResponses[httpCode][category]++
         stats.HTTPByCategory[category]++
 
+        if p.config.Cardinality.Enabled {
+                addDistinct(stats.Clients, clientIP)
+                addDistinct(stats.Users, user)
+        }
+
+        if !entry.hasTarget {
+                return nil
+        }
+
+        if p.config.LiveTop.Enabled {
+                p.addLive(stats, host, port, clientIP, bytesInt, category)
+        }
+
+        // Domain-specific stats
+        p.updateDomainStats(stats, host, port, bytesInt, httpCode, category, durationSeconds, cacheStatus)
+
+        // Endpoint stats for monitored domains with path rules
+        if path != "" && p.config.HasPathRules() {
+                if monitoredDomain, ok := p.config.IsMonitored(host, port); ok {
+                        if endpoint := monitoredDomain.Endpoint(path); endpoint != "" {
+                                updateEndpointStats(stats.DomainData[host][port], endpoint, httpCode, category, durationSeconds)
+                        }
+                }
+        }
+
+        if p.config.Cardinality.Enabled {
+                data := stats.DomainData[host][port]
+                if data.Clients == nil {
+                        data.Clients = make(map[string]struct{})
+                        data.Users = make(map[string]struct{})
+                }
+                addDistinct(data.Clients, clientIP)
+                addDistinct(data.Users, user)
+        }
+
+        return nil
+}
+
+// parseTarget extracts host, port and path from the URL field. Path is only
+// known for http(s) URLs. Internal Squid URLs and lines without a usable host
+// return errNoTarget; http(s) URLs that do not parse return their error.
+func parseTarget(method, urlStr string) (host, port, path string, err error) {
         // Skip internal Squid URLs
         if strings.HasPrefix(urlStr, "cache_object://") ||
                 strings.HasPrefix(urlStr, "mgr://") ||
                 strings.HasPrefix(urlStr, "internal://") ||
                 strings.HasPrefix(urlStr, "urn:") {
-                return nil
+                return "", "", "", errNoTarget
         }
 
-        // Parse host and port from URL
-        var host, port string
-
         // Handle CONNECT method (format: host:port)
         if method == "CONNECT" {
                 hostPort := strings.Split(urlStr, ":")
@@ -266,10 +614,14 @@ func (p *Parser) parseLine(line string, stats *Stats) error {
                 if strings.HasPrefix(urlStr, "http://") || strings.HasPrefix(urlStr, "https://") {
                         parsedURL, err := url.Parse(urlStr)
                         if err != nil {
-                                return nil
+                                return "", "", "", fmt.Errorf("invalid URL: %w", err)
                         }
                         host = parsedURL.Hostname()
                         port = parsedURL.Port()
+                        path = parsedURL.Path
+                        if path == "" {
+                                path = "/"
+                        }
                         if port == "" {
                                 if parsedURL.Scheme == "https" {
                                         port = "443"
@@ -293,13 +645,10 @@ func (p *Parser) parseLine(line string, stats *Stats) error {
 
         // Skip if no valid host
         if host == "" || host == "-" || host == "localhost" {
-                return nil
+                return "", "", "", errNoTarget
         }
 
-        // Domain-specific stats
-        p.updateDomainStats(stats, host, port, bytesInt, httpCode, category, durationSeconds, cacheStatus)
-
-        return nil
+        return host, port, path, nil
 }
 
 // splitPreservingQuotes splits a string by spaces but preserves quoted strings
@@ -360,61 +709,192 @@ func (p *Parser) updateDomainStats(stats *Stats, host, port string, bytes int64,
         data.ResponsesByCategory[category]++
 
         // Cache stats
-        if strings.HasPrefix(cacheStatus, "TCP_HIT") || strings.HasPrefix(cacheStatus, "TCP_MEM_HIT") {
+        switch cacheResult(cacheStatus) {
+        case "hit":
                 data.CacheHits++
-        } else if strings.HasPrefix(cacheStatus, "TCP_MISS") {
+                data.CacheHitBytes += bytes
+        case "miss":
                 data.CacheMisses++
+                data.CacheMissBytes += bytes
+        }
+}
+
+// updateEndpointStats records a request against an endpoint of a monitored domain
+func updateEndpointStats(data *DomainData, endpoint, httpCode, category string, duration float64) {
+        if data.Endpoints == nil {
+                data.Endpoints = make(map[string]*EndpointData)
+        }
+
+        endpointData := data.Endpoints[endpoint]
+        if endpointData == nil {
+                endpointData = &EndpointData{
+                        ResponsesByCode: make(map[string]map[string]int),
+                }
+                data.Endpoints[endpoint] = endpointData
+        }
+
+        endpointData.Requests++
+        endpointData.Durations = append(endpointData.Durations, duration)
+        if endpointData.ResponsesByCode[httpCode] == nil {
+                endpointData.ResponsesByCode[httpCode] = make(map[string]int)
+        }
+        endpointData.ResponsesByCode[httpCode][category]++
+}
+
+// updateGroupStats records a line matched by label or group rules
+func updateGroupStats(stats *Stats, result config.RuleResult, bytes int64, category string) {
+        keys := make([]string, 0, len(result.Labels))
+        for key := range result.Labels {
+                keys = append(keys, key)
+        }
+        sort.Strings(keys)
+
+        groupKey := result.Group
+        for _, key := range keys {
+                groupKey += "|" + key + "=" + result.Labels[key]
+        }
+
+        data := stats.Groups[groupKey]
+        if data == nil {
+                data = &GroupData{
+                        Group:               result.Group,
+                        Labels:              result.Labels,
+                        ResponsesByCategory: make(map[string]int),
+                }
+                stats.Groups[groupKey] = data
         }
+
+        data.Requests++
+        data.Bytes += bytes
+        data.ResponsesByCategory[category]++
+}
+
+// cacheResult classifies a Squid result tag as a cache "hit" (body served from
+// the cache, possibly after revalidation) or "miss" (body fetched upstream).
+// Tags that never touch the cache, such as TCP_TUNNEL or TCP_DENIED, return "".
+func cacheResult(cacheStatus string) string {
+        switch {
+        case strings.Contains(cacheStatus, "HIT"),
+                strings.HasPrefix(cacheStatus, "TCP_REFRESH_UNMODIFIED"),
+                strings.HasPrefix(cacheStatus, "TCP_REFRESH_IGNORED"),
+                strings.HasPrefix(cacheStatus, "TCP_REFRESH_FAIL_OLD"):
+                return "hit"
+        case strings.Contains(cacheStatus, "MISS"),
+                strings.HasPrefix(cacheStatus, "TCP_REFRESH"):
+                return "miss"
+        default:
+                return ""
+        }
+}
+
+// parseCycle collects what is published once per parse cycle, while the
+// counts of the cycle are added at every checkpoint. All checkpoints of a
+// cycle use its timestamp, so the domain trackers see the cycle as one.
+type parseCycle struct {
+	now       time.Time
+	expired   bool                              // idle tracked domains removed
+	monitored map[string]*MonitoredDomainStatus // host:port -> requests
+	untracked map[string]struct{}               // domains aggregated to __other__
+	live      map[liveKey]*liveCounts
+}
+
+// newParseCycle starts a parse cycle at now
+func newParseCycle(now time.Time) *parseCycle {
+	return &parseCycle{
+		now:       now,
+		monitored: make(map[string]*MonitoredDomainStatus),
+		untracked: make(map[string]struct{}),
+		live:      make(map[liveKey]*liveCounts),
+	}
+}
+
+// newStats creates empty statistics for the lines up to the next checkpoint
+// of the cycle. Live aggregates are shared by the whole cycle.
+func (c *parseCycle) newStats() *Stats {
+	stats := newStats()
+	stats.Live = c.live
+	return stats
+}
+
+// updateMetrics publishes the statistics of a whole parse cycle that ended at now
+func (p *Parser) updateMetrics(stats *Stats, now time.Time) {
+	cycle := newParseCycle(now)
+	cycle.live = stats.Live
+	p.addCounts(stats, cycle)
+	p.finishCycle(cycle)
 }
 
-func (p *Parser) updateMetrics(stats *Stats) {
+// addCounts adds the statistics of the lines up to a checkpoint of a parse
+// cycle to the counters, the domain trackers and the sketches
+func (p *Parser) addCounts(stats *Stats, cycle *parseCycle) {
+	now := cycle.now
+	expire := !cycle.expired
+	cycle.expired = true
+
 	// Global metrics
-	p.metrics.SetConnections(stats.Connections)
+	p.metrics.AddConnections(stats.Connections)
 
 	for interval, count := range stats.RequestDurations {
-		p.metrics.SetRequestDuration(interval, count)
+		p.metrics.AddRequestDuration(interval, count)
 	}
 
 	for status, count := range stats.CacheStatuses {
-		p.metrics.SetCacheStatus(status, count)
+		p.metrics.AddCacheStatus(status, count)
 	}
 
 	for code, categories := range stats.HTTPResponses {
 		for category, count := range categories {
-			p.metrics.SetHTTPResponse(code, category, count)
+			p.metrics.AddHTTPResponse(code, category, count)
 		}
 	}
 
+	p.metrics.AddCacheResults(stats.CacheHits, stats.CacheMisses,
+		float64(stats.CacheHitBytes), float64(stats.CacheMissBytes))
+
+	for _, group := range stats.Groups {
+		p.metrics.AddGroup(group.Group, group.Labels, group.Requests, float64(group.Bytes), group.ResponsesByCategory)
+	}
+	for rule, count := range stats.Dropped {
+		p.metrics.AddDroppedLines(rule, count)
+	}
+
+	p.metrics.AddLinesRead(stats.LinesRead, stats.LinesParsed, stats.BytesRead)
+	for reason, count := range stats.Rejected {
+		p.metrics.AddRejectedLines(reason, count)
+	}
+
 	// Domain metrics - track "other" for untracked domains
 	var otherRequests float64
 	var otherBytesIn float64
 	var otherBytesOut float64
 	otherResponsesByCategory := make(map[string]int)
+	var otherCacheHits, otherCacheMisses int
+	var otherCacheHitBytes, otherCacheMissBytes float64
+
+	if p.config.Global.TrackAllDomains && expire {
+		p.mu.Lock()
+		expired := p.trackedDomains.Expire(now)
+		p.mu.Unlock()
+		for _, entry := range expired {
+			p.metrics.DeleteDomain(entry.labels[0], entry.labels[1], evictTTL)
+		}
+	}
 
 	for host, ports := range stats.DomainData {
 		for port, data := range ports {
 			domainKey := host + ":" + port
 
-			// Determine if this domain should be tracked individually
-			shouldTrack := false
-			isUntracked := false
-
 			if p.config.Global.TrackAllDomains {
+				// Determine if this domain should be tracked individually,
+				// possibly reusing the slot of the least recently used domain
 				p.mu.Lock()
-				if p.allDomainsSeen[domainKey] {
-					// Already tracking this domain
-					shouldTrack = true
-				} else if len(p.allDomainsSeen) < p.config.Global.MaxDomains {
-					// Room for new domain
-					p.allDomainsSeen[domainKey] = true
-					shouldTrack = true
-				} else {
-					// Max reached - will be aggregated to "other"
-					shouldTrack = false
-					isUntracked = true
-				}
+				shouldTrack, evicted := p.trackedDomains.Touch(domainKey, []string{host, port}, now)
 				p.mu.Unlock()
 
+				if evicted != nil {
+					p.metrics.DeleteDomain(evicted.labels[0], evicted.labels[1], evictLRU)
+				}
+
 				if shouldTrack {
 					// Update individual domain metrics
 					p.metrics.UpdateAllDomains(
@@ -424,15 +904,24 @@ func (p *Parser) updateMetrics(stats *Stats) {
 						float64(data.BytesIn),
 						float64(data.BytesOut),
 						data.ResponsesByCategory,
+						data.CacheHits,
+						data.CacheMisses,
+						float64(data.CacheHitBytes),
+						float64(data.CacheMissBytes),
 					)
-				} else if isUntracked {
-					// Aggregate to "other"
+				} else {
+					// Max reached - aggregate to "other"
+					cycle.untracked[domainKey] = struct{}{}
 					otherRequests += float64(data.Requests)
 					otherBytesIn += float64(data.BytesIn)
 					otherBytesOut += float64(data.BytesOut)
 					for category, count := range data.ResponsesByCategory {
 						otherResponsesByCategory[category] += count
 					}
+					otherCacheHits += data.CacheHits
+					otherCacheMisses += data.CacheMisses
+					otherCacheHitBytes += float64(data.CacheHitBytes)
+					otherCacheMissBytes += float64(data.CacheMissBytes)
 				}
 			}
 
@@ -441,20 +930,15 @@ func (p *Parser) updateMetrics(stats *Stats) {
 
 			// If monitored, update extended metrics
 			if isMonitored {
-				// Calculate average duration
-				avgDuration := 0.0
-				if len(data.Durations) > 0 {
-					sum := 0.0
-					for _, d := range data.Durations {
-						sum += d
-					}
-					avgDuration = sum / float64(len(data.Durations))
+				status := cycle.monitored[domainKey]
+				if status == nil {
+					status = &MonitoredDomainStatus{Host: host, Port: port}
+					cycle.monitored[domainKey] = status
 				}
+				status.Labels = monitoredDomain.Labels
+				status.Requests += data.Requests
 
-				p50Duration := calculatePercentile(data.Durations, 0.50)
-				p90Duration := calculatePercentile(data.Durations, 0.90)
-				p95Duration := calculatePercentile(data.Durations, 0.95)
-				p99Duration := calculatePercentile(data.Durations, 0.99)
+				avgDuration, p50Duration, p90Duration, p95Duration, p99Duration := durationSummary(data.Durations)
 
 				p.metrics.UpdateMonitoredDomain(
 					host,
@@ -471,11 +955,44 @@ func (p *Parser) updateMetrics(stats *Stats) {
 					p99Duration,
 					data.CacheHits,
 					data.CacheMisses,
+					float64(data.CacheHitBytes),
+					float64(data.CacheMissBytes),
 				)
+
+				for endpoint, endpointData := range data.Endpoints {
+					avg, p50, p90, p95, p99 := durationSummary(endpointData.Durations)
+					p.metrics.UpdateMonitoredEndpoint(
+						host,
+						port,
+						endpoint,
+						monitoredDomain.Labels,
+						float64(endpointData.Requests),
+						endpointData.ResponsesByCode,
+						avg, p50, p90, p95, p99,
+					)
+				}
 			}
 		}
 	}
 
+	if p.config.Global.TrackAllDomains {
+		p.mu.RLock()
+		p.metrics.SetTrackedDomains("host", p.trackedDomains.Len())
+		p.mu.RUnlock()
+	}
+
+	if p.config.Global.SiteAggregation {
+		p.updateSiteMetrics(stats, now, expire)
+	}
+
+	if p.config.TopDomains.Enabled {
+		p.addTopDomains(stats, now)
+	}
+
+	if p.config.Cardinality.Enabled {
+		p.addCardinality(stats, now)
+	}
+
 	// Update "other" metric if we have untracked domains
 	if p.config.Global.TrackAllDomains && otherRequests > 0 {
 		p.metrics.UpdateAllDomains(
@@ -485,22 +1002,107 @@ func (p *Parser) updateMetrics(stats *Stats) {
 			otherBytesIn,
 			otherBytesOut,
 			otherResponsesByCategory,
+			otherCacheHits,
+			otherCacheMisses,
+			otherCacheHitBytes,
+			otherCacheMissBytes,
 		)
+	}
+}
+
+// finishCycle publishes what is computed once per parse cycle: the status
+// page, live aggregates, top domains and cardinality estimates
+func (p *Parser) finishCycle(cycle *parseCycle) {
+	monitored := make([]MonitoredDomainStatus, 0, len(cycle.monitored))
+	for _, status := range cycle.monitored {
+		monitored = append(monitored, *status)
+	}
+	p.status.setMonitored(monitored, cycle.now)
+
+	if p.config.LiveTop.Enabled {
+		p.updateLive(cycle.live, cycle.now)
+	}
+
+	if p.config.TopDomains.Enabled {
+		p.publishTopDomains(cycle.now)
+	}
+
+	if p.config.Cardinality.Enabled {
+		p.publishCardinality(cycle.now)
+	}
+
+	if len(cycle.untracked) > 0 {
+		log.Printf("Warning: %d domains not tracked individually (max_domains=%d reached). Aggregated to __other__",
+			len(cycle.untracked), p.config.Global.MaxDomains)
+	}
+}
+
+// updateSiteMetrics folds per-host data into registrable domains (eTLD+1).
+// Sites share the max_domains limit and eviction settings; sites beyond the
+// limit are aggregated to __other__. Idle sites are removed first if expire
+// is set.
+func (p *Parser) updateSiteMetrics(stats *Stats, now time.Time, expire bool) {
+	sites := make(map[string]*DomainData)
 
+	if expire {
 		p.mu.Lock()
-		untrackedCount := 0
-		for _, ports := range stats.DomainData {
-			for range ports {
-				untrackedCount++
-			}
+		expired := p.trackedSites.Expire(now)
+		p.mu.Unlock()
+		for _, entry := range expired {
+			p.metrics.DeleteSite(entry.key, evictTTL)
 		}
-		untrackedCount = untrackedCount - len(p.allDomainsSeen)
+	}
+
+	for host, ports := range stats.DomainData {
+		siteName := p.config.RegistrableDomain(host)
+
+		p.mu.Lock()
+		tracked, evicted := p.trackedSites.Touch(siteName, nil, now)
 		p.mu.Unlock()
 
-		if untrackedCount > 0 {
-			log.Printf("Warning: %d domains not tracked individually (max_domains=%d reached). Aggregated to __other__",
-				untrackedCount, p.config.Global.MaxDomains)
+		if evicted != nil {
+			p.metrics.DeleteSite(evicted.key, evictLRU)
 		}
+		if !tracked {
+			siteName = "__other__"
+		}
+
+		agg := sites[siteName]
+		if agg == nil {
+			agg = &DomainData{ResponsesByCategory: make(map[string]int)}
+			sites[siteName] = agg
+		}
+
+		for _, data := range ports {
+			agg.Requests += data.Requests
+			agg.BytesIn += data.BytesIn
+			agg.BytesOut += data.BytesOut
+			for category, count := range data.ResponsesByCategory {
+				agg.ResponsesByCategory[category] += count
+			}
+			agg.CacheHits += data.CacheHits
+			agg.CacheMisses += data.CacheMisses
+			agg.CacheHitBytes += data.CacheHitBytes
+			agg.CacheMissBytes += data.CacheMissBytes
+		}
+	}
+
+	p.mu.RLock()
+	p.metrics.SetTrackedDomains("site", p.trackedSites.Len())
+	p.mu.RUnlock()
+
+	for siteName, data := range sites {
+		p.metrics.UpdateSite(
+			siteName,
+			float64(data.Requests),
+			float64(data.BytesIn),
+			float64(data.BytesOut),
+			data.ResponsesByCategory,
+			data.CacheHits,
+			data.CacheMisses,
+			float64(data.CacheHitBytes),
+			float64(data.CacheMissBytes),
+		)
 	}
 }
 
@@ -540,6 +1142,23 @@ func getDurationBucket(seconds float64) string {
         }
 }
 
+// durationSummary returns the average and p50/p90/p95/p99 of durations
+func durationSummary(durations []float64) (avg, p50, p90, p95, p99 float64) {
+        if len(durations) > 0 {
+                sum := 0.0
+                for _, d := range durations {
+                        sum += d
+                }
+                avg = sum / float64(len(durations))
+        }
+
+        return avg,
+                calculatePercentile(durations, 0.50),
+                calculatePercentile(durations, 0.90),
+                calculatePercentile(durations, 0.95),
+                calculatePercentile(durations, 0.99)
+}
+
 func calculatePercentile(durations []float64, percentile float64) float64 {
         if len(durations) == 0 {
                 return 0
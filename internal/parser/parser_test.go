@@ -0,0 +1,241 @@
+package parser
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"squid-log-exporter/internal/config"
+	"squid-log-exporter/internal/metrics"
+	"squid-log-exporter/internal/position"
+)
+
+const (
+	firstLines = `1700000000.100 120 10.0.0.5 TCP_MISS/200 5000 GET http://api.example.com/v1/users/42 - HIER_DIRECT/1.2.3.4 application/json
+1700000001.100 10 10.0.0.6 TCP_HIT/200 3000 GET http://api.example.com/v1/users/43 - NONE/- application/json
+1700000002.100 300 10.0.0.7 TCP_TUNNEL/200 9000 CONNECT cdn.foo.example.net:443 alice HIER_DIRECT/1.2.3.5 -
+`
+	nextLines = `1700000003.100 30 10.0.0.7 TCP_MEM_HIT/200 700 GET http://www.example.com/ - NONE/- text/html
+1700000004.100 30 10.0.0.8 TCP_DENIED/403 0 GET http://blocked.example.org/ - HIER_NONE/- text/html
+`
+)
+
+// crashed is the panic value of a simulated crash
+type crashed string
+
+// testExporter is a log file and position file shared by the processes of
+// a test, each of which is started with start
+type testExporter struct {
+	t            *testing.T
+	cfg          *config.Config
+	logFile      string
+	positionFile string
+}
+
+// newTestExporter creates an exporter with state enabled and the given
+// additional configuration
+func newTestExporter(t *testing.T, extraConfig string) *testExporter {
+	t.Helper()
+
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(configFile, []byte("state:\n  enabled: true\n"+extraConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.LoadConfig(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testExporter{
+		t:            t,
+		cfg:          cfg,
+		logFile:      filepath.Join(dir, "access.log"),
+		positionFile: filepath.Join(dir, "position.json"),
+	}
+}
+
+// start returns the parser of a newly started process
+func (e *testExporter) start() *Parser {
+	return NewParser(e.logFile, e.positionFile, metrics.NewIsolatedMetrics(nil), e.cfg)
+}
+
+// appendLog appends lines to the log file and returns its new size
+func (e *testExporter) appendLog(lines string) int64 {
+	e.t.Helper()
+
+	f, err := os.OpenFile(e.logFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(lines); err != nil {
+		e.t.Fatal(err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	return info.Size()
+}
+
+// parseCrashing runs a parse cycle and simulates a crash at a step of the
+// position commit
+func (e *testExporter) parseCrashing(p *Parser, step string) {
+	e.t.Helper()
+
+	position.CrashHook = func(at string) {
+		if at == step {
+			panic(crashed(at))
+		}
+	}
+	defer func() {
+		position.CrashHook = nil
+		if r := recover(); r != crashed(step) {
+			e.t.Fatalf("parse cycle did not reach step %s (recovered %v)", step, r)
+		}
+	}()
+
+	p.Parse()
+}
+
+// checkpoint returns the position on disk and the connections counted in
+// the state committed with it
+func (e *testExporter) checkpoint() (int64, float64) {
+	e.t.Helper()
+
+	tracker := position.NewTracker(e.positionFile)
+	if err := tracker.Load(); err != nil {
+		e.t.Fatal(err)
+	}
+	pos, _ := tracker.GetPosition()
+
+	var state stateSnapshot
+	if err := json.Unmarshal(tracker.State(), &state); err != nil {
+		e.t.Fatal(err)
+	}
+	return pos, connections(state.Counters)
+}
+
+// connections returns the value of squid_connections_total in counters
+func connections(counters []metrics.CounterValue) float64 {
+	return counterValue(counters, "squid_connections_total", nil)
+}
+
+// counterValue returns the value of the series of a counter with labels
+func counterValue(counters []metrics.CounterValue, name string, labels map[string]string) float64 {
+	for _, counter := range counters {
+		if counter.Name == name && fmt.Sprint(counter.Labels) == fmt.Sprint(labels) {
+			return counter.Value
+		}
+	}
+	return 0
+}
+
+func TestCrashKeepsPositionAndCountersTogether(t *testing.T) {
+	tests := []struct {
+		step     string
+		recounts bool // whether the restart reads the lines of the crashed cycle again
+	}{
+		// Between updateMetrics and the commit of the position
+		{position.StepWrite, true},
+		{position.StepSync, true},
+		{position.StepRename, true},
+		{position.StepSyncDir, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.step, func(t *testing.T) {
+			e := newTestExporter(t, "")
+
+			firstEnd := e.appendLog(firstLines)
+			p := e.start()
+			if err := p.Parse(); err != nil {
+				t.Fatal(err)
+			}
+
+			nextEnd := e.appendLog(nextLines)
+			e.parseCrashing(p, tt.step)
+
+			pos, counted := e.checkpoint()
+			switch {
+			case pos == firstEnd && counted == 3:
+				if !tt.recounts {
+					t.Fatalf("crash at %s lost the checkpoint", tt.step)
+				}
+			case pos == nextEnd && counted == 5:
+				if tt.recounts {
+					t.Fatalf("checkpoint saved before %s", tt.step)
+				}
+			default:
+				t.Fatalf("position %d committed with %v connections", pos, counted)
+			}
+
+			// The restarted process reads the rest of the log exactly once
+			restarted := e.start()
+			if err := restarted.Parse(); err != nil {
+				t.Fatal(err)
+			}
+			if n := connections(restarted.metrics.Counters()); n != 5 {
+				t.Fatalf("squid_connections_total after restart = %v, want 5", n)
+			}
+			if pos, _ := restarted.positionTracker.GetPosition(); pos != nextEnd {
+				t.Fatalf("position after restart = %d, want %d", pos, nextEnd)
+			}
+		})
+	}
+}
+
+func TestCheckpointsWithinCycleDoNotEvictDomains(t *testing.T) {
+	e := newTestExporter(t, `global:
+  track_all_domains: true
+  max_domains: 2
+  evict_lru: true
+monitored_domains:
+  - host: a.example.com
+    port: "80"
+`)
+
+	// a and b fill max_domains before the first checkpoint; c only shows
+	// up after it, within the same cycle
+	var lines strings.Builder
+	line := func(host string) {
+		fmt.Fprintf(&lines, "1700000000.100 10 10.0.0.5 TCP_MISS/200 500 GET http://%s/ - HIER_DIRECT/1.2.3.4 text/html\n", host)
+	}
+	line("a.example.com")
+	line("b.example.com")
+	for i := 2; i < checkpointLines+10; i++ {
+		line("a.example.com")
+	}
+	line("c.example.com")
+	e.appendLog(lines.String())
+
+	p := e.start()
+	if err := p.Parse(); err != nil {
+		t.Fatal(err)
+	}
+
+	counters := p.metrics.Counters()
+	for _, host := range []string{"a.example.com", "b.example.com"} {
+		labels := map[string]string{"host": host, "port": "80"}
+		if counterValue(counters, "squid_all_domains_requests_total", labels) == 0 {
+			t.Errorf("%s evicted by a domain seen in the same cycle", host)
+		}
+	}
+	if n := counterValue(counters, "squid_exporter_domains_evicted_total", map[string]string{"kind": "host", "reason": "lru"}); n != 0 {
+		t.Errorf("%v domains evicted", n)
+	}
+	other := map[string]string{"host": "__other__", "port": "0"}
+	if n := counterValue(counters, "squid_all_domains_requests_total", other); n != 1 {
+		t.Errorf("__other__ requests = %v, want 1", n)
+	}
+
+	// The status page covers the whole cycle, not its last checkpoint
+	monitored := p.Status().MonitoredDomains
+	if len(monitored) != 1 || monitored[0].Requests != checkpointLines+9 {
+		t.Errorf("monitored domains = %+v, want a.example.com with %d requests", monitored, checkpointLines+9)
+	}
+}
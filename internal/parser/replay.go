@@ -0,0 +1,142 @@
+package parser
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"squid-log-exporter/internal/config"
+	"squid-log-exporter/internal/metrics"
+)
+
+// ReplayInput is a log to replay and the name used in errors
+type ReplayInput struct {
+	Name   string
+	Reader io.Reader
+}
+
+// NewReplayParser creates a parser for Replay. It never reads or writes the
+// position file, which holds all saved state.
+func NewReplayParser(m *metrics.Metrics, cfg *config.Config) *Parser {
+	return NewParser("", "", m, cfg)
+}
+
+// Replay parses every line of the inputs as a single parse cycle and updates
+// the metrics, as if the lines had been appended to the log file since the
+// previous cycle. It returns the statistics of the cycle.
+func (p *Parser) Replay(inputs ...ReplayInput) (*Stats, error) {
+	p.parseMu.Lock()
+	defer p.parseMu.Unlock()
+
+	start := time.Now()
+	stats := newStats()
+
+	for _, input := range inputs {
+		scanner := newLineScanner(input.Reader)
+		for scanner.Scan() {
+			if p.readLine(scanner.Text(), stats) {
+				stats.LinesParsed++
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return stats, fmt.Errorf("%s: %w", input.Name, err)
+		}
+	}
+
+	p.updateMetrics(stats, time.Now())
+	p.metrics.ObserveParseCycle(time.Since(start), nil)
+
+	return stats, nil
+}
+
+// maxEmptyGap is the longest gap between lines during a backfill that is
+// filled with steps without lines; nothing is emitted for longer gaps
+const maxEmptyGap = time.Hour
+
+// BackfillSummary describes a finished backfill
+type BackfillSummary struct {
+	LinesRead    int
+	LinesParsed  int
+	LinesSkipped int // outside the requested time range
+	Steps        int
+	From         time.Time // end of the first step
+	To           time.Time // end of the last step
+}
+
+// Backfill replays the inputs, oldest first, by their line timestamps. Lines
+// are grouped into steps aligned to multiples of step; each step runs as a
+// parse cycle ending at the step end, after which emit is called with that
+// time. Lines older than the current step are counted in it, since Squid logs
+// requests when they complete. Lines before start or from end on are skipped
+// if start or end are set.
+func (p *Parser) Backfill(step time.Duration, start, end time.Time, emit func(time.Time) error, inputs ...ReplayInput) (*BackfillSummary, error) {
+	p.parseMu.Lock()
+	defer p.parseMu.Unlock()
+
+	summary := &BackfillSummary{}
+	stats := newStats()
+	var stepEnd time.Time
+
+	finishStep := func() error {
+		summary.LinesRead += stats.LinesRead
+		summary.LinesParsed += stats.LinesParsed
+		summary.Steps++
+		if summary.From.IsZero() {
+			summary.From = stepEnd
+		}
+		summary.To = stepEnd
+
+		p.updateMetrics(stats, stepEnd)
+		stats = newStats()
+		return emit(stepEnd)
+	}
+
+	for _, input := range inputs {
+		scanner := newLineScanner(input.Reader)
+		for scanner.Scan() {
+			line := scanner.Text()
+
+			t, err := p.config.LogFormat.ParseTimestamp(p.config.LogFormat.GetField(splitPreservingQuotes(line), "timestamp"))
+			if err != nil {
+				stats.LinesRead++
+				stats.BytesRead += int64(len(line)) + 1
+				stats.Rejected[rejectTimestamp]++
+				p.status.rejected(rejectTimestamp, err, line)
+				continue
+			}
+			if (!start.IsZero() && t.Before(start)) || (!end.IsZero() && !t.Before(end)) {
+				summary.LinesSkipped++
+				continue
+			}
+
+			lineStep := t.Truncate(step).Add(step)
+			if stepEnd.IsZero() {
+				stepEnd = lineStep
+			}
+			for stepEnd.Before(lineStep) {
+				if err := finishStep(); err != nil {
+					return summary, err
+				}
+				stepEnd = stepEnd.Add(step)
+				if gap := lineStep.Sub(stepEnd); gap > maxEmptyGap {
+					stepEnd = lineStep
+				}
+			}
+
+			if p.readLine(line, stats) {
+				stats.LinesParsed++
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return summary, fmt.Errorf("%s: %w", input.Name, err)
+		}
+	}
+
+	if !stepEnd.IsZero() {
+		if err := finishStep(); err != nil {
+			return summary, err
+		}
+	}
+
+	return summary, nil
+}
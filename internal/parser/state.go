@@ -0,0 +1,146 @@
+package parser
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"squid-log-exporter/internal/metrics"
+	"squid-log-exporter/internal/topk"
+)
+
+// stateVersion is increased when the snapshot format changes incompatibly
+const stateVersion = 1
+
+// stateSnapshot is the state committed with the position. It holds what was
+// counted up to that position, so it can be restored without counting lines
+// twice or not at all. Counters, tracked domains and top domains are only
+// saved with state enabled; cardinality sketches whenever they are enabled.
+type stateSnapshot struct {
+	Version        int                    `json:"version"`
+	Counters       []metrics.CounterValue `json:"counters,omitempty"`
+	TrackedDomains []trackedState         `json:"tracked_domains,omitempty"` // most recently used first
+	TrackedSites   []trackedState         `json:"tracked_sites,omitempty"`
+	TopDomains     *topDomainsState       `json:"top_domains,omitempty"`
+	Cardinality    *cardinalityTracker    `json:"cardinality,omitempty"`
+}
+
+// trackedState is a saved domainTracker entry
+type trackedState struct {
+	Key      string    `json:"key"`
+	Labels   []string  `json:"labels,omitempty"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// topDomainsState holds the sketches of the current top_domains window
+type topDomainsState struct {
+	WindowStart time.Time   `json:"window_start"`
+	Requests    []topk.Item `json:"requests"`
+	Bytes       []topk.Item `json:"bytes"`
+}
+
+// snapshotState returns a snapshot of the counters, tracked domains, top
+// domain and cardinality sketches, to be committed with the position. It
+// returns nil if there is nothing to save.
+func (p *Parser) snapshotState() ([]byte, error) {
+	snapshot := stateSnapshot{Version: stateVersion}
+	if p.config.State.Enabled {
+		snapshot.Counters = p.metrics.Counters()
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.config.State.Enabled {
+		snapshot.TrackedDomains = saveTracked(p.trackedDomains)
+		snapshot.TrackedSites = saveTracked(p.trackedSites)
+		if p.top != nil {
+			snapshot.TopDomains = &topDomainsState{
+				WindowStart: p.top.windowStart,
+				Requests:    p.top.requests.Top(p.config.TopDomains.Capacity),
+				Bytes:       p.top.bytes.Top(p.config.TopDomains.Capacity),
+			}
+		}
+	}
+	if p.config.Cardinality.Enabled {
+		snapshot.Cardinality = p.cardinality
+	}
+	if !p.config.State.Enabled && snapshot.Cardinality == nil {
+		return nil, nil
+	}
+
+	// Marshaled under p.mu, since the sketches are not copied
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal state: %w", err)
+	}
+
+	return data, nil
+}
+
+// restoreState restores a snapshot committed with the loaded position
+func (p *Parser) restoreState(data []byte) error {
+	var snapshot stateSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return fmt.Errorf("failed to unmarshal state: %w", err)
+	}
+	if snapshot.Version != stateVersion {
+		return fmt.Errorf("unsupported state version %d", snapshot.Version)
+	}
+
+	p.mu.Lock()
+	if snapshot.Cardinality != nil && p.config.Cardinality.Enabled {
+		cfg := p.config.Cardinality
+		p.cardinality = newCardinalityTracker(cfg.Windows, cfg.Precision)
+		if snapshot.Cardinality.Global != nil {
+			p.cardinality.Global = snapshot.Cardinality.Global
+		}
+		if snapshot.Cardinality.Domains != nil {
+			p.cardinality.Domains = snapshot.Cardinality.Domains
+		}
+	}
+	p.mu.Unlock()
+
+	if !p.config.State.Enabled {
+		return nil
+	}
+
+	skipped := p.metrics.RestoreCounters(snapshot.Counters)
+
+	p.mu.Lock()
+	droppedDomains := p.trackedDomains.restore(restoreTracked(snapshot.TrackedDomains))
+	droppedSites := p.trackedSites.restore(restoreTracked(snapshot.TrackedSites))
+	if snapshot.TopDomains != nil && p.config.TopDomains.Enabled {
+		p.top = &topDomains{
+			requests:    topk.New(p.config.TopDomains.Capacity),
+			bytes:       topk.New(p.config.TopDomains.Capacity),
+			windowStart: snapshot.TopDomains.WindowStart,
+		}
+		p.top.requests.Restore(snapshot.TopDomains.Requests)
+		p.top.bytes.Restore(snapshot.TopDomains.Bytes)
+	}
+	p.mu.Unlock()
+
+	log.Printf("Restored state: %d counter series (%d skipped), %d tracked domains, %d tracked sites",
+		len(snapshot.Counters)-skipped, skipped,
+		len(snapshot.TrackedDomains)-droppedDomains, len(snapshot.TrackedSites)-droppedSites)
+
+	return nil
+}
+
+func saveTracked(t *domainTracker) []trackedState {
+	var states []trackedState
+	for _, entry := range t.entries() {
+		states = append(states, trackedState{Key: entry.key, Labels: entry.labels, LastSeen: entry.lastSeen})
+	}
+	return states
+}
+
+func restoreTracked(states []trackedState) []*trackedEntry {
+	entries := make([]*trackedEntry, 0, len(states))
+	for _, state := range states {
+		entries = append(entries, &trackedEntry{key: state.Key, labels: state.Labels, lastSeen: state.LastSeen})
+	}
+	return entries
+}
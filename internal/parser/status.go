@@ -0,0 +1,175 @@
+package parser
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxRecentErrors is the number of rejected lines kept for the status page
+const maxRecentErrors = 20
+
+// maxSampleLength truncates rejected lines kept as samples
+const maxSampleLength = 512
+
+// Status is a snapshot of the parser state for the status page and API
+type Status struct {
+	Inputs           []InputStatus           `json:"inputs"`
+	LastParse        *time.Time              `json:"last_parse,omitempty"`
+	LastParseSeconds float64                 `json:"last_parse_duration_seconds"`
+	LastParseLines   int                     `json:"last_parse_lines"`
+	LinesRead        int64                   `json:"lines_read"`
+	Ready            bool                    `json:"ready"`
+	NotReadyReason   string                  `json:"not_ready_reason,omitempty"`
+	TrackAllDomains  bool                    `json:"track_all_domains"`
+	TrackedDomains   int                     `json:"tracked_domains"`
+	TrackedSites     int                     `json:"tracked_sites"`
+	MaxDomains       int                     `json:"max_domains"`
+	RecentErrors     []LineErrorSample       `json:"recent_errors"`
+	MonitoredDomains []MonitoredDomainStatus `json:"monitored_domains"`
+}
+
+// InputStatus describes a log file being read
+type InputStatus struct {
+	File         string `json:"file"`
+	PositionFile string `json:"position_file"`
+	Inode        uint64 `json:"inode"`
+	Offset       int64  `json:"offset"`
+	Size         int64  `json:"size"`
+}
+
+// LineErrorSample is a recently rejected log line
+type LineErrorSample struct {
+	Time   time.Time `json:"time"`
+	Reason string    `json:"reason"`
+	Error  string    `json:"error"`
+	Line   string    `json:"line"`
+}
+
+// MonitoredDomainStatus is the traffic of a monitored domain in the last
+// parse cycle
+type MonitoredDomainStatus struct {
+	Host              string            `json:"host"`
+	Port              string            `json:"port"`
+	Labels            map[string]string `json:"labels,omitempty"`
+	Requests          int               `json:"requests"`
+	RequestsPerSecond float64           `json:"requests_per_second"`
+}
+
+// parserStatus holds what the status page shows beyond parserHealth
+type parserStatus struct {
+	mu            sync.Mutex
+	inode         uint64
+	offset        int64
+	size          int64
+	lastDuration  time.Duration
+	lastLines     int
+	linesRead     int64
+	recentErrors  []LineErrorSample // oldest first
+	monitored     []MonitoredDomainStatus
+	monitoredFrom time.Time // start of the period the monitored rates cover
+}
+
+// setPosition records the read position in the log file
+func (s *parserStatus) setPosition(inode uint64, offset, size int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.inode, s.offset, s.size = inode, offset, size
+}
+
+// rejected keeps a sample of a rejected line
+func (s *parserStatus) rejected(reason string, err error, line string) {
+	if len(line) > maxSampleLength {
+		line = line[:maxSampleLength] + "..."
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.recentErrors) >= maxRecentErrors {
+		s.recentErrors = append(s.recentErrors[:0], s.recentErrors[1:]...)
+	}
+	s.recentErrors = append(s.recentErrors, LineErrorSample{
+		Time:   time.Now(),
+		Reason: reason,
+		Error:  err.Error(),
+		Line:   line,
+	})
+}
+
+// finish records the duration and line count of a parse cycle
+func (s *parserStatus) finish(duration time.Duration, lines int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastDuration = duration
+	s.lastLines = lines
+	s.linesRead += int64(lines)
+}
+
+// setMonitored stores the monitored domain request counts of a parse cycle
+// and turns them into rates over the time since the previous cycle
+func (s *parserStatus) setMonitored(domains []MonitoredDomainStatus, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if elapsed := now.Sub(s.monitoredFrom).Seconds(); !s.monitoredFrom.IsZero() && elapsed > 0 {
+		for i := range domains {
+			domains[i].RequestsPerSecond = float64(domains[i].Requests) / elapsed
+		}
+	}
+	sort.Slice(domains, func(i, j int) bool {
+		if domains[i].Requests != domains[j].Requests {
+			return domains[i].Requests > domains[j].Requests
+		}
+		return domains[i].Host+":"+domains[i].Port < domains[j].Host+":"+domains[j].Port
+	})
+
+	s.monitored = domains
+	s.monitoredFrom = now
+}
+
+// Status returns a snapshot of the parser state
+func (p *Parser) Status() Status {
+	p.mu.RLock()
+	status := Status{
+		TrackAllDomains: p.config.Global.TrackAllDomains,
+		TrackedDomains:  p.trackedDomains.Len(),
+		TrackedSites:    p.trackedSites.Len(),
+		MaxDomains:      p.config.Global.MaxDomains,
+	}
+	p.mu.RUnlock()
+
+	if err := p.Ready(); err != nil {
+		status.NotReadyReason = err.Error()
+	} else {
+		status.Ready = true
+	}
+
+	p.health.mu.Lock()
+	if !p.health.lastParse.IsZero() {
+		lastParse := p.health.lastParse
+		status.LastParse = &lastParse
+	}
+	p.health.mu.Unlock()
+
+	s := &p.status
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status.Inputs = []InputStatus{{
+		File:         p.logFile,
+		PositionFile: p.positionFile,
+		Inode:        s.inode,
+		Offset:       s.offset,
+		Size:         s.size,
+	}}
+	status.LastParseSeconds = s.lastDuration.Seconds()
+	status.LastParseLines = s.lastLines
+	status.LinesRead = s.linesRead
+	status.RecentErrors = append([]LineErrorSample{}, s.recentErrors...)
+	status.MonitoredDomains = append([]MonitoredDomainStatus{}, s.monitored...)
+
+	return status
+}
@@ -0,0 +1,60 @@
+package parser
+
+import (
+	"time"
+
+	"squid-log-exporter/internal/topk"
+)
+
+// topDomains ranks hosts by requests and bytes per window using Space-Saving
+// sketches, independent of max_domains
+type topDomains struct {
+	requests    *topk.SpaceSaving
+	bytes       *topk.SpaceSaving
+	windowStart time.Time
+}
+
+// addTopDomains feeds the lines up to a checkpoint into the sketches
+func (p *Parser) addTopDomains(stats *Stats, now time.Time) {
+	cfg := p.config.TopDomains
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.top == nil {
+		p.top = &topDomains{
+			requests:    topk.New(cfg.Capacity),
+			bytes:       topk.New(cfg.Capacity),
+			windowStart: now,
+		}
+	}
+
+	for host, ports := range stats.DomainData {
+		for port, data := range ports {
+			key := host + ":" + port
+			p.top.requests.Observe(key, float64(data.Requests))
+			p.top.bytes.Observe(key, float64(data.BytesIn+data.BytesOut))
+		}
+	}
+
+}
+
+// publishTopDomains publishes the sketches and starts a new window once the
+// current one is over
+func (p *Parser) publishTopDomains(now time.Time) {
+	cfg := p.config.TopDomains
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.top == nil || now.Sub(p.top.windowStart) < cfg.Window {
+		return
+	}
+
+	p.metrics.SetTopDomains("requests", p.top.requests.Top(cfg.N))
+	p.metrics.SetTopDomains("bytes", p.top.bytes.Top(cfg.N))
+
+	p.top.requests.Reset()
+	p.top.bytes.Reset()
+	p.top.windowStart = now
+}
@@ -0,0 +1,130 @@
+package parser
+
+import (
+	"container/list"
+	"time"
+)
+
+// Eviction reasons reported by domainTracker
+const (
+	evictTTL = "ttl"
+	evictLRU = "lru"
+)
+
+// trackedEntry is a series tracked individually by a domainTracker
+type trackedEntry struct {
+	key      string
+	labels   []string
+	lastSeen time.Time
+}
+
+// domainTracker decides which domains get their own series. Entries idle for
+// longer than ttl expire; when the tracker is full and lru is enabled, the
+// least recently used entry is evicted to make room, provided it was not seen
+// in the current parse cycle.
+type domainTracker struct {
+	max   int
+	ttl   time.Duration
+	lru   bool
+	order *list.List // front = most recently used
+	items map[string]*list.Element
+}
+
+// newDomainTracker creates a tracker holding at most max entries
+func newDomainTracker(max int, ttl time.Duration, lru bool) *domainTracker {
+	return &domainTracker{
+		max:   max,
+		ttl:   ttl,
+		lru:   lru,
+		order: list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// Touch marks key as seen at now and reports whether it is tracked
+// individually. If an entry had to be evicted to make room it is returned.
+func (t *domainTracker) Touch(key string, labels []string, now time.Time) (bool, *trackedEntry) {
+	if elem, ok := t.items[key]; ok {
+		elem.Value.(*trackedEntry).lastSeen = now
+		t.order.MoveToFront(elem)
+		return true, nil
+	}
+
+	var evicted *trackedEntry
+	if len(t.items) >= t.max {
+		if !t.lru {
+			return false, nil
+		}
+		oldest := t.order.Back()
+		if oldest == nil || !oldest.Value.(*trackedEntry).lastSeen.Before(now) {
+			// Everything was seen this cycle, evicting would only cause churn
+			return false, nil
+		}
+		evicted = t.remove(oldest)
+	}
+
+	entry := &trackedEntry{key: key, labels: labels, lastSeen: now}
+	t.items[key] = t.order.PushFront(entry)
+
+	return true, evicted
+}
+
+// Expire removes and returns entries not seen for longer than the TTL
+func (t *domainTracker) Expire(now time.Time) []*trackedEntry {
+	if t.ttl <= 0 {
+		return nil
+	}
+
+	var expired []*trackedEntry
+	for elem := t.order.Back(); elem != nil; elem = t.order.Back() {
+		if now.Sub(elem.Value.(*trackedEntry).lastSeen) <= t.ttl {
+			break
+		}
+		expired = append(expired, t.remove(elem))
+	}
+
+	return expired
+}
+
+// Contains reports whether key is currently tracked
+func (t *domainTracker) Contains(key string) bool {
+	_, ok := t.items[key]
+	return ok
+}
+
+// Len returns the number of tracked entries
+func (t *domainTracker) Len() int {
+	return len(t.items)
+}
+
+func (t *domainTracker) remove(elem *list.Element) *trackedEntry {
+	entry := t.order.Remove(elem).(*trackedEntry)
+	delete(t.items, entry.key)
+	return entry
+}
+
+// entries returns the tracked entries, most recently used first
+func (t *domainTracker) entries() []*trackedEntry {
+	entries := make([]*trackedEntry, 0, t.order.Len())
+	for elem := t.order.Front(); elem != nil; elem = elem.Next() {
+		entries = append(entries, elem.Value.(*trackedEntry))
+	}
+	return entries
+}
+
+// restore adds saved entries, most recently used first, as long as there is
+// room. It returns the number of entries that did not fit.
+func (t *domainTracker) restore(entries []*trackedEntry) int {
+	dropped := 0
+	for _, entry := range entries {
+		if _, ok := t.items[entry.key]; ok {
+			continue
+		}
+		if t.order.Len() >= t.max {
+			dropped++
+			continue
+		}
+		t.items[entry.key] = t.order.PushBack(entry)
+	}
+	return dropped
+}
@@ -10,12 +10,15 @@ import (
 	"time"
 )
 
-// Position represents the current reading position in a log file
+// Position represents the current reading position in a log file. State is
+// an optional snapshot of everything counted up to Position; both are
+// written in the same file so they are always committed together.
 type Position struct {
-	Filename    string    `json:"filename"`
-	Position    int64     `json:"position"`
-	Inode       uint64    `json:"inode"`
-	LastUpdated time.Time `json:"last_updated"`
+	Filename    string          `json:"filename"`
+	Position    int64           `json:"position"`
+	Inode       uint64          `json:"inode"`
+	LastUpdated time.Time       `json:"last_updated"`
+	State       json.RawMessage `json:"state,omitempty"`
 }
 
 // Tracker manages the position tracking for log files
@@ -52,8 +55,37 @@ func (t *Tracker) Load() error {
 	return nil
 }
 
-// Save writes the current position to disk atomically
+// Steps of Commit, named for CrashHook
+const (
+	StepWrite   = "write"    // nothing written yet
+	StepSync    = "sync"     // temporary file written, not flushed
+	StepRename  = "rename"   // temporary file flushed, not renamed
+	StepSyncDir = "sync_dir" // renamed, directory not flushed
+)
+
+// CrashHook, when set, is called before each step of Commit. Tests set it
+// to panic at a step, which stops Commit there as a crash would.
+var CrashHook func(step string)
+
+// crashPoint calls CrashHook for a step of Commit
+func crashPoint(step string) {
+	if CrashHook != nil {
+		CrashHook(step)
+	}
+}
+
+// Save writes the current position to disk atomically, without state
 func (t *Tracker) Save(filename string, pos int64, inode uint64) error {
+	return t.Commit(filename, pos, inode, nil)
+}
+
+// Commit writes a checkpoint of the position and the state reached there.
+// The file is written to a temporary file, synced, renamed into place and
+// the directory is synced, so after a crash the file holds either the
+// previous checkpoint or this one, never a mix of both.
+func (t *Tracker) Commit(filename string, pos int64, inode uint64, state []byte) error {
+	crashPoint(StepWrite)
+
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
@@ -62,6 +94,7 @@ func (t *Tracker) Save(filename string, pos int64, inode uint64) error {
 		Position:    pos,
 		Inode:       inode,
 		LastUpdated: time.Now(),
+		State:       state,
 	}
 
 	data, err := json.MarshalIndent(t.position, "", "  ")
@@ -78,19 +111,58 @@ func (t *Tracker) Save(filename string, pos int64, inode uint64) error {
 	// Write to temp file in same directory as destination (guaranteed atomic rename)
 	tmpFile := t.positionFile + ".tmp"
 
-	if err := os.WriteFile(tmpFile, data, 0644); err != nil {
+	if err := writeSynced(tmpFile, data); err != nil {
+		os.Remove(tmpFile)
 		return fmt.Errorf("failed to write temp position file: %w", err)
 	}
 
 	// Atomic rename to final location
+	crashPoint(StepRename)
 	if err := os.Rename(tmpFile, t.positionFile); err != nil {
 		os.Remove(tmpFile) // Cleanup temp file on failure
 		return fmt.Errorf("failed to rename position file: %w", err)
 	}
 
+	// The rename is only durable once the directory entry is on disk
+	crashPoint(StepSyncDir)
+	if err := syncDir(dir); err != nil {
+		return fmt.Errorf("failed to sync position directory: %w", err)
+	}
+
 	return nil
 }
 
+// writeSynced writes data to a file and flushes it to disk
+func writeSynced(name string, data []byte) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	crashPoint(StepSync)
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// syncDir flushes a directory, making renames within it durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
 // GetPosition returns the last saved position and inode
 func (t *Tracker) GetPosition() (int64, uint64) {
 	t.mu.RLock()
@@ -99,6 +171,15 @@ func (t *Tracker) GetPosition() (int64, uint64) {
 	return t.position.Position, t.position.Inode
 }
 
+// State returns the state committed with the last loaded or saved position,
+// or nil if there is none
+func (t *Tracker) State() []byte {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.position.State
+}
+
 // GetFileInode returns the current inode of a file
 func GetFileInode(filename string) (uint64, error) {
 	fileInfo, err := os.Stat(filename)
@@ -0,0 +1,116 @@
+package position
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// crashed is the panic value of a simulated crash
+type crashed string
+
+// commitCrashing runs Commit and simulates a crash before step
+func commitCrashing(t *testing.T, tracker *Tracker, step string, pos int64, state []byte) {
+	t.Helper()
+
+	CrashHook = func(at string) {
+		if at == step {
+			panic(crashed(at))
+		}
+	}
+	defer func() {
+		CrashHook = nil
+		if r := recover(); r != crashed(step) {
+			t.Fatalf("Commit did not reach step %s (recovered %v)", step, r)
+		}
+	}()
+
+	tracker.Commit("access.log", pos, 1, state)
+}
+
+// lineState is a state that records the position it was taken at
+func lineState(pos int64) []byte {
+	return []byte(fmt.Sprintf(`{"lines_up_to":%d}`, pos))
+}
+
+// loadCheckpoint loads the position file as a restarted process would and
+// checks that the state belongs to the position
+func loadCheckpoint(t *testing.T, file string) int64 {
+	t.Helper()
+
+	tracker := NewTracker(file)
+	if err := tracker.Load(); err != nil {
+		t.Fatalf("Load after crash: %v", err)
+	}
+	pos, _ := tracker.GetPosition()
+
+	var state struct {
+		LinesUpTo int64 `json:"lines_up_to"`
+	}
+	if err := json.Unmarshal(tracker.State(), &state); err != nil {
+		t.Fatalf("state after crash: %v", err)
+	}
+	if state.LinesUpTo != pos {
+		t.Fatalf("position %d loaded with the state of position %d", pos, state.LinesUpTo)
+	}
+	return pos
+}
+
+func TestCommitCrashKeepsPositionAndState(t *testing.T) {
+	tests := []struct {
+		step string
+		want int64
+	}{
+		{StepWrite, 10},
+		{StepSync, 10},
+		{StepRename, 10},
+		// Renamed but not durable: a power loss may still bring back the
+		// old file, which is just as consistent
+		{StepSyncDir, 20},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.step, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "position.json")
+			if err := NewTracker(file).Commit("access.log", 10, 1, lineState(10)); err != nil {
+				t.Fatal(err)
+			}
+
+			commitCrashing(t, NewTracker(file), tt.step, 20, lineState(20))
+
+			// The temporary file was not flushed and may hold anything
+			if tt.step == StepSync {
+				if err := os.WriteFile(file+".tmp", []byte(`{"position": 2`), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if pos := loadCheckpoint(t, file); pos != tt.want {
+				t.Fatalf("position after crash = %d, want %d", pos, tt.want)
+			}
+
+			// The restarted process commits over what the crash left behind
+			if err := NewTracker(file).Commit("access.log", 30, 1, lineState(30)); err != nil {
+				t.Fatalf("Commit after crash: %v", err)
+			}
+			if pos := loadCheckpoint(t, file); pos != 30 {
+				t.Fatalf("position after restart = %d, want 30", pos)
+			}
+		})
+	}
+}
+
+func TestLoadMissingFileStartsFromBeginning(t *testing.T) {
+	tracker := NewTracker(filepath.Join(t.TempDir(), "position.json"))
+	if err := tracker.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if pos, inode := tracker.GetPosition(); pos != 0 || inode != 0 {
+		t.Fatalf("GetPosition() = %d, %d, want 0, 0", pos, inode)
+	}
+	if tracker.State() != nil {
+		t.Fatalf("State() = %s, want nil", tracker.State())
+	}
+}
@@ -0,0 +1,194 @@
+package relabel
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Actions, with the same meaning as in Prometheus relabel_configs
+const (
+	Replace   = "replace"
+	Keep      = "keep"
+	Drop      = "drop"
+	HashMod   = "hashmod"
+	LabelMap  = "labelmap"
+	LabelDrop = "labeldrop"
+	LabelKeep = "labelkeep"
+)
+
+// LabelNamePattern is the syntax of valid Prometheus label names
+const LabelNamePattern = `^[a-zA-Z_][a-zA-Z0-9_]*$`
+
+var labelNameRegex = regexp.MustCompile(LabelNamePattern)
+
+// IsValidLabelName reports whether name is a valid Prometheus label name
+func IsValidLabelName(name string) bool {
+	return labelNameRegex.MatchString(name)
+}
+
+// Config is one relabeling step. The metric name is available as __name__.
+type Config struct {
+	SourceLabels []string `yaml:"source_labels,flow,omitempty"`
+	Separator    string   `yaml:"separator,omitempty"` // default ";"
+	Regex        string   `yaml:"regex,omitempty"`     // anchored, default "(.*)"
+	Modulus      uint64   `yaml:"modulus,omitempty"`   // for hashmod
+	TargetLabel  string   `yaml:"target_label,omitempty" expand:"false"`
+	Replacement  *string  `yaml:"replacement,omitempty" expand:"false"` // default "$1"
+	Action       string   `yaml:"action,omitempty"`                     // default replace
+
+	regex *regexp.Regexp
+}
+
+// Label is a label name and value
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Compile applies defaults and validates the step
+func (c *Config) Compile() error {
+	if c.Action == "" {
+		c.Action = Replace
+	}
+	if c.Separator == "" {
+		c.Separator = ";"
+	}
+	if c.Regex == "" {
+		c.Regex = "(.*)"
+	}
+	if c.Replacement == nil {
+		replacement := "$1"
+		c.Replacement = &replacement
+	}
+
+	regex, err := regexp.Compile("^(?:" + c.Regex + ")$")
+	if err != nil {
+		return fmt.Errorf("invalid regex %q: %w", c.Regex, err)
+	}
+	c.regex = regex
+
+	switch c.Action {
+	case Replace:
+		if c.TargetLabel == "" {
+			return fmt.Errorf("relabel action %s requires target_label", c.Action)
+		}
+	case HashMod:
+		if c.TargetLabel == "" {
+			return fmt.Errorf("relabel action %s requires target_label", c.Action)
+		}
+		if c.Modulus == 0 {
+			return fmt.Errorf("relabel action %s requires a non-zero modulus", c.Action)
+		}
+		if !IsValidLabelName(c.TargetLabel) {
+			return fmt.Errorf("invalid target_label %q for action %s", c.TargetLabel, c.Action)
+		}
+	case Keep, Drop:
+		// Without source_labels the regex is matched against the empty
+		// string, as in Prometheus
+	case LabelMap, LabelDrop, LabelKeep:
+		if len(c.SourceLabels) > 0 || c.TargetLabel != "" {
+			return fmt.Errorf("relabel action %s takes no source_labels or target_label", c.Action)
+		}
+	default:
+		return fmt.Errorf("invalid relabel action %q (valid: replace, keep, drop, hashmod, labelmap, labeldrop, labelkeep)", c.Action)
+	}
+
+	return nil
+}
+
+// Process applies the steps in order. It returns false if the series is
+// dropped. Labels are returned sorted by name.
+func Process(labels []Label, configs []Config) ([]Label, bool) {
+	set := make(map[string]string, len(labels))
+	for _, label := range labels {
+		set[label.Name] = label.Value
+	}
+
+	for i := range configs {
+		if !configs[i].apply(set) {
+			return nil, false
+		}
+	}
+
+	result := make([]Label, 0, len(set))
+	for name, value := range set {
+		if value != "" {
+			result = append(result, Label{Name: name, Value: value})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+
+	return result, true
+}
+
+// apply runs one step on set, returning false if the series is dropped
+func (c *Config) apply(set map[string]string) bool {
+	values := make([]string, len(c.SourceLabels))
+	for i, name := range c.SourceLabels {
+		values[i] = set[name]
+	}
+	value := strings.Join(values, c.Separator)
+
+	switch c.Action {
+	case Keep:
+		return c.regex.MatchString(value)
+
+	case Drop:
+		return !c.regex.MatchString(value)
+
+	case Replace:
+		match := c.regex.FindStringSubmatchIndex(value)
+		if match == nil {
+			break
+		}
+		target := string(c.regex.ExpandString(nil, c.TargetLabel, value, match))
+		if !IsValidLabelName(target) {
+			break
+		}
+		replacement := string(c.regex.ExpandString(nil, *c.Replacement, value, match))
+		if replacement == "" {
+			delete(set, target)
+			break
+		}
+		set[target] = replacement
+
+	case HashMod:
+		hash := md5.Sum([]byte(value))
+		// Last 8 bytes of the hash, as Prometheus does
+		set[c.TargetLabel] = strconv.FormatUint(binary.BigEndian.Uint64(hash[8:])%c.Modulus, 10)
+
+	case LabelMap:
+		mapped := make(map[string]string)
+		for name, labelValue := range set {
+			if match := c.regex.FindStringSubmatchIndex(name); match != nil {
+				mapped[string(c.regex.ExpandString(nil, *c.Replacement, name, match))] = labelValue
+			}
+		}
+		for name, labelValue := range mapped {
+			set[name] = labelValue
+		}
+
+	case LabelDrop:
+		for name := range set {
+			if c.regex.MatchString(name) {
+				delete(set, name)
+			}
+		}
+
+	case LabelKeep:
+		for name := range set {
+			if !c.regex.MatchString(name) {
+				delete(set, name)
+			}
+		}
+	}
+
+	return true
+}
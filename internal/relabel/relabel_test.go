@@ -0,0 +1,29 @@
+package relabel
+
+import "testing"
+
+func TestKeepAndDropWithoutSourceLabels(t *testing.T) {
+	labels := []Label{{Name: "__name__", Value: "squid_connections_total"}}
+
+	tests := []struct {
+		action string
+		regex  string
+		keep   bool
+	}{
+		// The regex is matched against the empty string
+		{Keep, "", true},
+		{Keep, ".+", false},
+		{Drop, "", false},
+		{Drop, ".+", true},
+	}
+
+	for _, tt := range tests {
+		config := Config{Action: tt.action, Regex: tt.regex}
+		if err := config.Compile(); err != nil {
+			t.Fatalf("%s with regex %q: %v", tt.action, tt.regex, err)
+		}
+		if _, keep := Process(labels, []Config{config}); keep != tt.keep {
+			t.Errorf("%s with regex %q kept = %v, want %v", tt.action, tt.regex, keep, tt.keep)
+		}
+	}
+}
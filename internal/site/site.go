@@ -0,0 +1,124 @@
+package site
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"golang.org/x/net/idna"
+	"golang.org/x/net/publicsuffix"
+)
+
+// List resolves hosts to their registrable domain (eTLD+1) using the
+// Public Suffix List. The zero value uses the list embedded in the binary.
+type List struct {
+	rules      map[string]bool
+	wildcards  map[string]bool
+	exceptions map[string]bool
+}
+
+// LoadFile reads a Public Suffix List in the standard public_suffix_list.dat
+// format, replacing the embedded list
+func LoadFile(filename string) (*List, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open public suffix list: %w", err)
+	}
+	defer file.Close()
+
+	l := &List{
+		rules:      make(map[string]bool),
+		wildcards:  make(map[string]bool),
+		exceptions: make(map[string]bool),
+	}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// Rules end at the first whitespace, comments start with //
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "//") {
+			continue
+		}
+		rule := strings.Fields(line)[0]
+
+		table, name := l.rules, rule
+		switch {
+		case strings.HasPrefix(rule, "!"):
+			table, name = l.exceptions, rule[1:]
+		case strings.HasPrefix(rule, "*."):
+			table, name = l.wildcards, rule[2:]
+		}
+
+		// Hosts in Squid logs are in ASCII, so Unicode rules are stored as punycode
+		name, err := idna.ToASCII(name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid public suffix rule %q: %w", rule, err)
+		}
+		table[strings.ToLower(name)] = true
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read public suffix list: %w", err)
+	}
+
+	if len(l.rules)+len(l.wildcards) == 0 {
+		return nil, fmt.Errorf("public suffix list %s contains no rules", filename)
+	}
+
+	return l, nil
+}
+
+// RegistrableDomain returns the eTLD+1 for host, e.g. "example.co.uk" for
+// "a.b.example.co.uk". IP addresses, single-label hosts and hosts that are
+// themselves public suffixes are returned unchanged.
+func (l *List) RegistrableDomain(host string) string {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "" || net.ParseIP(host) != nil || !strings.Contains(host, ".") {
+		return host
+	}
+
+	var domain string
+	var err error
+	if l == nil || l.rules == nil {
+		domain, err = publicsuffix.EffectiveTLDPlusOne(host)
+	} else {
+		domain, err = l.effectiveTLDPlusOne(host)
+	}
+	if err != nil {
+		return host
+	}
+
+	return domain
+}
+
+// effectiveTLDPlusOne implements the Public Suffix List algorithm: exception
+// rules win, otherwise the longest matching rule is the public suffix, and the
+// implicit "*" rule applies when nothing matches
+func (l *List) effectiveTLDPlusOne(host string) (string, error) {
+	labels := strings.Split(host, ".")
+	suffixLabels := 1
+
+	for i := range labels {
+		candidate := strings.Join(labels[i:], ".")
+		n := len(labels) - i
+
+		if l.exceptions[candidate] {
+			suffixLabels = n - 1
+			break
+		}
+		if l.rules[candidate] && n > suffixLabels {
+			suffixLabels = n
+		}
+		if i > 0 && l.wildcards[candidate] && n+1 > suffixLabels {
+			suffixLabels = n + 1
+		}
+	}
+
+	if suffixLabels >= len(labels) {
+		return "", fmt.Errorf("%s is a public suffix", host)
+	}
+
+	return strings.Join(labels[len(labels)-suffixLabels-1:], "."), nil
+}
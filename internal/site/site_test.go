@@ -0,0 +1,112 @@
+package site
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testRules is a small list in public_suffix_list.dat format
+const testRules = `// ===BEGIN ICANN DOMAINS===
+com
+uk
+co.uk
+
+// Wildcard with an exception, as for Japanese city domains
+jp
+*.kawasaki.jp
+!city.kawasaki.jp
+
+// Rules end at the first whitespace
+ck	some comment
+*.ck
+!www.ck
+
+// Unicode rules, as in the official list
+cn
+公司.cn
+*.рф
+
+// ===BEGIN PRIVATE DOMAINS===
+blogspot.com
+`
+
+// loadTestList loads content as a public suffix list file
+func loadTestList(t *testing.T, content string) *List {
+	t.Helper()
+
+	file := filepath.Join(t.TempDir(), "public_suffix_list.dat")
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	l, err := LoadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func TestRegistrableDomain(t *testing.T) {
+	l := loadTestList(t, testRules)
+
+	tests := []struct {
+		host, want string
+	}{
+		{"www.example.com", "example.com"},
+		{"Example.COM.", "example.com"},
+		// Multi-label suffixes: the longest matching rule wins
+		{"a.b.example.co.uk", "example.co.uk"},
+		{"example.uk", "example.uk"},
+		{"me.blogspot.com", "me.blogspot.com"},
+		// Wildcards make every label below the suffix a public suffix
+		{"www.shop.kawasaki.jp", "www.shop.kawasaki.jp"},
+		{"a.www.shop.kawasaki.jp", "www.shop.kawasaki.jp"},
+		{"a.b.ck", "a.b.ck"},
+		// Exceptions override the wildcard
+		{"a.city.kawasaki.jp", "city.kawasaki.jp"},
+		{"www.ck", "www.ck"},
+		{"a.www.ck", "www.ck"},
+		// Unicode rules match the punycode hosts Squid logs (公司.cn, пример.рф)
+		{"www.example.xn--55qx5d.cn", "example.xn--55qx5d.cn"},
+		{"www.xn--e1afmkfd.xn--p1ai", "www.xn--e1afmkfd.xn--p1ai"},
+		{"a.www.xn--e1afmkfd.xn--p1ai", "www.xn--e1afmkfd.xn--p1ai"},
+		// Unlisted TLDs fall back to the implicit * rule
+		{"a.example.test", "example.test"},
+		// Bare suffixes, IP addresses and single labels are unchanged
+		{"co.uk", "co.uk"},
+		{"shop.kawasaki.jp", "shop.kawasaki.jp"},
+		{"blogspot.com", "blogspot.com"},
+		{"10.0.0.1", "10.0.0.1"},
+		{"::1", "::1"},
+		{"localhost", "localhost"},
+	}
+
+	for _, tt := range tests {
+		if got := l.RegistrableDomain(tt.host); got != tt.want {
+			t.Errorf("RegistrableDomain(%q) = %q, want %q", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestEmbeddedList(t *testing.T) {
+	var l *List
+	for host, want := range map[string]string{
+		"a.b.example.co.uk": "example.co.uk",
+		"www.example.com":   "example.com",
+		"co.uk":             "co.uk",
+	} {
+		if got := l.RegistrableDomain(host); got != want {
+			t.Errorf("RegistrableDomain(%q) = %q, want %q", host, got, want)
+		}
+	}
+}
+
+func TestLoadFileWithoutRules(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "empty.dat")
+	if err := os.WriteFile(file, []byte("// only comments\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadFile(file); err == nil {
+		t.Fatal("list without rules accepted")
+	}
+}
@@ -0,0 +1,140 @@
+package topk
+
+import (
+	"container/heap"
+	"sort"
+)
+
+// Item is an estimated heavy hitter. Count overestimates the true weight by
+// at most Error.
+type Item struct {
+	Key   string  `json:"key"`
+	Count float64 `json:"count"`
+	Error float64 `json:"error"`
+}
+
+// SpaceSaving tracks the heaviest keys of a weighted stream in bounded memory
+// using the Space-Saving algorithm (Metwally et al.). Any key whose true weight
+// exceeds total/capacity is guaranteed to be tracked.
+type SpaceSaving struct {
+	capacity int
+	items    map[string]*entry
+	heap     minHeap
+}
+
+type entry struct {
+	Item
+	index int
+}
+
+// New creates a sketch holding at most capacity counters
+func New(capacity int) *SpaceSaving {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &SpaceSaving{
+		capacity: capacity,
+		items:    make(map[string]*entry, capacity),
+	}
+}
+
+// Observe adds weight to key
+func (s *SpaceSaving) Observe(key string, weight float64) {
+	if weight <= 0 {
+		return
+	}
+
+	if e, ok := s.items[key]; ok {
+		e.Count += weight
+		heap.Fix(&s.heap, e.index)
+		return
+	}
+
+	if len(s.items) < s.capacity {
+		e := &entry{Item: Item{Key: key, Count: weight}}
+		s.items[key] = e
+		heap.Push(&s.heap, e)
+		return
+	}
+
+	// Replace the smallest counter; its count becomes the error bound
+	e := s.heap[0]
+	delete(s.items, e.Key)
+	e.Error = e.Count
+	e.Key = key
+	e.Count += weight
+	s.items[key] = e
+	heap.Fix(&s.heap, 0)
+}
+
+// Top returns the n heaviest keys, heaviest first
+func (s *SpaceSaving) Top(n int) []Item {
+	items := make([]Item, 0, len(s.heap))
+	for _, e := range s.heap {
+		items = append(items, e.Item)
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].Count != items[j].Count {
+			return items[i].Count > items[j].Count
+		}
+		return items[i].Key < items[j].Key
+	})
+
+	if n < len(items) {
+		items = items[:n]
+	}
+	return items
+}
+
+// Restore replaces all counters with saved items, e.g. from Top, keeping the
+// heaviest ones that fit into the capacity
+func (s *SpaceSaving) Restore(items []Item) {
+	sorted := append([]Item{}, items...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Count > sorted[j].Count
+	})
+
+	s.Reset()
+	for _, item := range sorted {
+		if len(s.items) >= s.capacity {
+			break
+		}
+		if _, ok := s.items[item.Key]; ok {
+			continue
+		}
+		e := &entry{Item: item}
+		s.items[item.Key] = e
+		heap.Push(&s.heap, e)
+	}
+}
+
+// Reset clears all counters
+func (s *SpaceSaving) Reset() {
+	s.items = make(map[string]*entry, s.capacity)
+	s.heap = nil
+}
+
+// minHeap orders entries by count, smallest first
+type minHeap []*entry
+
+func (h minHeap) Len() int           { return len(h) }
+func (h minHeap) Less(i, j int) bool { return h[i].Count < h[j].Count }
+func (h minHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *minHeap) Push(x any) {
+	e := x.(*entry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *minHeap) Pop() any {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
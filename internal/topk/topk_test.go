@@ -0,0 +1,74 @@
+package topk
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestSpaceSavingErrorBound(t *testing.T) {
+	const capacity = 50
+
+	s := New(capacity)
+	truth := make(map[string]float64)
+	total := 0.0
+
+	// A skewed stream: a few heavy keys among many light ones
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 100000; i++ {
+		key := fmt.Sprintf("key%d", int(rng.ExpFloat64()*20))
+		weight := float64(1 + rng.Intn(10))
+		s.Observe(key, weight)
+		truth[key] += weight
+		total += weight
+	}
+
+	tracked := make(map[string]Item)
+	for _, item := range s.Top(capacity) {
+		tracked[item.Key] = item
+
+		// The count overestimates by at most the error, which is at most
+		// total/capacity
+		if item.Count < truth[item.Key] || item.Count-item.Error > truth[item.Key] {
+			t.Errorf("%s: count %v, error %v, true weight %v", item.Key, item.Count, item.Error, truth[item.Key])
+		}
+		if item.Error > total/capacity {
+			t.Errorf("%s: error %v above total/capacity %v", item.Key, item.Error, total/capacity)
+		}
+	}
+
+	for key, weight := range truth {
+		if _, ok := tracked[key]; weight > total/capacity && !ok {
+			t.Errorf("%s with weight %v above total/capacity %v not tracked", key, weight, total/capacity)
+		}
+	}
+}
+
+func TestSpaceSavingEvictsSmallestCounter(t *testing.T) {
+	s := New(2)
+	s.Observe("a", 1)
+	s.Observe("b", 3)
+	s.Observe("c", 3) // replaces a, inheriting its count as error
+
+	want := []Item{{Key: "c", Count: 4, Error: 1}, {Key: "b", Count: 3}}
+	if got := s.Top(2); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("Top(2) = %v, want %v", got, want)
+	}
+
+	s.Observe("d", 2) // replaces b
+	s.Observe("c", 1)
+	want = []Item{{Key: "c", Count: 5, Error: 1}, {Key: "d", Count: 5, Error: 3}}
+	if got := s.Top(2); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("Top(2) = %v, want %v", got, want)
+	}
+}
+
+func TestSpaceSavingRestoreKeepsHeaviest(t *testing.T) {
+	s := New(2)
+	s.Restore([]Item{{Key: "a", Count: 1}, {Key: "b", Count: 5}, {Key: "c", Count: 3, Error: 1}})
+
+	want := []Item{{Key: "b", Count: 5}, {Key: "c", Count: 3, Error: 1}}
+	if got := s.Top(10); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("Top after Restore = %v, want %v", got, want)
+	}
+}
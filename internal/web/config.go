@@ -0,0 +1,280 @@
+package web
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+)
+
+// redacted replaces secret values when a web config is marshaled
+const redacted = "<secret>"
+
+// Secret is a string that is redacted when marshaled, so a web config can
+// be logged without its password hashes
+type Secret string
+
+// MarshalYAML implements yaml.Marshaler
+func (s Secret) MarshalYAML() (interface{}, error) {
+	if s == "" {
+		return "", nil
+	}
+	return redacted, nil
+}
+
+// MarshalJSON implements json.Marshaler
+func (s Secret) MarshalJSON() ([]byte, error) {
+	if s == "" {
+		return json.Marshal("")
+	}
+	return json.Marshal(redacted)
+}
+
+// Config is a web configuration file, in the format of the Prometheus
+// exporter-toolkit web.yml
+type Config struct {
+	TLSServerConfig  TLSConfig         `yaml:"tls_server_config"`
+	HTTPServerConfig HTTPConfig        `yaml:"http_server_config"`
+	BasicAuthUsers   map[string]Secret `yaml:"basic_auth_users"` // bcrypt hashes
+}
+
+// TLSConfig configures HTTPS. TLS is enabled when cert_file and key_file are set.
+type TLSConfig struct {
+	CertFile          string   `yaml:"cert_file"`
+	KeyFile           string   `yaml:"key_file"`
+	ClientAuthType    string   `yaml:"client_auth_type"` // default NoClientCert
+	ClientCAFile      string   `yaml:"client_ca_file"`
+	ClientAllowedSANs []string `yaml:"client_allowed_sans"`
+	MinVersion        string   `yaml:"min_version"` // default TLS12
+	MaxVersion        string   `yaml:"max_version"`
+	CipherSuites      []string `yaml:"cipher_suites"`
+	CurvePreferences  []string `yaml:"curve_preferences"`
+
+	// Accepted for compatibility; Go ignores it since 1.18
+	PreferServerCipherSuites bool `yaml:"prefer_server_cipher_suites"`
+}
+
+// HTTPConfig configures the HTTP server
+type HTTPConfig struct {
+	HTTP2   *bool             `yaml:"http2"` // default true
+	Headers map[string]string `yaml:"headers"`
+}
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"":                           tls.NoClientCert,
+	"NoClientCert":               tls.NoClientCert,
+	"RequestClientCert":          tls.RequestClientCert,
+	"RequireAnyClientCert":       tls.RequireAnyClientCert,
+	"VerifyClientCertIfGiven":    tls.VerifyClientCertIfGiven,
+	"RequireAndVerifyClientCert": tls.RequireAndVerifyClientCert,
+}
+
+var tlsVersions = map[string]uint16{
+	"TLS10": tls.VersionTLS10,
+	"TLS11": tls.VersionTLS11,
+	"TLS12": tls.VersionTLS12,
+	"TLS13": tls.VersionTLS13,
+}
+
+var curves = map[string]tls.CurveID{
+	"CurveP256": tls.CurveP256,
+	"CurveP384": tls.CurveP384,
+	"CurveP521": tls.CurveP521,
+	"X25519":    tls.X25519,
+}
+
+// LoadConfig reads and validates a web configuration file. Relative paths
+// are resolved against the directory of the file.
+func LoadConfig(filename string) (*Config, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read web config file: %w", err)
+	}
+
+	var webConfig Config
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&webConfig); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to parse web config: %w", err)
+	}
+
+	tlsConfig := &webConfig.TLSServerConfig
+	baseDir := filepath.Dir(filename)
+	for _, path := range []*string{&tlsConfig.CertFile, &tlsConfig.KeyFile, &tlsConfig.ClientCAFile} {
+		if *path != "" && !filepath.IsAbs(*path) {
+			*path = filepath.Join(baseDir, *path)
+		}
+	}
+
+	if (tlsConfig.CertFile == "") != (tlsConfig.KeyFile == "") {
+		return nil, fmt.Errorf("tls_server_config: cert_file and key_file must be set together")
+	}
+	if tlsConfig.CertFile == "" && (tlsConfig.ClientCAFile != "" || tlsConfig.ClientAuthType != "") {
+		return nil, fmt.Errorf("tls_server_config: client authentication requires cert_file and key_file")
+	}
+	// Building the TLS config checks everything else, including the files
+	if _, err := webConfig.tlsConfig(); err != nil {
+		return nil, err
+	}
+
+	for user, hash := range webConfig.BasicAuthUsers {
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("basic_auth_users: invalid bcrypt hash for user %s: %w", user, err)
+		}
+	}
+
+	return &webConfig, nil
+}
+
+// TLSEnabled reports whether the server should serve HTTPS
+func (c *Config) TLSEnabled() bool {
+	return c.TLSServerConfig.CertFile != ""
+}
+
+// HTTP2 reports whether HTTP/2 is enabled (the default)
+func (c *Config) HTTP2() bool {
+	return c.HTTPServerConfig.HTTP2 == nil || *c.HTTPServerConfig.HTTP2
+}
+
+// tlsConfig builds the server TLS configuration, reading the certificate,
+// key and client CA files. It returns nil if TLS is disabled.
+func (c *Config) tlsConfig() (*tls.Config, error) {
+	t := c.TLSServerConfig
+	if t.CertFile == "" {
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("tls_server_config: failed to load certificate: %w", err)
+	}
+
+	result := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	clientAuth, ok := clientAuthTypes[t.ClientAuthType]
+	if !ok {
+		return nil, fmt.Errorf("tls_server_config: invalid client_auth_type %q (valid: %s)", t.ClientAuthType, validNames(clientAuthTypes))
+	}
+	result.ClientAuth = clientAuth
+
+	if t.ClientCAFile != "" {
+		pem, err := os.ReadFile(t.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("tls_server_config: failed to read client_ca_file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("tls_server_config: no certificates found in %s", t.ClientCAFile)
+		}
+		result.ClientCAs = pool
+	} else if clientAuth == tls.VerifyClientCertIfGiven || clientAuth == tls.RequireAndVerifyClientCert {
+		return nil, fmt.Errorf("tls_server_config: client_auth_type %s requires client_ca_file", t.ClientAuthType)
+	}
+
+	if len(t.ClientAllowedSANs) > 0 {
+		if clientAuth != tls.RequireAndVerifyClientCert && clientAuth != tls.VerifyClientCertIfGiven {
+			return nil, fmt.Errorf("tls_server_config: client_allowed_sans requires a verifying client_auth_type")
+		}
+		result.VerifyPeerCertificate = verifySANs(t.ClientAllowedSANs)
+	}
+
+	if t.MinVersion != "" {
+		version, ok := tlsVersions[t.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("tls_server_config: invalid min_version %q (valid: %s)", t.MinVersion, validNames(tlsVersions))
+		}
+		result.MinVersion = version
+	}
+	if t.MaxVersion != "" {
+		version, ok := tlsVersions[t.MaxVersion]
+		if !ok {
+			return nil, fmt.Errorf("tls_server_config: invalid max_version %q (valid: %s)", t.MaxVersion, validNames(tlsVersions))
+		}
+		result.MaxVersion = version
+	}
+	if result.MaxVersion != 0 && result.MaxVersion < result.MinVersion {
+		return nil, fmt.Errorf("tls_server_config: max_version is lower than min_version")
+	}
+
+	if len(t.CipherSuites) > 0 {
+		suites := make(map[string]uint16)
+		for _, suite := range tls.CipherSuites() {
+			suites[suite.Name] = suite.ID
+		}
+		for _, name := range t.CipherSuites {
+			id, ok := suites[name]
+			if !ok {
+				return nil, fmt.Errorf("tls_server_config: unknown or insecure cipher suite %q", name)
+			}
+			result.CipherSuites = append(result.CipherSuites, id)
+		}
+	}
+
+	for _, name := range t.CurvePreferences {
+		curve, ok := curves[name]
+		if !ok {
+			return nil, fmt.Errorf("tls_server_config: invalid curve %q (valid: %s)", name, validNames(curves))
+		}
+		result.CurvePreferences = append(result.CurvePreferences, curve)
+	}
+
+	return result, nil
+}
+
+// verifySANs accepts a verified client certificate only if one of its
+// subject alternative names is in allowed
+func verifySANs(allowed []string) func([][]byte, [][]*x509.Certificate) error {
+	return func(_ [][]byte, chains [][]*x509.Certificate) error {
+		if len(chains) == 0 {
+			// No certificate given, which client_auth_type allowed
+			return nil
+		}
+		for _, chain := range chains {
+			if len(chain) == 0 {
+				continue
+			}
+			cert := chain[0]
+			names := append([]string{}, cert.DNSNames...)
+			names = append(names, cert.EmailAddresses...)
+			for _, ip := range cert.IPAddresses {
+				names = append(names, ip.String())
+			}
+			for _, uri := range cert.URIs {
+				names = append(names, uri.String())
+			}
+			for _, name := range names {
+				for _, want := range allowed {
+					if name == want {
+						return nil
+					}
+				}
+			}
+		}
+		return fmt.Errorf("client certificate has no allowed subject alternative name")
+	}
+}
+
+// validNames lists the non-empty keys of a lookup table for error messages
+func validNames[T any](table map[string]T) string {
+	names := make([]string, 0, len(table))
+	for name := range table {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,223 @@
+package web
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// dummyHash is checked for unknown users, so the response time does not
+// reveal which user names exist
+const dummyHash Secret = "$2a$10$bI2mAnvS7M8.by1hqBPGuOKar9gZYRTyrSt.LmPiKlbQqQdVTKxbG"
+
+// maxAuthCache bounds the cache of successful logins; bcrypt is
+// deliberately slow and Prometheus sends the same credentials every scrape
+const maxAuthCache = 1000
+
+// reloadCheckInterval limits how often the files are checked for changes
+const reloadCheckInterval = time.Second
+
+// Server serves HTTP, or HTTPS if the web config enables TLS. The web config
+// and the certificate files it references are re-read when they change, so
+// certificates can be rotated and users edited without a restart.
+type Server struct {
+	file string
+
+	mu        sync.Mutex
+	config    *Config
+	tlsConfig *tls.Config
+	modTimes  map[string]time.Time
+	checked   time.Time
+
+	authMu    sync.Mutex
+	authCache map[[sha256.Size]byte]struct{}
+}
+
+// NewServer loads a web config file. With an empty file name the server
+// uses plain HTTP without authentication.
+func NewServer(file string) (*Server, error) {
+	s := &Server{
+		file:      file,
+		config:    &Config{},
+		authCache: make(map[[sha256.Size]byte]struct{}),
+	}
+	if file == "" {
+		return s, nil
+	}
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	s.checked = time.Now()
+	return s, nil
+}
+
+// load reads the web config file and builds its TLS configuration. The
+// caller must hold mu, except during NewServer.
+func (s *Server) load() error {
+	webConfig, err := LoadConfig(s.file)
+	if err != nil {
+		return err
+	}
+	if s.config.TLSEnabled() != webConfig.TLSEnabled() && s.modTimes != nil {
+		return fmt.Errorf("enabling or disabling TLS requires a restart")
+	}
+
+	tlsConfig, err := webConfig.tlsConfig()
+	if err != nil {
+		return err
+	}
+	if tlsConfig != nil {
+		tlsConfig.NextProtos = []string{"http/1.1"}
+		if webConfig.HTTP2() {
+			tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+		}
+	}
+
+	s.config = webConfig
+	s.tlsConfig = tlsConfig
+	s.modTimes = modTimes(s.file, webConfig)
+	return nil
+}
+
+// modTimes returns the modification times of the web config file and the
+// files it references
+func modTimes(file string, webConfig *Config) map[string]time.Time {
+	times := make(map[string]time.Time)
+	for _, path := range []string{file, webConfig.TLSServerConfig.CertFile, webConfig.TLSServerConfig.KeyFile, webConfig.TLSServerConfig.ClientCAFile} {
+		if path == "" {
+			continue
+		}
+		if info, err := os.Stat(path); err == nil {
+			times[path] = info.ModTime()
+		}
+	}
+	return times
+}
+
+// current returns the web config and TLS configuration, reloading them if
+// any of the files changed. An invalid new config is logged and the
+// previous one kept.
+func (s *Server) current() (*Config, *tls.Config) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == "" || time.Since(s.checked) < reloadCheckInterval {
+		return s.config, s.tlsConfig
+	}
+	s.checked = time.Now()
+
+	times := modTimes(s.file, s.config)
+	if sameModTimes(times, s.modTimes) {
+		return s.config, s.tlsConfig
+	}
+
+	if err := s.load(); err != nil {
+		log.Printf("Failed to reload web config %s, keeping the previous one: %v", s.file, err)
+		// Do not retry until the files change again
+		s.modTimes = times
+		return s.config, s.tlsConfig
+	}
+	log.Printf("Reloaded web config %s", s.file)
+
+	return s.config, s.tlsConfig
+}
+
+func sameModTimes(a, b map[string]time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for path, modTime := range a {
+		if !b[path].Equal(modTime) {
+			return false
+		}
+	}
+	return true
+}
+
+// TLSEnabled reports whether the server serves HTTPS
+func (s *Server) TLSEnabled() bool {
+	webConfig, _ := s.current()
+	return webConfig.TLSEnabled()
+}
+
+// ListenAndServe serves server.Handler on server.Addr, adding basic
+// authentication, response headers and TLS as configured
+func (s *Server) ListenAndServe(server *http.Server) error {
+	webConfig, tlsConfig := s.current()
+	server.Handler = s.handler(server.Handler)
+	if !webConfig.HTTP2() {
+		server.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
+
+	if tlsConfig == nil {
+		return server.ListenAndServe()
+	}
+
+	// Every handshake picks up the latest certificates
+	server.TLSConfig = &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			_, tlsConfig := s.current()
+			return tlsConfig, nil
+		},
+	}
+	return server.ListenAndServeTLS("", "")
+}
+
+// handler wraps next with response headers and basic authentication
+func (s *Server) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		webConfig, _ := s.current()
+		for name, value := range webConfig.HTTPServerConfig.Headers {
+			w.Header().Set(name, value)
+		}
+
+		if len(webConfig.BasicAuthUsers) > 0 {
+			user, password, ok := r.BasicAuth()
+			if !ok || !s.authenticate(webConfig, user, password) {
+				w.Header().Set("WWW-Authenticate", `Basic realm="squid-log-exporter"`)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authenticate checks a password against the user's bcrypt hash. Successful
+// logins are cached by user, hash and password.
+func (s *Server) authenticate(webConfig *Config, user, password string) bool {
+	hash, known := webConfig.BasicAuthUsers[user]
+	if !known {
+		hash = dummyHash
+	}
+
+	key := sha256.Sum256([]byte(user + "\x00" + string(hash) + "\x00" + password))
+	s.authMu.Lock()
+	_, cached := s.authCache[key]
+	s.authMu.Unlock()
+	if cached {
+		return known
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil || !known {
+		return false
+	}
+
+	s.authMu.Lock()
+	if len(s.authCache) >= maxAuthCache {
+		s.authCache = make(map[[sha256.Size]byte]struct{})
+	}
+	s.authCache[key] = struct{}{}
+	s.authMu.Unlock()
+
+	return true
+}
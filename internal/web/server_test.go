@@ -0,0 +1,351 @@
+package web
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// writeFile writes a file and moves its modification time forward, so a
+// rewrite within the same second is seen as a change
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+
+	var modTime time.Time
+	if info, err := os.Stat(path); err == nil {
+		modTime = info.ModTime().Add(time.Second)
+	} else {
+		modTime = time.Now()
+	}
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// hashPassword returns a bcrypt hash of password at the lowest cost
+func hashPassword(t *testing.T, password string) string {
+	t.Helper()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(hash)
+}
+
+// recheck makes the next request check the files for changes
+func (s *Server) recheck() {
+	s.mu.Lock()
+	s.checked = time.Time{}
+	s.mu.Unlock()
+}
+
+// newAuthServer serves an OK handler behind basic authentication of the
+// users in the web config file, which is returned
+func newAuthServer(t *testing.T, users string) (*Server, *httptest.Server, string) {
+	t.Helper()
+
+	file := filepath.Join(t.TempDir(), "web.yml")
+	writeFile(t, file, "basic_auth_users:\n"+users)
+	s, err := NewServer(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s.handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	})))
+	t.Cleanup(ts.Close)
+	return s, ts, file
+}
+
+// get requests url with optional basic auth credentials and returns the status
+func get(t *testing.T, url string, credentials ...string) int {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(credentials) == 2 {
+		req.SetBasicAuth(credentials[0], credentials[1])
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestBasicAuthRejectsWrongCredentials(t *testing.T) {
+	_, ts, _ := newAuthServer(t, fmt.Sprintf("  prometheus: %s\n", hashPassword(t, "secret")))
+
+	tests := []struct {
+		name        string
+		credentials []string
+		want        int
+	}{
+		{"valid", []string{"prometheus", "secret"}, http.StatusOK},
+		{"wrong password", []string{"prometheus", "wrong"}, http.StatusUnauthorized},
+		{"unknown user", []string{"nobody", "secret"}, http.StatusUnauthorized},
+		{"no header", nil, http.StatusUnauthorized},
+		// A cached success must not let other credentials through
+		{"wrong password after success", []string{"prometheus", "wrong"}, http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		if status := get(t, ts.URL, tt.credentials...); status != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, status, tt.want)
+		}
+	}
+}
+
+func TestBasicAuthCacheFollowsUsersFile(t *testing.T) {
+	s, ts, file := newAuthServer(t, fmt.Sprintf("  prometheus: %s\n", hashPassword(t, "old")))
+
+	if status := get(t, ts.URL, "prometheus", "old"); status != http.StatusOK {
+		t.Fatalf("status %d with the old password", status)
+	}
+
+	writeFile(t, file, fmt.Sprintf("basic_auth_users:\n  prometheus: %s\n", hashPassword(t, "new")))
+	s.recheck()
+
+	if status := get(t, ts.URL, "prometheus", "old"); status != http.StatusUnauthorized {
+		t.Errorf("status %d with the cached old password, want 401", status)
+	}
+	if status := get(t, ts.URL, "prometheus", "new"); status != http.StatusOK {
+		t.Errorf("status %d with the new password, want 200", status)
+	}
+
+	// A removed user is rejected even though the login was cached
+	writeFile(t, file, fmt.Sprintf("basic_auth_users:\n  other: %s\n", hashPassword(t, "new")))
+	s.recheck()
+	if status := get(t, ts.URL, "prometheus", "new"); status != http.StatusUnauthorized {
+		t.Errorf("status %d for a removed user, want 401", status)
+	}
+}
+
+// testCA issues certificates for TLS tests
+type testCA struct {
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	pem    string
+	serial int64
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{
+		cert:   cert,
+		key:    key,
+		pem:    string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		serial: 1,
+	}
+}
+
+// issue returns a PEM certificate and key for name, valid for usage
+func (ca *testCA) issue(t *testing.T, name string, usage x509.ExtKeyUsage) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca.serial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(ca.serial),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+}
+
+// clientCert returns a client certificate for name as used by tls.Config
+func (ca *testCA) clientCert(t *testing.T, name string) tls.Certificate {
+	t.Helper()
+
+	certPEM, keyPEM := ca.issue(t, name, x509.ExtKeyUsageClientAuth)
+	cert, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// tlsTestServer is a Server serving HTTPS from files in a temporary directory
+type tlsTestServer struct {
+	*Server
+	ca   *testCA
+	dir  string
+	addr string
+}
+
+// newTLSServer serves an OK handler over HTTPS with a certificate for
+// server.example, issued by a new CA that also signs client certificates.
+// extra is appended to tls_server_config.
+func newTLSServer(t *testing.T, extra string) *tlsTestServer {
+	t.Helper()
+
+	ts := &tlsTestServer{ca: newTestCA(t), dir: t.TempDir()}
+	ts.rotate(t, "server.example")
+	writeFile(t, filepath.Join(ts.dir, "ca.pem"), ts.ca.pem)
+	writeFile(t, filepath.Join(ts.dir, "web.yml"), "tls_server_config:\n  cert_file: server.pem\n  key_file: server.key\n"+extra)
+
+	s, err := NewServer(filepath.Join(ts.dir, "web.yml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.Server = s
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.addr = listener.Addr().String()
+	listener.Close()
+
+	server := &http.Server{
+		Addr: ts.addr,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "ok")
+		}),
+	}
+	go s.ListenAndServe(server)
+	t.Cleanup(func() { server.Close() })
+
+	// Wait until the server accepts connections
+	for i := 0; ; i++ {
+		conn, err := net.Dial("tcp", ts.addr)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if i == 100 {
+			t.Fatalf("server not listening: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return ts
+}
+
+// rotate replaces the server certificate files with a new certificate for name
+func (ts *tlsTestServer) rotate(t *testing.T, name string) {
+	t.Helper()
+
+	certPEM, keyPEM := ts.ca.issue(t, name, x509.ExtKeyUsageServerAuth)
+	writeFile(t, filepath.Join(ts.dir, "server.pem"), certPEM)
+	writeFile(t, filepath.Join(ts.dir, "server.key"), keyPEM)
+}
+
+// dial makes a new TLS connection and returns the server certificate name
+func (ts *tlsTestServer) dial(t *testing.T, clientCerts ...tls.Certificate) (string, error) {
+	t.Helper()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ts.ca.cert)
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: clientCerts},
+	}}
+	defer client.CloseIdleConnections()
+
+	resp, err := client.Get("https://" + ts.addr + "/")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return resp.TLS.PeerCertificates[0].Subject.CommonName, nil
+}
+
+func TestTLSClientAllowedSANs(t *testing.T) {
+	ts := newTLSServer(t, `  client_auth_type: RequireAndVerifyClientCert
+  client_ca_file: ca.pem
+  client_allowed_sans: [prometheus.example]
+`)
+
+	if _, err := ts.dial(t, ts.ca.clientCert(t, "prometheus.example")); err != nil {
+		t.Errorf("client with an allowed SAN rejected: %v", err)
+	}
+	if _, err := ts.dial(t, ts.ca.clientCert(t, "intruder.example")); err == nil {
+		t.Error("client with a disallowed SAN accepted")
+	}
+	if _, err := ts.dial(t); err == nil {
+		t.Error("client without a certificate accepted")
+	}
+
+	// A certificate with an allowed SAN from another CA is not verified
+	if _, err := ts.dial(t, newTestCA(t).clientCert(t, "prometheus.example")); err == nil {
+		t.Error("client certificate of an unknown CA accepted")
+	}
+}
+
+func TestTLSServesRotatedCertificate(t *testing.T) {
+	ts := newTLSServer(t, "")
+
+	if name, err := ts.dial(t); err != nil || name != "server.example" {
+		t.Fatalf("certificate %q, %v before rotation", name, err)
+	}
+
+	ts.rotate(t, "rotated.example")
+	ts.recheck()
+
+	if name, err := ts.dial(t); err != nil || name != "rotated.example" {
+		t.Fatalf("certificate %q, %v after rotation, want rotated.example", name, err)
+	}
+}